@@ -0,0 +1,323 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+const (
+	apiPrefix = "/v1/faxes"
+
+	maxUploadSize   = 64 << 20
+	maxUploadMemory = 8 << 20
+
+	defaultListLimit = 50
+)
+
+// apiServer implements the HTTP/JSON API
+type apiServer struct {
+	q           *jobQueue
+	token       string
+	ghostscript string
+}
+
+// apiError is returned as JSON with the status code
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func newAPIError(code int, format string, a ...interface{}) *apiError {
+	return &apiError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix, s.handleFaxes)
+	mux.HandleFunc(apiPrefix+"/", s.handleFax)
+	return s.authenticate(mux)
+}
+
+// authenticate requires the configured token as bearer token
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gofaxapi"`)
+				writeError(w, newAPIError(http.StatusUnauthorized, "invalid or missing token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleFaxes lists or submits jobs
+func (s *apiServer) handleFaxes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit := defaultListLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+				writeError(w, newAPIError(http.StatusBadRequest, "invalid limit %q", l))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, s.q.List(r.URL.Query().Get("state"), limit))
+
+	case http.MethodPost:
+		job, err := s.submit(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Location", apiPrefix+"/"+job.ID)
+		writeJSON(w, http.StatusCreated, job)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "method %v not allowed", r.Method))
+	}
+}
+
+// handleFax shows or cancels a job
+func (s *apiServer) handleFax(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/")
+
+	var job Job
+	var err error
+	code := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		job, err = s.q.Get(id)
+	case http.MethodDelete:
+		job, err = s.q.Cancel(id)
+		if job.State == stateSending {
+			// Cancelled when the call is hung up
+			code = http.StatusAccepted
+		}
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "method %v not allowed", r.Method))
+		return
+	}
+
+	switch err {
+	case nil:
+		writeJSON(w, code, job)
+	case errJobNotFound:
+		writeError(w, newAPIError(http.StatusNotFound, "%v", err))
+	case errJobFinished:
+		writeError(w, newAPIError(http.StatusConflict, "%v", err))
+	default:
+		writeError(w, err)
+	}
+}
+
+// submit creates a job from a multipart/form-data request
+func (s *apiServer) submit(w http.ResponseWriter, r *http.Request) (Job, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return Job{}, newAPIError(http.StatusBadRequest, "invalid form: %v", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	number := strings.TrimSpace(r.FormValue("number"))
+	if number == "" {
+		return Job{}, newAPIError(http.StatusBadRequest, "number is required")
+	}
+	if gofaxlib.Config.Dialplan.CountryCode != "" {
+		if _, _, _, err := gofaxsend.NormalizeNumber(number); err != nil {
+			return Job{}, newAPIError(http.StatusBadRequest, "invalid number: %v", err)
+		}
+	}
+
+	ecm, err := formBool(r, "ecm", true)
+	if err != nil {
+		return Job{}, err
+	}
+	v17, err := formBool(r, "v17", true)
+	if err != nil {
+		return Job{}, err
+	}
+	now := time.Now()
+	next := now
+	if sendat := r.FormValue("sendat"); sendat != "" {
+		if next, err = time.Parse(time.RFC3339, sendat); err != nil {
+			return Job{}, newAPIError(http.StatusBadRequest, "invalid sendat %q, expected RFC 3339 time", sendat)
+		}
+	}
+	owner := r.FormValue("owner")
+	if owner == "" {
+		owner = deviceID
+	}
+
+	uploads := r.MultipartForm.File["document"]
+	if len(uploads) == 0 {
+		return Job{}, newAPIError(http.StatusBadRequest, "at least one document is required")
+	}
+
+	jobid, err := gofaxlib.GetSeqFor("sendq")
+	if err != nil {
+		return Job{}, fmt.Errorf("allocating job id: %w", err)
+	}
+	id := strconv.FormatUint(jobid, 10)
+
+	var documents []string
+	var pages int
+	for n, upload := range uploads {
+		filename := filepath.Join(s.q.dir, fmt.Sprintf("%s-%d.tif", id, n+1))
+		documents = append(documents, filename)
+		p, err := s.storeDocument(r.Context(), upload, filename)
+		if err != nil {
+			removeFiles(documents)
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				apiErr.msg = fmt.Sprintf("document %d (%s): %s", n+1, upload.Filename, apiErr.msg)
+			}
+			return Job{}, err
+		}
+		pages += p
+	}
+
+	job := &Job{
+		ID:        id,
+		State:     stateQueued,
+		Number:    number,
+		Sender:    r.FormValue("sender"),
+		Tag:       r.FormValue("tag"),
+		Created:   now,
+		Updated:   now,
+		Next:      &next,
+		Documents: documents,
+		Params:    newParams(jobid, number, r.FormValue("sender"), owner, r.FormValue("tag"), ecm, v17, documents, pages),
+	}
+	if err = s.q.Submit(job); err != nil {
+		removeFiles(documents)
+		return Job{}, err
+	}
+	logger.Logger.Printf("Job %v: Submitted fax to %v with %d pages", id, number, pages)
+	return s.q.Get(id)
+}
+
+// storeDocument saves an uploaded TIFF or PDF as fax TIFF and returns its number of pages
+func (s *apiServer) storeDocument(ctx context.Context, upload *multipart.FileHeader, filename string) (int, error) {
+	src, err := upload.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	tmp := filename + ".upload"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err = dst.Close(); err != nil {
+		return 0, err
+	}
+
+	format, err := documentFormat(tmp)
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case formatTIFF:
+		if err = os.Rename(tmp, filename); err != nil {
+			return 0, err
+		}
+	case formatPDF:
+		if err = convertPDF(ctx, s.ghostscript, tmp, filename); err != nil {
+			return 0, newAPIError(http.StatusUnprocessableEntity, "%v", err)
+		}
+	default:
+		return 0, newAPIError(http.StatusUnsupportedMediaType, "unsupported format, expected TIFF or PDF")
+	}
+
+	pages, err := checkDocument(filename)
+	if err != nil {
+		return 0, newAPIError(http.StatusUnprocessableEntity, "%v", err)
+	}
+	return pages, nil
+}
+
+// formBool parses an optional boolean form value
+func formBool(r *http.Request, name string, def bool) (bool, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, newAPIError(http.StatusBadRequest, "invalid %v %q, expected true or false", name, value)
+	}
+	return b, nil
+}
+
+func removeFiles(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Logger.Print("Error writing response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		logger.Logger.Print(err)
+		apiErr = newAPIError(http.StatusInternalServerError, "%v", err)
+	}
+	writeJSON(w, apiErr.code, map[string]string{"error": apiErr.msg})
+}
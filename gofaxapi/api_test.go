@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testTIFF    = "../gofaxsend/testdata/pages,3.tif"
+	invalidTIFF = "../gofaxsend/testdata/invalid.tif"
+)
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupAPITest creates a spool directory and a job queue without workers
+func setupAPITest(t *testing.T) (*apiServer, string) {
+	spooldir, err := ioutil.TempDir("", "gofaxapi")
+	must(t, err)
+	for _, dir := range []string{"sendq", "log"} {
+		must(t, os.Mkdir(filepath.Join(spooldir, dir), 0755))
+	}
+	gofaxlib.Config.Hylafax.Spooldir = spooldir
+	gofaxlib.Config.Dialplan.CountryCode = ""
+
+	wd, err := os.Getwd()
+	must(t, err)
+	must(t, os.Chdir(spooldir))
+
+	q, err := newJobQueue(jobsDir)
+	must(t, err)
+
+	t.Cleanup(func() {
+		q.Stop()
+		os.Chdir(wd)
+		os.RemoveAll(spooldir)
+	})
+
+	return &apiServer{q: q}, spooldir
+}
+
+type testDocument struct {
+	name string
+	data []byte
+}
+
+// readDocument has to be called before changing to the spool directory
+func readDocument(t *testing.T, filename string) testDocument {
+	data, err := ioutil.ReadFile(filename)
+	must(t, err)
+	return testDocument{name: filepath.Base(filename), data: data}
+}
+
+func submitRequest(t *testing.T, fields map[string]string, docs ...testDocument) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		must(t, mw.WriteField(k, v))
+	}
+	for _, doc := range docs {
+		w, err := mw.CreateFormFile("document", doc.name)
+		must(t, err)
+		_, err = w.Write(doc.data)
+		must(t, err)
+	}
+	must(t, mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, apiPrefix, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func serve(s *apiServer, r *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestSubmitAndCancel(t *testing.T) {
+	tiff := readDocument(t, testTIFF)
+	s, spooldir := setupAPITest(t)
+	assert := assert.New(t)
+
+	w, job := serve(s, submitRequest(t, map[string]string{
+		"number": "04012345",
+		"sender": "Max Mustermann",
+		"ecm":    "false",
+	}, tiff))
+	assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal("1", job["id"])
+	assert.Equal(apiPrefix+"/1", w.Header().Get("Location"))
+	assert.Equal(stateQueued, job["state"])
+	assert.Equal("04012345", job["number"])
+	assert.EqualValues(3, job["pages"])
+	assert.Nil(job["params"])
+
+	stored := s.q.jobs["1"]
+	document := filepath.Join(jobsDir, "1-1.tif")
+	assert.Equal([]string{"0::" + document}, stored.Params["fax"])
+	assert.Equal([]string{"0"}, stored.Params["desiredec"])
+	assert.Equal([]string{"Max Mustermann"}, stored.Params["sender"])
+	assert.FileExists(filepath.Join(spooldir, document))
+	assert.FileExists(filepath.Join(spooldir, jobsDir, "1.json"))
+
+	w, job = serve(s, httptest.NewRequest(http.MethodGet, apiPrefix+"/1", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("Queued", job["status"])
+
+	w, _ = serve(s, httptest.NewRequest(http.MethodGet, apiPrefix+"?state=queued", nil))
+	var jobs []Job
+	must(t, json.Unmarshal(w.Body.Bytes(), &jobs))
+	if assert.Len(jobs, 1) {
+		assert.Equal("1", jobs[0].ID)
+	}
+
+	w, job = serve(s, httptest.NewRequest(http.MethodDelete, apiPrefix+"/1", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(stateCancelled, job["state"])
+	assert.NoFileExists(filepath.Join(spooldir, document))
+
+	w, resp := serve(s, httptest.NewRequest(http.MethodDelete, apiPrefix+"/1", nil))
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.Equal("job is already finished", resp["error"])
+
+	w, _ = serve(s, httptest.NewRequest(http.MethodGet, apiPrefix+"/2", nil))
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w, _ = serve(s, httptest.NewRequest(http.MethodPut, apiPrefix+"/1", nil))
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestSubmitErrors(t *testing.T) {
+	tiff := readDocument(t, testTIFF)
+	invalid := readDocument(t, invalidTIFF)
+	s, spooldir := setupAPITest(t)
+
+	for _, tc := range []struct {
+		name   string
+		fields map[string]string
+		docs   []testDocument
+		code   int
+		err    string
+	}{
+		{"no number", nil, []testDocument{tiff}, http.StatusBadRequest, "number is required"},
+		{"no document", map[string]string{"number": "123"}, nil, http.StatusBadRequest, "at least one document is required"},
+		{"invalid option", map[string]string{"number": "123", "ecm": "maybe"}, []testDocument{tiff}, http.StatusBadRequest, `invalid ecm "maybe", expected true or false`},
+		{"invalid sendat", map[string]string{"number": "123", "sendat": "tomorrow"}, []testDocument{tiff}, http.StatusBadRequest, `invalid sendat "tomorrow", expected RFC 3339 time`},
+		{"invalid page", map[string]string{"number": "123"}, []testDocument{tiff, invalid}, http.StatusUnprocessableEntity, "document 2 (invalid.tif): page 2: invalid page width 1000"},
+		{"unknown format", map[string]string{"number": "123"}, []testDocument{{"fax.txt", []byte("Hello")}}, http.StatusUnsupportedMediaType, "document 1 (fax.txt): unsupported format, expected TIFF or PDF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, resp := serve(s, submitRequest(t, tc.fields, tc.docs...))
+			assert.Equal(t, tc.code, w.Code)
+			assert.Equal(t, tc.err, resp["error"])
+		})
+	}
+
+	// Nothing is left behind by failed submissions
+	files, err := ioutil.ReadDir(filepath.Join(spooldir, jobsDir))
+	must(t, err)
+	assert.Empty(t, files)
+	assert.Empty(t, s.q.jobs)
+}
+
+func TestSubmitPDF(t *testing.T) {
+	tiff, err := filepath.Abs(testTIFF)
+	must(t, err)
+	s, spooldir := setupAPITest(t)
+	pdf := testDocument{"fax.pdf", []byte("%PDF-1.4\n")}
+
+	// Fake Ghostscript writing the test TIFF
+	s.ghostscript = filepath.Join(spooldir, "gs")
+	script := fmt.Sprintf("#!/bin/sh\nfor arg; do case $arg in -sOutputFile=*) cp '%s' \"${arg#-sOutputFile=}\";; esac; done\n", tiff)
+	must(t, ioutil.WriteFile(s.ghostscript, []byte(script), 0755))
+
+	w, job := serve(s, submitRequest(t, map[string]string{"number": "123"}, pdf))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.EqualValues(t, 3, job["pages"])
+	assert.FileExists(t, filepath.Join(spooldir, jobsDir, "1-1.tif"))
+
+	must(t, ioutil.WriteFile(s.ghostscript, []byte("#!/bin/sh\necho 'Unrecoverable error' >&2\nexit 1\n"), 0755))
+	w, resp := serve(s, submitRequest(t, map[string]string{"number": "123"}, pdf))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "document 1 (fax.pdf): converting PDF: exit status 1: Unrecoverable error", resp["error"])
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _ := setupAPITest(t)
+	s.token = "secret"
+
+	w, _ := serve(s, httptest.NewRequest(http.MethodGet, apiPrefix, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest(http.MethodGet, apiPrefix, nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w, _ = serve(s, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r.Header.Set("Authorization", "Bearer secret")
+	w, _ = serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+}
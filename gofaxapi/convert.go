@@ -0,0 +1,114 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
+)
+
+const (
+	formatUnknown = iota
+	formatTIFF
+	formatPDF
+
+	defaultGhostscript = "gs"
+	convertTimeout     = 2 * time.Minute
+)
+
+// documentFormat detects the format of a document by its magic number
+func documentFormat(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return formatUnknown, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(f, magic); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return formatUnknown, nil
+		}
+		return formatUnknown, err
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte("II*\x00")), bytes.Equal(magic, []byte("MM\x00*")):
+		return formatTIFF, nil
+	case bytes.Equal(magic, []byte("%PDF")):
+		return formatPDF, nil
+	}
+	return formatUnknown, nil
+}
+
+// convertPDF renders a PDF document to a G4 compressed TIFF
+// with fax page width and fine resolution using Ghostscript.
+// Pages are scaled to fit A4.
+func convertPDF(ctx context.Context, ghostscript, in, out string) error {
+	if ghostscript == "" {
+		ghostscript = defaultGhostscript
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, convertTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, ghostscript,
+		"-q", "-dSAFER", "-dBATCH", "-dNOPAUSE",
+		"-sDEVICE=tiffg4", "-r204x196",
+		"-dDEVICEWIDTH=1728", "-dDEVICEHEIGHT=2292",
+		"-dFIXEDMEDIA", "-dPDFFitPage",
+		"-sOutputFile="+out, in)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(out)
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("converting PDF: %v: %s", err, msg)
+		}
+		return fmt.Errorf("converting PDF: %v", err)
+	}
+	return nil
+}
+
+// checkDocument returns the number of pages of a TIFF
+// if all pages can be sent without conversion
+func checkDocument(filename string) (int, error) {
+	file, err := tiff.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	for i, ifd := range file.IFDs {
+		if err = ifd.CheckFax(); err != nil {
+			return 0, fmt.Errorf("page %d: %w", i+1, err)
+		}
+	}
+	if len(file.IFDs) == 0 {
+		return 0, errors.New("document has no pages")
+	}
+	return len(file.IFDs), nil
+}
@@ -0,0 +1,182 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+// States of a job
+const (
+	stateQueued    = "queued"
+	stateSending   = "sending"
+	stateDone      = "done"
+	stateFailed    = "failed"
+	stateCancelled = "cancelled"
+)
+
+// Job is a fax submitted using the API. The queue file tags used by
+// gofaxsend are kept in Params, so all attempts share the state HylaFAX
+// would keep in the qfile (counters, remaining documents, ...).
+type Job struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	Number    string    `json:"number"`
+	Sender    string    `json:"sender,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Cancelled bool      `json:"cancelled,omitempty"`
+	// Time of the next attempt of a queued job
+	Next *time.Time `json:"next,omitempty"`
+
+	// Filled from Params when the job is shown
+	Status    string `json:"status,omitempty"`
+	Pages     int    `json:"pages"`
+	SentPages int    `json:"sentpages"`
+	Dials     int    `json:"dials"`
+	Tries     int    `json:"tries"`
+
+	// Pages confirmed by the receiver, numbered across all attempts
+	PageResults []PageResult `json:"pageresults"`
+	Attempts    []Attempt    `json:"attempts"`
+
+	Documents []string            `json:"documents,omitempty"`
+	Params    map[string][]string `json:"params,omitempty"`
+}
+
+// Attempt is the outcome of one call of SendQfileContext
+type Attempt struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	CommID      string    `json:"commid,omitempty"`
+	Status      string    `json:"status"`
+	Outcome     string    `json:"outcome,omitempty"`
+	Hangupcause string    `json:"hangupcause,omitempty"`
+	RemoteID    string    `json:"remoteid,omitempty"`
+	Rate        uint      `json:"rate,omitempty"`
+	Ecm         bool      `json:"ecm,omitempty"`
+	Pages       uint      `json:"pages"`
+}
+
+// PageResult holds the transmission details of a page
+type PageResult struct {
+	Page             int       `json:"page"`
+	Time             time.Time `json:"time"`
+	BadRows          uint      `json:"badrows"`
+	LongestBadRowRun uint      `json:"longestbadrowrun"`
+	Encoding         string    `json:"encoding"`
+	Resolution       string    `json:"resolution"`
+	Size             uint      `json:"size"`
+}
+
+// view returns a copy of the job suitable for API responses
+func (j *Job) view() Job {
+	v := *j
+	qf := gofaxsend.NewQmemory(j.Params)
+	v.Status = qf.GetString("status")
+	v.Pages, _ = qf.GetInt("totpages")
+	v.SentPages, _ = qf.GetInt("npages")
+	v.Dials, _ = qf.GetInt("totdials")
+	v.Tries, _ = qf.GetInt("tottries")
+	if v.PageResults == nil {
+		v.PageResults = []PageResult{}
+	}
+	if v.Attempts == nil {
+		v.Attempts = []Attempt{}
+	}
+	v.Documents = nil
+	v.Params = nil
+	return v
+}
+
+// finished returns true if the job will not be sent again
+func (j *Job) finished() bool {
+	return j.State == stateDone || j.State == stateFailed || j.State == stateCancelled
+}
+
+// addAttempt records the outcome of an attempt starting at the given page
+func (j *Job) addAttempt(start time.Time, firstPage int, result *gofaxlib.FaxResult) {
+	qf := gofaxsend.NewQmemory(j.Params)
+	a := Attempt{
+		Start:  start,
+		End:    time.Now(),
+		CommID: qf.GetString("commid"),
+		Status: qf.GetString("status"),
+	}
+	if result != nil {
+		a.Outcome = string(result.Outcome)
+		a.Hangupcause = result.Hangupcause
+		a.RemoteID = result.RemoteID
+		a.Rate = result.TransferRate
+		a.Ecm = result.Ecm
+		a.Pages = result.TransferredPages
+		for _, p := range result.PageResults {
+			j.PageResults = append(j.PageResults, PageResult{
+				Page:             firstPage + int(p.Page),
+				Time:             p.Ts,
+				BadRows:          p.BadRows,
+				LongestBadRowRun: p.LongestBadRowRun,
+				Encoding:         p.EncodingName,
+				Resolution:       p.ImageResolution.String(),
+				Size:             p.ImageSize,
+			})
+		}
+	}
+	j.Attempts = append(j.Attempts, a)
+}
+
+// setStatus overrides the status of the job
+func (j *Job) setStatus(status string) {
+	gofaxsend.NewQmemory(j.Params).Set("status", status)
+}
+
+// newParams creates the queue file tags of a new job
+func newParams(jobid uint64, number, sender, owner, tag string, ecm, v17 bool, documents []string, pages int) map[string][]string {
+	params := map[string][]string{
+		"jobid":     {strconv.FormatUint(jobid, 10)},
+		"external":  {number},
+		"number":    {number},
+		"owner":     {owner},
+		"desiredec": {"0"},
+		"desiredbr": {"5"},
+		"totpages":  {strconv.Itoa(pages)},
+		"status":    {"Queued"},
+	}
+	if sender != "" {
+		params["sender"] = []string{sender}
+	}
+	if tag != "" {
+		params["jobtag"] = []string{tag}
+	}
+	if ecm {
+		params["desiredec"] = []string{"1"}
+	}
+	if !v17 {
+		params["desiredbr"] = []string{"4"}
+	}
+	for _, doc := range documents {
+		params["fax"] = append(params["fax"], fmt.Sprintf("0::%s", doc))
+	}
+	return params
+}
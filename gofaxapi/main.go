@@ -0,0 +1,157 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+const (
+	defaultConfigfile = "/etc/gofax.conf"
+	productName       = "GOfax.IP"
+
+	defaultListen = "127.0.0.1:8080"
+
+	// Time to wait for running requests when stopping
+	shutdownTimeout = 10 * time.Second
+)
+
+var (
+	configFile  = flag.String("c", defaultConfigfile, "GOfax configuration file")
+	showVersion = flag.Bool("version", false, "Show version information")
+
+	usage = fmt.Sprintf("Usage: %s -version | [-c configfile]", os.Args[0])
+
+	// Version can be set at build time using:
+	//    -ldflags "-X main.version 0.42"
+	version string
+)
+
+func init() {
+	if version == "" {
+		version = "development version"
+	}
+
+	flag.Usage = func() {
+		log.Printf("%s %s\n%s\n", productName, version, usage)
+		flag.PrintDefaults()
+	}
+}
+
+func loadConfig() {
+	gofaxlib.LoadConfig(*configFile)
+	for _, load := range []func() error{
+		gofaxsend.LoadRetryPolicies,
+		gofaxsend.LoadGateways,
+		gofaxsend.LoadDialPlan,
+		gofaxsend.LoadSendWindows,
+		gofaxsend.LoadSIPHeaders,
+	} {
+		if err := load(); err != nil {
+			logger.Logger.Print("Config: ", err)
+			log.Fatal("Config: ", err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version)
+		os.Exit(1)
+	}
+
+	logger.Logger.Printf("%v gofaxapi %v starting", productName, version)
+	loadConfig()
+
+	if gofaxlib.Config.Hylafax.Standalone {
+		if err := gofaxlib.CreateSpool(); err != nil {
+			logger.Logger.Print(err)
+			log.Fatal(err)
+		}
+	}
+
+	// Session logs and queue files are relative to the spool directory
+	if err := os.Chdir(gofaxlib.Config.Hylafax.Spooldir); err != nil {
+		logger.Logger.Print(err)
+		log.Fatal(err)
+	}
+
+	q, err := newJobQueue(jobsDir)
+	if err != nil {
+		logger.Logger.Fatal(err)
+	}
+	if err = q.Resume(); err != nil {
+		logger.Logger.Print(err)
+	}
+	q.Start()
+
+	api := &apiServer{
+		q:           q,
+		token:       gofaxlib.Config.Gofaxapi.Token,
+		ghostscript: gofaxlib.Config.Gofaxapi.Ghostscript,
+	}
+	listen := gofaxlib.Config.Gofaxapi.Listen
+	if listen == "" {
+		listen = defaultListen
+	}
+	server := &http.Server{
+		Addr:    listen,
+		Handler: api.Handler(),
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
+
+	errchan := make(chan error, 1)
+	go func() {
+		logger.Logger.Print("Listening on ", listen)
+		errchan <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-errchan:
+		logger.Logger.Print(err)
+		q.Stop()
+		log.Fatal(err)
+	case sig := <-sigchan:
+		logger.Logger.Print("Received ", sig, ", stopping")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err = server.Shutdown(ctx); err != nil {
+			logger.Logger.Print(err)
+		}
+		cancel()
+	}
+
+	// Running transmissions are hung up and resumed after the next start
+	q.Stop()
+	logger.Logger.Print("Exiting")
+}
@@ -0,0 +1,511 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+const (
+	jobsDir = "gofaxapi"
+
+	// Device ID passed to DynamicConfig and written to xferfaxlog
+	deviceID = "gofaxapi"
+
+	defaultWorkers    = 2
+	defaultMaxTries   = 3
+	defaultMaxDials   = 12
+	defaultRetryDelay = 300 // seconds
+	defaultKeepDays   = 7
+
+	cleanupInterval = time.Hour
+)
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobFinished = errors.New("job is already finished")
+)
+
+// jobQueue saves jobs in the jobs directory and sends them using gofaxsend
+type jobQueue struct {
+	dir        string
+	workers    uint
+	maxTries   int
+	maxDials   int
+	retryDelay time.Duration
+	keep       time.Duration
+
+	ctx     context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+
+	work chan *Job
+}
+
+// newJobQueue creates a job queue with settings from the configuration file
+func newJobQueue(dir string) (*jobQueue, error) {
+	cfg := &gofaxlib.Config.Gofaxapi
+
+	q := &jobQueue{
+		dir:        dir,
+		workers:    defaultWorkers,
+		maxTries:   defaultMaxTries,
+		maxDials:   defaultMaxDials,
+		retryDelay: defaultRetryDelay * time.Second,
+		keep:       defaultKeepDays * 24 * time.Hour,
+		jobs:       make(map[string]*Job),
+		cancels:    make(map[string]context.CancelFunc),
+		work:       make(chan *Job),
+	}
+	q.ctx, q.stop = context.WithCancel(context.Background())
+
+	if cfg.Workers != 0 {
+		q.workers = cfg.Workers
+	}
+	if cfg.MaxTries != 0 {
+		q.maxTries = int(cfg.MaxTries)
+	}
+	if cfg.MaxDials != 0 {
+		q.maxDials = int(cfg.MaxDials)
+	}
+	if cfg.RetryDelay != 0 {
+		q.retryDelay = time.Duration(cfg.RetryDelay) * time.Second
+	}
+	if cfg.KeepDays != 0 {
+		q.keep = time.Duration(cfg.KeepDays) * 24 * time.Hour
+	}
+
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Resume loads all jobs saved by a previous run
+func (q *jobQueue) Resume() error {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, file := range files {
+		job, err := q.load(file)
+		if err != nil {
+			logger.Logger.Printf("Error loading job %v: %v", file, err)
+			continue
+		}
+		if job.State == stateSending {
+			// Interrupted without being able to save the result
+			job.State = stateQueued
+		}
+		q.jobs[job.ID] = job
+		if job.State == stateQueued {
+			logger.Logger.Printf("Resuming job %v", job.ID)
+		}
+	}
+	return nil
+}
+
+// Start starts the workers and schedules all queued jobs
+func (q *jobQueue) Start() {
+	for i := uint(0); i < q.workers; i++ {
+		go q.worker()
+	}
+
+	q.mu.Lock()
+	for _, job := range q.jobs {
+		if job.State == stateQueued {
+			q.schedule(job)
+		}
+	}
+	q.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			q.cleanup()
+			select {
+			case <-ticker.C:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop hangs up all running transmissions and waits until their jobs are saved.
+// Interrupted jobs are resumed after the next start.
+func (q *jobQueue) Stop() {
+	q.mu.Lock()
+	q.stop()
+	q.mu.Unlock()
+	q.running.Wait()
+}
+
+// Submit saves and schedules a new job
+func (q *jobQueue) Submit(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.save(job); err != nil {
+		return err
+	}
+	q.jobs[job.ID] = job
+	q.schedule(job)
+	return nil
+}
+
+// Get returns the job with given ID
+func (q *jobQueue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return job.view(), nil
+}
+
+// List returns up to limit jobs in the given state (all if empty), newest first
+func (q *jobQueue) List(state string, limit int) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []Job{}
+	for _, job := range q.jobs {
+		if state == "" || job.State == state {
+			jobs = append(jobs, job.view())
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Created.Equal(jobs[j].Created) {
+			return jobs[i].Created.After(jobs[j].Created)
+		}
+		return jobs[i].ID > jobs[j].ID
+	})
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// Cancel cancels a job. A running transmission is hung up,
+// the job is cancelled when its result was saved.
+func (q *jobQueue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if job.finished() {
+		return job.view(), errJobFinished
+	}
+
+	job.Cancelled = true
+	job.Updated = time.Now()
+	if cancel, ok := q.cancels[id]; ok {
+		logger.Logger.Printf("Job %v: Cancelling transmission", id)
+		cancel()
+	} else {
+		job.State = stateCancelled
+		job.Next = nil
+		job.setStatus("Cancelled")
+		q.removeDocuments(job)
+	}
+	if err := q.save(job); err != nil {
+		logger.Logger.Printf("Job %v: Error saving job: %v", id, err)
+	}
+	return job.view(), nil
+}
+
+func (q *jobQueue) schedule(job *Job) {
+	var delay time.Duration
+	if job.Next != nil {
+		delay = time.Until(*job.Next)
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case q.work <- job:
+		case <-q.ctx.Done():
+		}
+	})
+}
+
+func (q *jobQueue) worker() {
+	for {
+		select {
+		case job := <-q.work:
+			q.run(job)
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// run sends a job and decides what to do next
+func (q *jobQueue) run(job *Job) {
+	q.mu.Lock()
+	if job.State != stateQueued || q.ctx.Err() != nil {
+		q.mu.Unlock()
+		return
+	}
+	q.running.Add(1)
+	defer q.running.Done()
+
+	ctx, cancel := context.WithCancel(q.ctx)
+	defer cancel()
+	q.cancels[job.ID] = cancel
+
+	qf := &jobQfile{q: q, job: job, qf: gofaxsend.NewQmemory(job.Params)}
+	// tts is only set by gofaxsend to request a delay for the next attempt
+	qf.qf.SetAll("tts", nil)
+	firstPage, _ := qf.qf.GetInt("npages")
+	dials, _ := qf.qf.GetInt("totdials")
+	job.State = stateSending
+	job.Next = nil
+	job.Updated = time.Now()
+	if err := q.save(job); err != nil {
+		logger.Logger.Printf("Job %v: Error saving job: %v", job.ID, err)
+	}
+	q.mu.Unlock()
+
+	start := time.Now()
+	returned, result, err := gofaxsend.SendQfileContext(ctx, qf, deviceID)
+	if err != nil {
+		logger.Logger.Printf("Job %v: Error sending fax: %v", job.ID, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.cancels, job.ID)
+
+	if newDials, _ := qf.qf.GetInt("totdials"); newDials != dials {
+		job.addAttempt(start, firstPage, result)
+	}
+	q.finish(job, returned, err)
+	if err := q.save(job); err != nil {
+		logger.Logger.Printf("Job %v: Error saving job: %v", job.ID, err)
+	}
+	if job.State == stateQueued && q.ctx.Err() == nil {
+		q.schedule(job)
+	}
+}
+
+// finish sets the state of a job after an attempt
+func (q *jobQueue) finish(job *Job, returned gofaxsend.SendResult, err error) {
+	qf := gofaxsend.NewQmemory(job.Params)
+	status := qf.GetString("status")
+	tries, _ := qf.GetInt("tottries")
+	dials, _ := qf.GetInt("totdials")
+
+	// Invalid jobs can't be sent, other errors are local problems
+	// like a locked sequence file and count as failed attempt
+	var faxErr gofaxsend.FaxError
+	invalid := errors.As(err, &faxErr) && !faxErr.Retry()
+	if err != nil {
+		status = err.Error()
+		job.setStatus(status)
+		if !invalid {
+			tries++
+			qf.Set("tottries", strconv.Itoa(tries))
+		}
+	}
+
+	job.Updated = time.Now()
+	switch {
+	case job.Cancelled:
+		job.State = stateCancelled
+		job.setStatus("Cancelled")
+	case invalid:
+		job.State = stateFailed
+	case returned == gofaxsend.SendDone:
+		job.State = stateDone
+	case q.ctx.Err() != nil:
+		// Stopped while sending, try again after the next start
+		job.State = stateQueued
+		job.Next = nil
+	case err == nil && (returned == gofaxsend.SendFailed || returned == gofaxsend.SendReformat):
+		// Documents are not converted again, so reformatting is not possible
+		job.State = stateFailed
+	case tries >= q.maxTries:
+		job.State = stateFailed
+		job.setStatus(fmt.Sprintf("%s (giving up after %d attempts)", status, tries))
+	case dials >= q.maxDials:
+		job.State = stateFailed
+		job.setStatus(fmt.Sprintf("%s (giving up after %d dials)", status, dials))
+	default:
+		job.State = stateQueued
+		next := time.Now().Add(q.retryDelay)
+		if tts, err := qf.GetInt("tts"); err == nil && tts > 0 {
+			next = time.Unix(int64(tts), 0)
+		}
+		job.Next = &next
+	}
+
+	if job.finished() {
+		job.Next = nil
+		q.removeDocuments(job)
+	}
+	logger.Logger.Printf("Job %v: %v, %v", job.ID, job.State, qf.GetString("status"))
+}
+
+// cleanup removes finished jobs which were not updated for q.keep
+func (q *jobQueue) cleanup() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, job := range q.jobs {
+		if job.finished() && time.Since(job.Updated) > q.keep {
+			if err := os.Remove(q.filename(job)); err != nil && !os.IsNotExist(err) {
+				logger.Logger.Printf("Job %v: Error removing job: %v", id, err)
+				continue
+			}
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// removeDocuments removes the documents of a finished job
+func (q *jobQueue) removeDocuments(job *Job) {
+	for _, doc := range job.Documents {
+		if err := os.Remove(doc); err != nil && !os.IsNotExist(err) {
+			logger.Logger.Printf("Job %v: Error removing document: %v", job.ID, err)
+		}
+	}
+	job.Documents = nil
+}
+
+func (q *jobQueue) filename(job *Job) string {
+	return filepath.Join(q.dir, job.ID+".json")
+}
+
+// save atomically writes a job to the jobs directory
+func (q *jobQueue) save(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(q.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), q.filename(job))
+}
+
+func (q *jobQueue) load(filename string) (*Job, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	job := new(Job)
+	if err = json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	if job.ID != strings.TrimSuffix(filepath.Base(filename), ".json") {
+		return nil, fmt.Errorf("job ID %v does not match file name", job.ID)
+	}
+	return job, nil
+}
+
+// jobQfile gives gofaxsend access to the queue file tags of a job.
+// Writing it saves the job, so the progress is visible to clients.
+type jobQfile struct {
+	q   *jobQueue
+	job *Job
+	qf  *gofaxsend.Qmemory
+}
+
+func (f *jobQfile) Write() error {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	f.job.Updated = time.Now()
+	return f.q.save(f.job)
+}
+
+func (f *jobQfile) GetAll(tag string) []string {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	return append([]string(nil), f.qf.GetAll(tag)...)
+}
+
+func (f *jobQfile) GetString(tag string) string {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	return f.qf.GetString(tag)
+}
+
+func (f *jobQfile) GetInt(tag string) (int, error) {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	return f.qf.GetInt(tag)
+}
+
+func (f *jobQfile) Set(tag, value string) {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	f.qf.Set(tag, value)
+}
+
+func (f *jobQfile) SetAll(tag string, values []string) {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	f.qf.SetAll(tag, values)
+}
+
+func (f *jobQfile) Add(tag, value string) {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	f.qf.Add(tag, value)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxsend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinish(t *testing.T) {
+	s, _ := setupAPITest(t)
+	q := s.q
+	tts := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	for _, tc := range []struct {
+		name      string
+		params    map[string][]string
+		cancelled bool
+		returned  gofaxsend.SendResult
+		err       error
+		state     string
+		status    string
+		tries     int
+		next      time.Duration
+	}{
+		{name: "done", returned: gofaxsend.SendDone, state: stateDone, status: "OK"},
+		{name: "failed", returned: gofaxsend.SendFailed, state: stateFailed, status: "OK"},
+		{name: "reformat", returned: gofaxsend.SendReformat, state: stateFailed, status: "OK"},
+		{name: "invalid", returned: gofaxsend.SendFailed, err: gofaxsend.NewFaxError("Error parsing jobid", false), state: stateFailed, status: "Error parsing jobid"},
+		{
+			name:     "local error",
+			returned: gofaxsend.SendFailed, err: errors.New("open log/c000000001: no space left on device"),
+			state: stateQueued, status: "open log/c000000001: no space left on device", tries: 1, next: q.retryDelay,
+		},
+		{
+			name:     "local error max tries",
+			params:   map[string][]string{"tottries": {"2"}},
+			returned: gofaxsend.SendFailed, err: errors.New("lock seqf: resource temporarily unavailable"),
+			state: stateFailed, status: "lock seqf: resource temporarily unavailable (giving up after 3 attempts)", tries: 3,
+		},
+		{name: "cancelled", cancelled: true, returned: gofaxsend.SendRetry, state: stateCancelled, status: "Cancelled"},
+		{name: "retry", returned: gofaxsend.SendRetry, state: stateQueued, status: "OK", next: q.retryDelay},
+		{name: "v17fail", returned: gofaxsend.SendV17fail, state: stateQueued, status: "OK", next: q.retryDelay},
+		{
+			name:     "retry at tts",
+			params:   map[string][]string{"tts": {strconv.FormatInt(tts.Unix(), 10)}},
+			returned: gofaxsend.SendRetry, state: stateQueued, status: "OK", next: time.Until(tts),
+		},
+		{
+			name:     "max tries",
+			params:   map[string][]string{"tottries": {"3"}},
+			returned: gofaxsend.SendRetry, state: stateFailed, status: "OK (giving up after 3 attempts)",
+		},
+		{
+			name:     "max dials",
+			params:   map[string][]string{"totdials": {"12"}},
+			returned: gofaxsend.SendRetry, state: stateFailed, status: "OK (giving up after 12 dials)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := map[string][]string{"status": {"OK"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+			job := &Job{ID: "1", State: stateSending, Cancelled: tc.cancelled, Params: params}
+
+			q.finish(job, tc.returned, tc.err)
+			view := job.view()
+			assert.Equal(t, tc.state, view.State)
+			assert.Equal(t, tc.status, view.Status)
+			if tc.tries != 0 {
+				assert.Equal(t, tc.tries, view.Tries)
+			}
+			if tc.state == stateQueued {
+				if assert.NotNil(t, job.Next) {
+					assert.WithinDuration(t, time.Now().Add(tc.next), *job.Next, 2*time.Second)
+				}
+			} else {
+				assert.Nil(t, job.Next)
+			}
+		})
+	}
+}
+
+func TestStopRequeues(t *testing.T) {
+	s, _ := setupAPITest(t)
+	s.q.Stop()
+
+	job := &Job{ID: "1", State: stateSending, Params: map[string][]string{"status": {"Transmission cancelled"}}}
+	s.q.finish(job, gofaxsend.SendFailed, nil)
+	assert.Equal(t, stateQueued, job.State)
+}
+
+func TestResume(t *testing.T) {
+	s, spooldir := setupAPITest(t)
+	now := time.Now()
+
+	for _, job := range []*Job{
+		{ID: "1", State: stateSending, Created: now, Params: map[string][]string{"npages": {"2"}}},
+		{ID: "2", State: stateDone, Created: now.Add(time.Second), Updated: now},
+		{ID: "3", State: stateFailed, Created: now.Add(2 * time.Second), Updated: now.Add(-30 * 24 * time.Hour)},
+	} {
+		must(t, s.q.save(job))
+	}
+
+	q, err := newJobQueue(filepath.Join(spooldir, jobsDir))
+	must(t, err)
+	must(t, q.Resume())
+	defer q.Stop()
+
+	jobs := q.List("", 0)
+	if assert.Len(t, jobs, 3) {
+		assert.Equal(t, []string{"3", "2", "1"}, []string{jobs[0].ID, jobs[1].ID, jobs[2].ID})
+		assert.Equal(t, stateQueued, jobs[2].State)
+		assert.Equal(t, 2, jobs[2].SentPages)
+	}
+	assert.Len(t, q.List(stateDone, 0), 1)
+	assert.Len(t, q.List("", 1), 1)
+
+	// Old finished jobs are removed
+	q.cleanup()
+	assert.Len(t, q.List("", 0), 2)
+	assert.NoFileExists(t, filepath.Join(spooldir, jobsDir, "3.json"))
+}
+
+func TestAddAttempt(t *testing.T) {
+	job := &Job{Params: map[string][]string{"commid": {"000000042"}, "status": {"Call dropped"}}}
+	result := &gofaxlib.FaxResult{
+		Hangupcause:      "NORMAL_CLEARING",
+		RemoteID:         "+49 40 123456",
+		TransferRate:     14400,
+		TransferredPages: 2,
+		PageResults: []gofaxlib.PageResult{
+			{Page: 1, EncodingName: "MMR", ImageResolution: gofaxlib.Resolution{X: 204, Y: 196}},
+			{Page: 2, BadRows: 3, EncodingName: "MMR", ImageResolution: gofaxlib.Resolution{X: 204, Y: 196}},
+		},
+	}
+
+	// Resumed attempt after 2 pages were sent before
+	job.addAttempt(time.Now(), 2, result)
+	if assert.Len(t, job.Attempts, 1) {
+		a := job.Attempts[0]
+		assert.Equal(t, "000000042", a.CommID)
+		assert.Equal(t, "Call dropped", a.Status)
+		assert.Equal(t, "NORMAL_CLEARING", a.Hangupcause)
+		assert.Equal(t, uint(14400), a.Rate)
+		assert.Equal(t, uint(2), a.Pages)
+	}
+	if assert.Len(t, job.PageResults, 2) {
+		assert.Equal(t, 3, job.PageResults[0].Page)
+		assert.Equal(t, 4, job.PageResults[1].Page)
+		assert.Equal(t, uint(3), job.PageResults[1].BadRows)
+		assert.Equal(t, "204x196", job.PageResults[1].Resolution)
+	}
+
+	// Failed call without result
+	job.addAttempt(time.Now(), 4, nil)
+	assert.Len(t, job.Attempts, 2)
+	assert.Len(t, job.PageResults, 2)
+}
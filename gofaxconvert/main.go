@@ -0,0 +1,68 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gonicus/gofaxip/gofaxlib/faxpdf"
+)
+
+const productName = "GOfax.IP"
+
+var (
+	showVersion = flag.Bool("version", false, "Show version information")
+
+	usage = fmt.Sprintf("Usage: %s -version | in.tif out.pdf", os.Args[0])
+
+	// Version can be set at build time using:
+	//    -ldflags "-X main.version 0.42"
+	version string
+)
+
+func init() {
+	if version == "" {
+		version = "development version"
+	}
+	version = fmt.Sprintf("%v %v", productName, version)
+
+	flag.Usage = func() {
+		log.Printf("%s\n%s\n", version, usage)
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version)
+		os.Exit(1)
+	}
+
+	if flag.NArg() != 2 {
+		log.Fatal(usage)
+	}
+
+	if err := faxpdf.ConvertFile(flag.Arg(0), flag.Arg(1)); err != nil {
+		log.Fatal(err)
+	}
+}
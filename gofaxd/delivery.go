@@ -0,0 +1,342 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
+)
+
+const (
+	deliveryqDir = "deliveryq"
+
+	defaultDeliveryDeadLetter = "deliveryq/failed"
+
+	defaultDeliveryWorkers = 4
+	defaultDeliveryTimeout = 300 // seconds
+	defaultDeliveryRetries = 5
+	defaultDeliveryBackoff = 60 // seconds
+	maxDeliveryBackoff     = 6 * time.Hour
+)
+
+// receivedFax holds everything known about a received fax
+type receivedFax struct {
+	Filename   string
+	Device     string
+	CommID     string
+	UUID       string
+	Cidnum     string
+	Cidname    string
+	Recipient  string
+	Gateway    string
+	FaxRcvdCmd string
+	Webhook    string
+	MailTo     string
+
+	// X- headers of the INVITE by name
+	SIPHeaders map[string]string
+
+	Result *gofaxlib.FaxResult
+	Record *gofaxlib.XFRecord
+}
+
+// faxMetadata is the JSON document describing a received fax
+// passed to webhooks and FaxRcvdCmd
+type faxMetadata struct {
+	CommID     string
+	UUID       string
+	Filename   string
+	Device     string
+	Cidnum     string
+	Cidname    string
+	Recipient  string
+	Gateway    string
+	SIPHeaders map[string]string
+
+	Result *gofaxlib.FaxResult
+	Record *gofaxlib.XFRecord
+}
+
+func (f *receivedFax) metadata() *faxMetadata {
+	return &faxMetadata{
+		CommID:     f.CommID,
+		UUID:       f.UUID,
+		Filename:   f.Filename,
+		Device:     f.Device,
+		Cidnum:     f.Cidnum,
+		Cidname:    f.Cidname,
+		Recipient:  f.Recipient,
+		Gateway:    f.Gateway,
+		SIPHeaders: f.SIPHeaders,
+		Result:     f.Result,
+		Record:     f.Record,
+	}
+}
+
+// delivery is a pending delivery of a received fax.
+// Deliveries are saved in deliveryq until they succeeded or failed permanently.
+type delivery struct {
+	ID        string
+	Kind      string
+	Attempts  uint
+	Next      time.Time
+	LastError string
+	Fax       receivedFax
+}
+
+// A deliverer delivers a received fax. Deliveries are retried if an error is returned.
+type deliverer func(d *delivery, sessionlog gofaxlib.SessionLogger, timeout time.Duration) error
+
+// deliverers holds the available deliverers by kind
+var deliverers = map[string]deliverer{}
+
+// deliveryQueue runs deliveries using a bounded number of workers
+type deliveryQueue struct {
+	dir        string
+	deadLetter string
+	timeout    time.Duration
+	retries    uint
+	backoff    time.Duration
+
+	work chan *delivery
+}
+
+var deliveries *deliveryQueue
+
+// newDeliveryQueue creates a delivery queue with settings from the configuration file
+func newDeliveryQueue() (*deliveryQueue, error) {
+	cfg := &gofaxlib.Config.Gofaxd
+
+	q := &deliveryQueue{
+		dir:        deliveryqDir,
+		deadLetter: defaultDeliveryDeadLetter,
+		timeout:    defaultDeliveryTimeout * time.Second,
+		retries:    defaultDeliveryRetries,
+		backoff:    defaultDeliveryBackoff * time.Second,
+		work:       make(chan *delivery),
+	}
+	if cfg.DeliveryTimeout != 0 {
+		q.timeout = time.Duration(cfg.DeliveryTimeout) * time.Second
+	}
+	if cfg.DeliveryRetries != nil {
+		q.retries = *cfg.DeliveryRetries
+	}
+	if cfg.DeliveryBackoff != 0 {
+		q.backoff = time.Duration(cfg.DeliveryBackoff) * time.Second
+	}
+	if cfg.DeliveryDeadLetter != "" {
+		q.deadLetter = cfg.DeliveryDeadLetter
+	}
+
+	for _, dir := range []string{q.dir, q.deadLetter} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	workers := cfg.DeliveryWorkers
+	if workers == 0 {
+		workers = defaultDeliveryWorkers
+	}
+	for i := uint(0); i < workers; i++ {
+		go q.worker()
+	}
+
+	return q, nil
+}
+
+// Resume schedules all deliveries still pending from a previous run
+func (q *deliveryQueue) Resume() error {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		d, err := q.load(file)
+		if err != nil {
+			logger.Logger.Printf("Error loading delivery %v: %v", file, err)
+			continue
+		}
+		logger.Logger.Printf("Resuming %v delivery %v", d.Kind, d.ID)
+		q.schedule(d)
+	}
+
+	return nil
+}
+
+// Enqueue saves and schedules a new delivery of given kind
+func (q *deliveryQueue) Enqueue(kind string, fax *receivedFax) error {
+	if _, ok := deliverers[kind]; !ok {
+		return fmt.Errorf("unknown delivery kind %v", kind)
+	}
+
+	d := &delivery{
+		ID:   fmt.Sprintf("%s-%s", fax.CommID, kind),
+		Kind: kind,
+		Next: time.Now(),
+		Fax:  *fax,
+	}
+	if err := q.save(d); err != nil {
+		return err
+	}
+
+	q.schedule(d)
+	return nil
+}
+
+func (q *deliveryQueue) schedule(d *delivery) {
+	time.AfterFunc(time.Until(d.Next), func() {
+		q.work <- d
+	})
+}
+
+func (q *deliveryQueue) worker() {
+	for d := range q.work {
+		q.run(d)
+	}
+}
+
+// run attempts a delivery and reschedules it if it failed
+func (q *deliveryQueue) run(d *delivery) {
+	sessionlog, err := gofaxlib.OpenSessionLogger(0, d.Fax.CommID)
+	if err != nil {
+		logger.Logger.Printf("Error opening session log for delivery %v, logging to syslog: %v", d.ID, err)
+		sessionlog = deliveryLog{d.ID}
+	}
+
+	deliver, ok := deliverers[d.Kind]
+	if !ok {
+		sessionlog.Logf("Unknown delivery kind %v, dropping delivery %v", d.Kind, d.ID)
+		q.remove(d)
+		return
+	}
+
+	d.Attempts++
+	err = deliver(d, sessionlog, q.timeout)
+	if err == nil {
+		q.remove(d)
+		return
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts > q.retries {
+		sessionlog.Logf("Delivery %v failed after %d attempts, giving up: %v", d.ID, d.Attempts, err)
+		if err = q.save(d); err != nil {
+			sessionlog.Log("Error saving delivery:", err)
+		}
+		deadLetter := filepath.Join(q.deadLetter, filepath.Base(q.filename(d)))
+		if err = os.Rename(q.filename(d), deadLetter); err != nil {
+			sessionlog.Log("Error moving delivery to dead letter directory:", err)
+			q.remove(d)
+			return
+		}
+		sessionlog.Log("Moved delivery to", deadLetter)
+		return
+	}
+
+	delay := q.backoff
+	for i := uint(1); i < d.Attempts && delay < maxDeliveryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxDeliveryBackoff {
+		delay = maxDeliveryBackoff
+	}
+	d.Next = time.Now().Add(delay)
+	sessionlog.Logf("Delivery %v failed (attempt %d): %v, retrying in %v", d.ID, d.Attempts, err, delay)
+
+	if err = q.save(d); err != nil {
+		sessionlog.Log("Error saving delivery:", err)
+	}
+	q.schedule(d)
+}
+
+func (q *deliveryQueue) filename(d *delivery) string {
+	return filepath.Join(q.dir, d.ID+".json")
+}
+
+// save atomically writes a delivery to the queue directory
+func (q *deliveryQueue) save(d *delivery) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(q.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), q.filename(d))
+}
+
+func (q *deliveryQueue) load(filename string) (*delivery, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(delivery)
+	if err = json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	if d.ID != strings.TrimSuffix(filepath.Base(filename), ".json") {
+		return nil, fmt.Errorf("delivery ID %v does not match file name", d.ID)
+	}
+	return d, nil
+}
+
+func (q *deliveryQueue) remove(d *delivery) {
+	if err := os.Remove(q.filename(d)); err != nil {
+		logger.Logger.Print(err)
+	}
+}
+
+// deliveryLog is used for deliveries without a session log
+type deliveryLog struct {
+	id string
+}
+
+func (l deliveryLog) CommSeq() uint64 { return 0 }
+func (l deliveryLog) CommID() string  { return "" }
+func (l deliveryLog) Logfile() string { return "" }
+
+func (l deliveryLog) Log(v ...interface{}) {
+	logger.Logger.Println(append([]interface{}{fmt.Sprintf("(%s)", l.id)}, v...)...)
+}
+
+func (l deliveryLog) Logf(format string, v ...interface{}) {
+	l.Log(fmt.Sprintf(format, v...))
+}
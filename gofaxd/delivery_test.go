@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+const deliveryTest = "test"
+
+// fakeDeliverer records attempts and fails until fails is exhausted
+type fakeDeliverer struct {
+	attempts chan *delivery
+	times    chan time.Time
+	fails    int
+}
+
+func (f *fakeDeliverer) deliver(d *delivery, sessionlog gofaxlib.SessionLogger, timeout time.Duration) error {
+	copy := *d
+	f.times <- time.Now()
+	f.attempts <- &copy
+	if f.fails != 0 {
+		f.fails--
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+// attempt waits for the next delivery attempt
+func (f *fakeDeliverer) attempt(t *testing.T) *delivery {
+	t.Helper()
+	select {
+	case d := <-f.attempts:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery attempt")
+		return nil
+	}
+}
+
+func setupDeliveryTest(t *testing.T, fails int) (*deliveryQueue, *fakeDeliverer) {
+	dir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	must(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+
+	// Session logs are written relative to the spool directory
+	wd, err := os.Getwd()
+	must(t, err)
+	must(t, os.Chdir(dir))
+
+	fake := &fakeDeliverer{attempts: make(chan *delivery, 10), times: make(chan time.Time, 10), fails: fails}
+	deliverers[deliveryTest] = fake.deliver
+
+	gofaxlib.Config.Gofaxd.DeliveryWorkers = 1
+	gofaxlib.Config.Gofaxd.DeliveryBackoff = 0
+	q, err := newDeliveryQueue()
+	must(t, err)
+	q.backoff = 50 * time.Millisecond
+
+	t.Cleanup(func() {
+		delete(deliverers, deliveryTest)
+		gofaxlib.Config.Gofaxd.DeliveryWorkers = 0
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	return q, fake
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	assert := assert.New(t)
+	q, fake := setupDeliveryTest(t, 1)
+
+	fax := &receivedFax{CommID: "000000001", Filename: "recvq/fax00000001.tif"}
+	assert.Error(q.Enqueue("unknown", fax))
+	must(t, q.Enqueue(deliveryTest, fax))
+
+	// The delivery is saved until it succeeds
+	d := fake.attempt(t)
+	assert.Equal("000000001-test", d.ID)
+	assert.Equal(*fax, d.Fax)
+	assert.EqualValues(1, d.Attempts)
+	filename := filepath.Join(deliveryqDir, "000000001-test.json")
+	assert.True(waitFor(func() bool {
+		saved, err := q.load(filename)
+		return err == nil && saved.LastError == "unavailable"
+	}))
+	saved, err := q.load(filename)
+	must(t, err)
+	assert.EqualValues(1, saved.Attempts)
+	assert.WithinDuration(time.Now().Add(q.backoff), saved.Next, q.backoff)
+
+	d = fake.attempt(t)
+	assert.EqualValues(2, d.Attempts)
+	assert.True(waitFor(func() bool {
+		_, err := os.Stat(filename)
+		return os.IsNotExist(err)
+	}))
+}
+
+func TestDeliveryQueueBackoff(t *testing.T) {
+	assert := assert.New(t)
+	q, fake := setupDeliveryTest(t, -1)
+	q.retries = 3
+
+	must(t, q.Enqueue(deliveryTest, &receivedFax{CommID: "000000002"}))
+	var times []time.Time
+	for i := 0; i < 4; i++ {
+		fake.attempt(t)
+		times = append(times, <-fake.times)
+	}
+
+	// The delay doubles with every attempt
+	for i := 1; i < len(times); i++ {
+		delay := q.backoff << uint(i-1)
+		assert.True(times[i].Sub(times[i-1]) >= delay, "attempt %d after %v, expected %v", i+1, times[i].Sub(times[i-1]), delay)
+	}
+
+	// Failed deliveries are moved to the dead letter directory
+	deadLetter := filepath.Join(defaultDeliveryDeadLetter, "000000002-test.json")
+	assert.True(waitFor(func() bool {
+		_, err := os.Stat(deadLetter)
+		return err == nil
+	}))
+	d, err := q.load(deadLetter)
+	must(t, err)
+	assert.EqualValues(4, d.Attempts)
+	assert.Equal("unavailable", d.LastError)
+	_, err = os.Stat(filepath.Join(deliveryqDir, "000000002-test.json"))
+	assert.True(os.IsNotExist(err))
+
+	select {
+	case <-fake.attempts:
+		t.Fatal("delivery attempted after it was moved to the dead letter directory")
+	case <-time.After(10 * q.backoff):
+	}
+}
+
+func TestDeliveryQueueResume(t *testing.T) {
+	assert := assert.New(t)
+	q, fake := setupDeliveryTest(t, 0)
+
+	// Deliveries left from a previous run, the commid is not needed
+	must(t, q.save(&delivery{ID: "pending-test", Kind: deliveryTest, Attempts: 2, Fax: receivedFax{CommID: "invalid"}}))
+	must(t, ioutil.WriteFile(filepath.Join(deliveryqDir, "other-test.json"), []byte(`{"ID": "mismatch"}`), 0644))
+
+	must(t, q.Resume())
+	d := fake.attempt(t)
+	assert.Equal("pending-test", d.ID)
+	assert.EqualValues(3, d.Attempts)
+	assert.True(waitFor(func() bool {
+		_, err := os.Stat(filepath.Join(deliveryqDir, "pending-test.json"))
+		return os.IsNotExist(err)
+	}))
+
+	// Invalid files are kept
+	_, err := os.Stat(filepath.Join(deliveryqDir, "other-test.json"))
+	assert.NoError(err)
+	select {
+	case d := <-fake.attempts:
+		t.Fatalf("unexpected delivery %v", d.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/gonicus/gofaxip/gofaxlib"
@@ -32,6 +34,8 @@ const (
 	stateBusy
 	stateDown
 	stateLocked
+	// Not used for outbound faxes, but still receiving
+	stateExempt
 
 	fifoPrefix = "FIFO."
 	statusDir  = "status"
@@ -47,6 +51,19 @@ type Device struct {
 	stateSet chan uint
 	stateGet chan uint
 	errors   chan error
+
+	// Requests to abort the current reception
+	aborts chan struct{}
+	// Requests to answer the current call now
+	answers chan struct{}
+
+	// Protects the fields below
+	mu sync.Mutex
+	// State to return to after a reception
+	idleState uint
+	receiving bool
+	// Set using "C" FIFO messages
+	params map[string]string
 }
 
 // NewDevice creates a new virtual modem
@@ -62,33 +79,43 @@ func NewDevice(name string) (*Device, error) {
 		stateSet: make(chan uint),
 		stateGet: make(chan uint),
 		errors:   make(chan error),
-	}
+		aborts:   make(chan struct{}, 1),
+		answers:  make(chan struct{}, 1),
 
-	// Create device FIFO
-	stat, err := os.Stat(d.fifoname)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if err = syscall.Mkfifo(d.fifoname, 0600); err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
-	} else {
-		if stat.Mode()&os.ModeNamedPipe == 0 {
-			return nil, errors.New("File exists and is not a FIFO")
-		}
+		idleState: stateReady,
+		params:    make(map[string]string),
 	}
 
 	go d.stateLoop(stateReady)
 
-	d.fifostream = gofaxlib.NewFifoStream(d.fifoname)
-	go d.fifoLoop()
+	// Without HylaFAX, nobody sends commands to the device
+	if !gofaxlib.Config.Hylafax.Standalone {
+		if err = d.createFifo(); err != nil {
+			return nil, err
+		}
+		d.fifostream = gofaxlib.NewFifoStream(d.fifoname)
+		go d.fifoLoop()
+	}
 
 	d.SetReady()
 	return &d, nil
 }
 
+// createFifo creates the device FIFO if it does not exist
+func (d *Device) createFifo() error {
+	stat, err := os.Stat(d.fifoname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return syscall.Mkfifo(d.fifoname, 0600)
+		}
+		return err
+	}
+	if stat.Mode()&os.ModeNamedPipe == 0 {
+		return errors.New("File exists and is not a FIFO")
+	}
+	return nil
+}
+
 func (d *Device) fifoLoop() {
 
 	for {
@@ -101,20 +128,34 @@ func (d *Device) fifoLoop() {
 			logger.Logger.Println(d.fifoname, "received message:", msg)
 
 			switch msg[0] {
+			case 'A': // Answer the current call
+				d.Answer(msg[1:])
+			case 'C': // Set configuration parameter
+				d.setParam(msg[1:])
 			case 'H': // Hello
-				d.SetReady()
+				d.setIdleState(stateReady)
 			case 'L': // Lock
 				d.SetLocked()
+			case 'Q': // Quit
+				d.quit()
 			case 'S': // Set state
 				if len(msg) < 2 {
 					continue
 				}
 				switch msg[1] {
 				case 'R':
-					d.SetReady()
+					d.setIdleState(stateReady)
 				case 'B':
 					d.SetBusy("Sending facsimile", true)
+				case 'D':
+					d.setIdleState(stateDown)
+				case 'E':
+					d.setIdleState(stateExempt)
+				default:
+					logger.Logger.Println("Unhandled state:", msg)
 				}
+			case 'Z': // Abort
+				d.Abort()
 			default:
 				logger.Logger.Println("Unhandled message:", msg)
 			}
@@ -127,6 +168,143 @@ func (d *Device) fifoLoop() {
 
 }
 
+// setIdleState changes the state of the device. While receiving,
+// the state is changed when the reception is done.
+func (d *Device) setIdleState(state uint) {
+	d.mu.Lock()
+	d.idleState = state
+	receiving := d.receiving
+	d.mu.Unlock()
+
+	if receiving {
+		logger.Logger.Printf("Modem %v is receiving, state will be changed after the reception", d.Name)
+		return
+	}
+	d.applyState(state)
+}
+
+func (d *Device) applyState(state uint) {
+	switch state {
+	case stateDown:
+		d.SetDown()
+	case stateExempt:
+		d.SetExempt()
+	default:
+		d.SetReady()
+	}
+}
+
+// quit takes the device down like faxgetty exiting. The parameters set
+// using the FIFO are discarded, as a restarted faxgetty would do.
+func (d *Device) quit() {
+	d.mu.Lock()
+	d.params = make(map[string]string)
+	d.mu.Unlock()
+	d.setIdleState(stateDown)
+}
+
+// setParam sets a configuration parameter given as "name:value"
+func (d *Device) setParam(param string) {
+	parts := strings.SplitN(param, ":", 2)
+	if len(parts) != 2 {
+		logger.Logger.Printf("Invalid configuration parameter for modem %v: %q", d.Name, param)
+		return
+	}
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	logger.Logger.Printf("Setting parameter %v of modem %v to %q", name, d.Name, value)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.params[name] = value
+}
+
+// Config returns the parameters set for this device,
+// they are used like DynamicConfig output for receptions.
+func (d *Device) Config() *gofaxlib.HylaConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	config := &gofaxlib.HylaConfig{}
+	for name, value := range d.params {
+		config.Set(name, value)
+	}
+	return config
+}
+
+// Abort requests to abort the current reception
+func (d *Device) Abort() {
+	select {
+	case d.aborts <- struct{}{}:
+	default:
+	}
+}
+
+// Answer requests to answer the current call without waiting for
+// answerafter. Virtual modems only answer fax calls, so requests to
+// answer as data or voice call are ignored.
+func (d *Device) Answer(how string) {
+	switch how = strings.ToLower(strings.TrimSpace(how)); how {
+	case "", "any", "fax":
+	default:
+		logger.Logger.Printf("Modem %v can not answer calls as %v", d.Name, how)
+		return
+	}
+	select {
+	case d.answers <- struct{}{}:
+	default:
+	}
+}
+
+// AnswerRequests returns a channel receiving requests to answer the current call
+func (d *Device) AnswerRequests() <-chan struct{} {
+	return d.answers
+}
+
+// Aborts returns a channel receiving abort requests
+func (d *Device) Aborts() <-chan struct{} {
+	return d.aborts
+}
+
+// allocate marks the device as receiving or sending. It returns false
+// if the device is not ready or does not answer fax calls. Exempt
+// devices are only used for receiving.
+func (d *Device) allocate(msg string, outbound bool) bool {
+	state := d.GetState()
+	if outbound {
+		if state != stateReady {
+			return false
+		}
+	} else if state != stateReady && state != stateExempt {
+		return false
+	}
+
+	d.mu.Lock()
+	d.receiving = true
+	d.mu.Unlock()
+
+	// Discard requests received before
+	select {
+	case <-d.aborts:
+	default:
+	}
+	select {
+	case <-d.answers:
+	default:
+	}
+
+	d.SetBusy(msg, outbound)
+	return true
+}
+
+// Release returns the device to its idle state after a reception or transmission
+func (d *Device) Release() {
+	d.mu.Lock()
+	d.receiving = false
+	state := d.idleState
+	d.mu.Unlock()
+
+	d.applyState(state)
+}
+
 func (d *Device) stateLoop(state uint) {
 	for {
 		select {
@@ -203,6 +381,15 @@ func (d *Device) SetDown() {
 	d.WriteStatusFile("Down")
 }
 
+// SetExempt sets the device state to EXEMPT. Faxq is told that the
+// device is busy, so it is not used for sending, but calls are still received.
+func (d *Device) SetExempt() {
+	logger.Logger.Printf("Changing state of modem %v to EXEMPT", d.Name)
+	d.stateSet <- stateExempt
+	gofaxlib.Faxq.ModemStatus(d.Name, "B")
+	d.WriteStatusFile("Running and idle, exempt from sending")
+}
+
 // SetLocked sets the device state to LOCKED
 func (d *Device) SetLocked() {
 	logger.Logger.Printf("Changing state of modem %v to LOCKED", d.Name)
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// sendFifo writes messages to the FIFO of device like faxstate and friends
+func sendFifo(t *testing.T, device *Device, messages ...string) {
+	f, err := os.OpenFile(device.fifoname, os.O_WRONLY, 0)
+	must(t, err)
+	defer f.Close()
+	for _, msg := range messages {
+		_, err = f.WriteString(msg + "\x00")
+		must(t, err)
+	}
+}
+
+func TestDeviceFifoCommands(t *testing.T) {
+	faxq, _ := setupHandlerTest(t)
+	device := devmanager.devices[0]
+	modem := device.Name
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+
+	// Exempt devices still receive, but are busy for faxq
+	faxq.Messages()
+	sendFifo(t, device, "SE")
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateExempt }))
+	assert.True(t, waitFor(func() bool {
+		messages := faxq.Messages()
+		return len(messages) > 0 && messages[len(messages)-1] == "+"+modem+":B"
+	}))
+
+	// Answer requests, only fax calls can be answered
+	sendFifo(t, device, "Adata", "Afax")
+	assert.True(t, waitFor(func() bool { return len(device.AnswerRequests()) == 1 }))
+
+	// Configuration parameters
+	sendFifo(t, device, "CLocalIdentifier:+49 30 123", "CEnableT38: false")
+	assert.True(t, waitFor(func() bool { return device.Config().GetString("EnableT38") == "false" }))
+	assert.Equal(t, "+49 30 123", device.Config().GetString("localidentifier"))
+
+	// State changes during a reception are applied afterwards
+	found, err := devmanager.FindDevice("Receiving facsimile")
+	must(t, err)
+	assert.Equal(t, device, found)
+	assert.Len(t, device.AnswerRequests(), 0)
+	sendFifo(t, device, "Q", "Z")
+	assert.True(t, waitFor(func() bool { return len(device.Aborts()) == 1 }))
+	assert.Equal(t, stateBusy, int(device.GetState()))
+	device.Release()
+	assert.Equal(t, stateDown, int(device.GetState()))
+
+	// Quit discards the configuration
+	assert.Equal(t, "", device.Config().GetString("LocalIdentifier"))
+
+	// Hello
+	sendFifo(t, device, "H")
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+
+	// Stale abort requests are discarded on allocation
+	found, err = devmanager.FindDevice("Receiving facsimile")
+	must(t, err)
+	assert.Len(t, device.Aborts(), 0)
+	found.Release()
+	assert.Equal(t, stateReady, int(device.GetState()))
+}
+
+func TestDeviceFifoRejectCall(t *testing.T) {
+	setupHandlerTest(t)
+	device := devmanager.devices[0]
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+
+	startServer(t)
+
+	// Calls are rejected by the modem configuration, unless a did says otherwise
+	sendFifo(t, device, "CRejectCall: yes")
+	assert.True(t, waitFor(func() bool { return device.Config().GetString("RejectCall") == "yes" }))
+
+	connect := map[string]string{
+		"Unique-ID":                uuid.New().String(),
+		"Channel-Caller-ID-Number": "4940123",
+		"variable_sip_to_user":     "4930200",
+	}
+	fs := dialFakeFreeswitch(t, gofaxlib.Config.Gofaxd.Socket)
+	commands := fs.call(t, connect, "exit")
+	assert.Contains(t, strings.Join(commands, "\n"), "execute-app-arg: 404")
+	assert.NotContains(t, strings.Join(commands, "\n"), "execute-app-name: rxfax")
+}
+
+func TestDeviceFifoAnswer(t *testing.T) {
+	setupHandlerTest(t)
+	device := devmanager.devices[0]
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+	gofaxlib.Config.Gofaxd.Answerafter = 60000
+	defer func() { gofaxlib.Config.Gofaxd.Answerafter = 0 }()
+
+	startServer(t)
+
+	connect := map[string]string{
+		"Unique-ID":                uuid.New().String(),
+		"Channel-Caller-ID-Number": "4940123",
+		"variable_sip_to_user":     "4930123",
+	}
+	fs := dialFakeFreeswitch(t, gofaxlib.Config.Gofaxd.Socket)
+	fs.call(t, connect, "execute-app-name: ring_ready")
+
+	// The call is answered without waiting for answerafter
+	sendFifo(t, device, "A")
+	commands := fs.call(t, connect, "execute-app-name: answer")
+	assert.NotContains(t, strings.Join(commands, "\n"), "execute-app-name: sleep")
+	fs.conn.Close()
+}
@@ -0,0 +1,245 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+// didRoute is a [did "..."] section from the configuration file
+type didRoute struct {
+	name   string
+	config *gofaxlib.DidConfig
+	regex  *regexp.Regexp
+}
+
+// didTable holds all configured DID routes
+type didTable struct {
+	exact  map[string]*didRoute
+	prefix []*didRoute
+	regex  []*didRoute
+}
+
+var didRoutes *didTable
+
+// loadDidTable builds a didTable from the [did "..."] sections of the configuration
+func loadDidTable(sections map[string]*gofaxlib.DidConfig) (*didTable, error) {
+	t := &didTable{
+		exact: make(map[string]*didRoute),
+	}
+
+	// Sort section names so regular expressions are tried in a stable order
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cfg := sections[name]
+		if err := validSubdir(cfg.Subdir); err != nil {
+			return nil, fmt.Errorf("did %q: %w", name, err)
+		}
+		if err := validWebhook(cfg.Webhook); err != nil {
+			return nil, fmt.Errorf("did %q: %w", name, err)
+		}
+
+		route := &didRoute{
+			name:   name,
+			config: cfg,
+		}
+
+		numbers := cfg.Number
+		if len(numbers) == 0 && len(cfg.Prefix) == 0 && cfg.Regex == "" {
+			numbers = []string{name}
+		}
+		for _, number := range numbers {
+			if other, ok := t.exact[number]; ok {
+				return nil, fmt.Errorf("did %q: number %v already used by did %q", name, number, other.name)
+			}
+			t.exact[number] = route
+		}
+
+		if len(cfg.Prefix) > 0 {
+			t.prefix = append(t.prefix, route)
+		}
+
+		if cfg.Regex != "" {
+			re, err := regexp.Compile(cfg.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("did %q: %w", name, err)
+			}
+			route.regex = re
+			t.regex = append(t.regex, route)
+		}
+	}
+
+	return t, nil
+}
+
+// Match returns the route for given recipient. Exact matches take precedence
+// over the longest matching prefix, which takes precedence over regular expressions.
+func (t *didTable) Match(recipient string) *didRoute {
+	if t == nil {
+		return nil
+	}
+
+	if route, ok := t.exact[recipient]; ok {
+		return route
+	}
+
+	var match *didRoute
+	var matchLen int
+	for _, route := range t.prefix {
+		for _, prefix := range route.config.Prefix {
+			if len(prefix) > matchLen && strings.HasPrefix(recipient, prefix) {
+				match = route
+				matchLen = len(prefix)
+			}
+		}
+	}
+	if match != nil {
+		return match
+	}
+
+	for _, route := range t.regex {
+		if route.regex.MatchString(recipient) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// callConfig holds the settings used for an incoming call
+type callConfig struct {
+	csi         string
+	enableT38   bool
+	requestT38  bool
+	faxrcvdCmd  string
+	webhook     string
+	mailTo      string
+	answerafter uint64
+	reject      bool
+	subdir      string
+}
+
+// newCallConfig returns the default settings for incoming calls
+func newCallConfig() *callConfig {
+	return &callConfig{
+		csi:         gofaxlib.Config.Freeswitch.Ident,
+		enableT38:   gofaxlib.Config.Gofaxd.EnableT38,
+		requestT38:  gofaxlib.Config.Gofaxd.RequestT38,
+		faxrcvdCmd:  gofaxlib.Config.Gofaxd.FaxRcvdCmd,
+		webhook:     gofaxlib.Config.Gofaxd.Webhook,
+		answerafter: gofaxlib.Config.Gofaxd.Answerafter,
+	}
+}
+
+// applyDid overrides settings with the values set in given DID route
+func (cc *callConfig) applyDid(route *didRoute) {
+	cfg := route.config
+	if cfg.Ident != "" {
+		cc.csi = cfg.Ident
+	}
+	if cfg.EnableT38 != nil {
+		cc.enableT38 = *cfg.EnableT38
+	}
+	if cfg.RequestT38 != nil {
+		cc.requestT38 = *cfg.RequestT38
+	}
+	if cfg.FaxRcvdCmd != "" {
+		cc.faxrcvdCmd = cfg.FaxRcvdCmd
+	}
+	if cfg.Webhook != "" {
+		cc.webhook = cfg.Webhook
+	}
+	if cfg.MailTo != "" {
+		cc.mailTo = cfg.MailTo
+	}
+	if cfg.Answerafter != nil {
+		cc.answerafter = *cfg.Answerafter
+	}
+	if cfg.Subdir != "" {
+		cc.subdir = cfg.Subdir
+	}
+	if cfg.Reject != nil {
+		cc.reject = *cfg.Reject
+	}
+}
+
+// applyDynamicConfig overrides settings with the values returned by DynamicConfig
+func (cc *callConfig) applyDynamicConfig(dc *gofaxlib.HylaConfig) error {
+	if reject := dc.GetString("RejectCall"); reject != "" {
+		cc.reject = gofaxlib.DynamicConfigBool(reject)
+	}
+	if csi := dc.GetString("LocalIdentifier"); csi != "" {
+		cc.csi = csi
+	}
+	if enableT38 := dc.GetString("EnableT38"); enableT38 != "" {
+		cc.enableT38 = gofaxlib.DynamicConfigBool(enableT38)
+	}
+	if requestT38 := dc.GetString("RequestT38"); requestT38 != "" {
+		cc.requestT38 = gofaxlib.DynamicConfigBool(requestT38)
+	}
+	if faxrcvdCmd := dc.GetString("FaxRcvdCmd"); faxrcvdCmd != "" {
+		cc.faxrcvdCmd = faxrcvdCmd
+	}
+	if webhook := dc.GetString("Webhook"); webhook != "" {
+		if err := validWebhook(webhook); err != nil {
+			return err
+		}
+		cc.webhook = webhook
+	}
+	if mailTo := dc.GetString("MailTo"); mailTo != "" {
+		cc.mailTo = mailTo
+	}
+	if answerafter := dc.GetString("AnswerAfter"); answerafter != "" {
+		ms, err := strconv.ParseUint(answerafter, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid AnswerAfter: %w", err)
+		}
+		cc.answerafter = ms
+	}
+	if subdir := dc.GetString("RecvSubdir"); subdir != "" {
+		if err := validSubdir(subdir); err != nil {
+			return err
+		}
+		cc.subdir = subdir
+	}
+	return nil
+}
+
+// validSubdir checks that a destination subdirectory stays inside recvq
+func validSubdir(subdir string) error {
+	if subdir == "" {
+		return nil
+	}
+	clean := filepath.Clean(subdir)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("subdirectory %v is not inside %v", subdir, recvqDir)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDidTableMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	table, err := loadDidTable(map[string]*gofaxlib.DidConfig{
+		"4930100":  {},
+		"sales":    {Number: []string{"4930200", "4930201"}},
+		"berlin":   {Prefix: []string{"4930"}},
+		"berlin-2": {Prefix: []string{"49302"}},
+		"mobile":   {Regex: `^491[5-7]`},
+		"any":      {Regex: `^49`},
+	})
+	assert.NoError(err)
+
+	tests := []struct {
+		recipient string
+		route     string
+	}{
+		// Exact matches before prefixes
+		{"4930100", "4930100"},
+		{"4930201", "sales"},
+		// Longest prefix before regular expressions
+		{"4930101", "berlin"},
+		{"4930299", "berlin-2"},
+		// Regular expressions in order of the section names
+		{"4915112345", "any"},
+		{"4940123", "any"},
+		{"3312345", ""},
+	}
+	for _, test := range tests {
+		route := table.Match(test.recipient)
+		if test.route == "" {
+			assert.Nil(route, test.recipient)
+			continue
+		}
+		if assert.NotNil(route, test.recipient) {
+			assert.Equal(test.route, route.name, test.recipient)
+		}
+	}
+
+	var none *didTable
+	assert.Nil(none.Match("4930100"))
+
+	_, err = loadDidTable(map[string]*gofaxlib.DidConfig{
+		"a": {Number: []string{"4930100"}},
+		"b": {Number: []string{"4930100"}},
+	})
+	assert.EqualError(err, `did "b": number 4930100 already used by did "a"`)
+}
+
+func TestApplyDid(t *testing.T) {
+	assert := assert.New(t)
+	gofaxlib.Config.Freeswitch.Ident = "GOfax.IP"
+	gofaxlib.Config.Gofaxd.EnableT38 = true
+	gofaxlib.Config.Gofaxd.FaxRcvdCmd = "bin/faxrcvd"
+	defer func() {
+		gofaxlib.Config.Freeswitch.Ident = ""
+		gofaxlib.Config.Gofaxd.EnableT38 = false
+		gofaxlib.Config.Gofaxd.FaxRcvdCmd = ""
+	}()
+
+	disabled := false
+	var answerafter uint64
+	cc := newCallConfig()
+	cc.applyDid(&didRoute{name: "sales", config: &gofaxlib.DidConfig{
+		Ident:       "Sales",
+		EnableT38:   &disabled,
+		Answerafter: &answerafter,
+		MailTo:      "sales@example.com",
+		Subdir:      "sales",
+	}})
+	assert.Equal(&callConfig{
+		csi:        "Sales",
+		enableT38:  false,
+		faxrcvdCmd: "bin/faxrcvd",
+		mailTo:     "sales@example.com",
+		subdir:     "sales",
+	}, cc)
+}
+
+func TestValidSubdir(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, subdir := range []string{"", "sales", "sales/archive", "..archive", "sales/../archive"} {
+		assert.NoError(validSubdir(subdir), subdir)
+	}
+	for _, subdir := range []string{"..", "../archive", "sales/../../archive", "/var/spool/archive"} {
+		assert.Error(validSubdir(subdir), subdir)
+	}
+}
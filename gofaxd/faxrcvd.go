@@ -0,0 +1,174 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+const deliveryFaxRcvd = "faxrcvd"
+
+func init() {
+	deliverers[deliveryFaxRcvd] = runFaxRcvdCmd
+}
+
+// runFaxRcvdCmd calls FaxRcvdCmd for a received fax. The command and all
+// processes started by it are killed if it does not exit within timeout.
+func runFaxRcvdCmd(d *delivery, sessionlog gofaxlib.SessionLogger, timeout time.Duration) error {
+	fax := &d.Fax
+
+	rcvdcmd := fax.FaxRcvdCmd
+	if rcvdcmd == "" {
+		rcvdcmd = defaultFaxrcvdCmd
+	}
+	errmsg := ""
+	if !fax.Result.Success {
+		errmsg = fax.Result.ResultText
+	}
+
+	cmd := exec.Command(rcvdcmd, fax.Filename, fax.Device, fax.CommID, errmsg, fax.Cidnum, fax.Cidname, fax.Recipient, fax.Gateway)
+	cmd.Env = append(os.Environ(), faxRcvdEnv(fax)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if gofaxlib.Config.Gofaxd.FaxRcvdJSON {
+		metadata, err := json.Marshal(fax.metadata())
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = bytes.NewReader(metadata)
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	sessionlog.Log("Calling", cmd.Path, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		// Kill the whole process group
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = fmt.Errorf("timeout after %v", timeout)
+	}
+
+	if err != nil {
+		sessionlog.Log(cmd.Path, "ended with", err)
+		if output.Len() > 0 {
+			sessionlog.Log(output.String())
+		}
+		return err
+	}
+
+	sessionlog.Log(cmd.Path, "ended successfully")
+	return nil
+}
+
+// faxRcvdEnv returns the environment variables describing a received fax.
+// Variables are prefixed with GOFAX_ to avoid clashes with the environment of
+// gofaxd, HANGUPCAUSE and TRANSFER_RATE keep their names as used by existing
+// FaxDispatch scripts. X- SIP headers are passed as GOFAX_SIP_X_NAME.
+func faxRcvdEnv(fax *receivedFax) []string {
+	result := fax.Result
+
+	var badRows, longestBadRowRun uint
+	for _, p := range result.PageResults {
+		badRows += p.BadRows
+		if p.LongestBadRowRun > longestBadRowRun {
+			longestBadRowRun = p.LongestBadRowRun
+		}
+	}
+	var duration time.Duration
+	if !result.StartTs.IsZero() && result.EndTs.After(result.StartTs) {
+		duration = result.EndTs.Sub(result.StartTs)
+	}
+
+	env := []string{
+		"GOFAX_FILENAME=" + fax.Filename,
+		"GOFAX_DEVICE=" + fax.Device,
+		"GOFAX_COMMID=" + fax.CommID,
+		"GOFAX_CALL_UUID=" + fax.UUID,
+		"GOFAX_CIDNUM=" + fax.Cidnum,
+		"GOFAX_CIDNAME=" + fax.Cidname,
+		"GOFAX_RECIPIENT=" + fax.Recipient,
+		"GOFAX_GATEWAY=" + fax.Gateway,
+		"HANGUPCAUSE=" + result.Hangupcause,
+		fmt.Sprintf("GOFAX_SUCCESS=%v", result.Success),
+		"GOFAX_OUTCOME=" + string(result.Outcome),
+		fmt.Sprintf("GOFAX_RESULT_CODE=%d", result.ResultCode),
+		"GOFAX_RESULT_TEXT=" + result.ResultText,
+		"GOFAX_LOCAL_ID=" + result.LocalID,
+		"GOFAX_REMOTE_ID=" + result.RemoteID,
+		"GOFAX_REMOTE_VENDOR=" + result.RemoteVendor,
+		"GOFAX_REMOTE_MODEL=" + result.RemoteModel,
+		"GOFAX_T38_STATUS=" + result.T38Status,
+		fmt.Sprintf("TRANSFER_RATE=%d", result.TransferRate),
+		fmt.Sprintf("GOFAX_ECM=%v", result.Ecm),
+		fmt.Sprintf("GOFAX_PAGES=%d", result.TransferredPages),
+		fmt.Sprintf("GOFAX_TOTAL_PAGES=%d", result.TotalPages),
+		fmt.Sprintf("GOFAX_BAD_ROWS=%d", badRows),
+		fmt.Sprintf("GOFAX_LONGEST_BAD_ROW_RUN=%d", longestBadRowRun),
+		fmt.Sprintf("GOFAX_DURATION=%d", int64(duration.Seconds())),
+		fmt.Sprintf("GOFAX_NEGOTIATIONS=%d", result.NegotiateCount),
+	}
+
+	names := make([]string, 0, len(fax.SIPHeaders))
+	for name := range fax.SIPHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, sipHeaderEnv(name)+"="+fax.SIPHeaders[name])
+	}
+	return env
+}
+
+// sipHeaderEnv returns the environment variable name for a SIP header.
+// Characters other than letters and digits become underscores, so headers like
+// X-Foo-Bar and X-Foo_Bar map to the same variable, the last one sorted wins.
+func sipHeaderEnv(name string) string {
+	return "GOFAX_SIP_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+type testLog struct{}
+
+func (testLog) CommSeq() uint64                      { return 1 }
+func (testLog) CommID() string                       { return "000000001" }
+func (testLog) Logfile() string                      { return "" }
+func (testLog) Log(v ...interface{})                 {}
+func (testLog) Logf(format string, v ...interface{}) {}
+
+func TestFaxRcvdCmd(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "faxrcvd")
+	must(t, ioutil.WriteFile(script, []byte("#!/bin/sh\nenv > \""+dir+"/env\"\ncat > \""+dir+"/stdin\"\n"), 0700))
+
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	d := &delivery{Fax: receivedFax{
+		Filename:   "recvq/fax000000001.tif",
+		Device:     "freeswitch0",
+		CommID:     "000000001",
+		UUID:       "3f8b9a4e-0c7f-4d3e-9d7a-4b1b5a0e2c11",
+		Cidnum:     "4940123",
+		Cidname:    "Doe, John",
+		Recipient:  "4930100",
+		Gateway:    "carrier",
+		FaxRcvdCmd: script,
+		SIPHeaders: map[string]string{"X-Customer-Id": "1234", "X-Gofax-Jobid": "42", "X-Foo-Bar": "1", "X-Foo_bar": "2"},
+		Result: &gofaxlib.FaxResult{
+			StartTs:          start,
+			EndTs:            start.Add(95 * time.Second),
+			Hangupcause:      "NORMAL_CLEARING",
+			TotalPages:       3,
+			TransferredPages: 2,
+			Ecm:              true,
+			RemoteID:         "+49 40 123",
+			ResultCode:       49,
+			ResultText:       "The call dropped prematurely",
+			Outcome:          gofaxlib.OutcomePartial,
+			LocalID:          "+49 30 100",
+			T38Status:        "off",
+			TransferRate:     14400,
+			NegotiateCount:   2,
+			PageResults: []gofaxlib.PageResult{
+				{Page: 1, BadRows: 3, LongestBadRowRun: 2},
+				{Page: 2, BadRows: 4, LongestBadRowRun: 1},
+			},
+		},
+	}}
+
+	// Environment only
+	must(t, runFaxRcvdCmd(d, testLog{}, 10*time.Second))
+	env, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+	must(t, err)
+	for _, expected := range []string{
+		"GOFAX_FILENAME=recvq/fax000000001.tif",
+		"GOFAX_DEVICE=freeswitch0",
+		"GOFAX_COMMID=000000001",
+		"GOFAX_CALL_UUID=3f8b9a4e-0c7f-4d3e-9d7a-4b1b5a0e2c11",
+		"GOFAX_CIDNUM=4940123",
+		"GOFAX_CIDNAME=Doe, John",
+		"GOFAX_RECIPIENT=4930100",
+		"GOFAX_GATEWAY=carrier",
+		"HANGUPCAUSE=NORMAL_CLEARING",
+		"GOFAX_SUCCESS=false",
+		"GOFAX_OUTCOME=partial",
+		"GOFAX_LOCAL_ID=+49 30 100",
+		"GOFAX_T38_STATUS=off",
+		"GOFAX_RESULT_CODE=49",
+		"GOFAX_RESULT_TEXT=The call dropped prematurely",
+		"GOFAX_REMOTE_ID=+49 40 123",
+		"TRANSFER_RATE=14400",
+		"GOFAX_ECM=true",
+		"GOFAX_PAGES=2",
+		"GOFAX_TOTAL_PAGES=3",
+		"GOFAX_BAD_ROWS=7",
+		"GOFAX_LONGEST_BAD_ROW_RUN=2",
+		"GOFAX_DURATION=95",
+		"GOFAX_NEGOTIATIONS=2",
+		"GOFAX_SIP_X_CUSTOMER_ID=1234",
+		"GOFAX_SIP_X_GOFAX_JOBID=42",
+		"GOFAX_SIP_X_FOO_BAR=2",
+	} {
+		assert.Contains(strings.Split(string(env), "\n"), expected)
+	}
+	assert.NotContains(strings.Split(string(env), "\n"), "GOFAX_SIP_X_FOO_BAR=1")
+	stdin, err := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+	must(t, err)
+	assert.Empty(stdin)
+
+	// JSON on stdin
+	gofaxlib.Config.Gofaxd.FaxRcvdJSON = true
+	defer func() { gofaxlib.Config.Gofaxd.FaxRcvdJSON = false }()
+	must(t, runFaxRcvdCmd(d, testLog{}, 10*time.Second))
+	stdin, err = ioutil.ReadFile(filepath.Join(dir, "stdin"))
+	must(t, err)
+	var metadata faxMetadata
+	must(t, json.Unmarshal(stdin, &metadata))
+	assert.Equal(d.Fax.metadata(), &metadata)
+}
+
+func TestFaxRcvdCmdTimeout(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	// The child keeps the output open, so the whole process group has to be killed
+	script := filepath.Join(dir, "faxrcvd")
+	must(t, ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 30 &\necho $! > \""+dir+"/child\"\nwait\n"), 0700))
+
+	d := &delivery{Fax: receivedFax{FaxRcvdCmd: script, Result: &gofaxlib.FaxResult{Success: true}}}
+	start := time.Now()
+	err = runFaxRcvdCmd(d, testLog{}, 200*time.Millisecond)
+	assert.EqualError(err, "timeout after 200ms")
+	assert.True(time.Since(start) < 10*time.Second)
+
+	child, err := ioutil.ReadFile(filepath.Join(dir, "child"))
+	must(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(child)))
+	must(t, err)
+	assert.True(waitFor(func() bool {
+		// Killed orphans stay zombies until reaped by init
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		return os.IsNotExist(err) || strings.Contains(string(stat), ") Z ")
+	}))
+}
@@ -0,0 +1,334 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/faxpdf"
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
+)
+
+const (
+	deliveryMail = "mail"
+
+	attachmentTIFF = "tiff"
+	attachmentPDF  = "pdf"
+
+	defaultMailSubject = "Fax from {{.Cidnum}} to {{.Recipient}}"
+	defaultMailBody    = `A fax was received.
+
+From:        {{.Cidname}} <{{.Cidnum}}>
+To:          {{.Recipient}}
+Remote ID:   {{.Result.RemoteID}}
+Pages:       {{.Result.TransferredPages}}
+Result:      {{.Result.ResultText}}
+CommID:      {{.CommID}}
+`
+	base64LineLength = 76
+)
+
+func init() {
+	deliverers[deliveryMail] = sendMail
+}
+
+var (
+	mailSubject *template.Template
+	mailBody    *template.Template
+	mailMap     map[string]string
+
+	// Certificates trusted for STARTTLS, the system roots if nil
+	mailRootCAs *x509.CertPool
+)
+
+// loadMailConfig parses the mail templates and mapping file
+func loadMailConfig() error {
+	cfg := &gofaxlib.Config.Mail
+
+	switch cfg.Attachment {
+	case "", attachmentTIFF, attachmentPDF:
+	default:
+		return fmt.Errorf("mail: unknown attachment type %v", cfg.Attachment)
+	}
+
+	subject := cfg.Subject
+	if subject == "" {
+		subject = defaultMailSubject
+	}
+	var err error
+	if mailSubject, err = template.New("subject").Parse(subject); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	body := defaultMailBody
+	if cfg.BodyTemplate != "" {
+		data, err := ioutil.ReadFile(cfg.BodyTemplate)
+		if err != nil {
+			return fmt.Errorf("mail: %w", err)
+		}
+		body = string(data)
+	}
+	if mailBody, err = template.New("body").Parse(body); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	if cfg.Mapfile != "" {
+		if mailMap, err = readMailMap(cfg.Mapfile); err != nil {
+			return fmt.Errorf("mail: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// readMailMap reads a file mapping recipients to mail addresses.
+// Each line contains a recipient and a mail address separated by whitespace,
+// empty lines and lines starting with # are ignored.
+func readMailMap(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: error parsing line %d", filename, line)
+		}
+		m[fields[0]] = fields[1]
+	}
+	return m, scanner.Err()
+}
+
+// mailRecipient returns the mail address for a recipient found in the mapping file
+func mailRecipient(recipient string) string {
+	return mailMap[recipient]
+}
+
+// sendMail sends a received fax by mail
+func sendMail(d *delivery, sessionlog gofaxlib.SessionLogger, timeout time.Duration) error {
+	cfg := &gofaxlib.Config.Mail
+	fax := &d.Fax
+
+	var subject, body bytes.Buffer
+	if err := mailSubject.Execute(&subject, fax); err != nil {
+		return err
+	}
+	if err := mailBody.Execute(&body, fax); err != nil {
+		return err
+	}
+
+	tiffname := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, fax.Filename)
+	attachmentName := filepath.Base(fax.Filename)
+	contentType := "image/tiff"
+	var attachment []byte
+	var err error
+	if _, err = os.Stat(tiffname); os.IsNotExist(err) {
+		// Failed receptions may not have written a file, the mail reports the result only
+		sessionlog.Log("No fax file received, sending mail without attachment")
+		attachmentName = ""
+	} else if err != nil {
+		return err
+	} else if cfg.Attachment == attachmentPDF {
+		var pdf bytes.Buffer
+		f, err := tiff.Open(tiffname)
+		if err != nil {
+			return err
+		}
+		err = faxpdf.Convert(&pdf, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("converting %v to PDF: %w", tiffname, err)
+		}
+		attachment = pdf.Bytes()
+		attachmentName = strings.TrimSuffix(attachmentName, filepath.Ext(attachmentName)) + ".pdf"
+		contentType = "application/pdf"
+	} else if attachment, err = ioutil.ReadFile(tiffname); err != nil {
+		return err
+	}
+
+	msg, err := buildMail(cfg.From, fax.MailTo, strings.TrimSpace(subject.String()), body.String(), attachmentName, contentType, attachment)
+	if err != nil {
+		return err
+	}
+
+	sessionlog.Logf("Sending fax to %v using mail server %v", fax.MailTo, cfg.Server)
+	if err = smtpSend(cfg.Server, timeout, cfg.From, fax.MailTo, msg); err != nil {
+		return err
+	}
+
+	sessionlog.Log("Mail sent successfully")
+	return nil
+}
+
+// buildMail assembles a MIME message with a text part and an attachment,
+// which is left out if attachmentName is empty
+func buildMail(from, to, subject, body, attachmentName, contentType string, attachment []byte) ([]byte, error) {
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+
+	hostname, _ := os.Hostname()
+	msgid := make([]byte, 16)
+	rand.Read(msgid)
+
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%x@%s>\r\n", msgid, hostname)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(encodeBase64Lines([]byte(body)))
+
+	if attachmentName == "" {
+		if err = mw.Close(); err != nil {
+			return nil, err
+		}
+		return msg.Bytes(), nil
+	}
+
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Type", fmt.Sprintf("%s; name=\"%s\"", contentType, attachmentName))
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", attachmentName))
+	header.Set("Content-Transfer-Encoding", "base64")
+	if part, err = mw.CreatePart(header); err != nil {
+		return nil, err
+	}
+	part.Write(encodeBase64Lines(attachment))
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// encodeBase64Lines encodes data as base64 with line breaks as required for mail
+func encodeBase64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var out bytes.Buffer
+	for len(encoded) > base64LineLength {
+		out.WriteString(encoded[:base64LineLength])
+		out.WriteString("\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	out.WriteString(encoded)
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// smtpSend delivers a message using the configured SMTP server,
+// using STARTTLS and authentication if configured
+func smtpSend(server string, timeout time.Duration, from, to string, msg []byte) error {
+	cfg := &gofaxlib.Config.Mail
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %w", from, err)
+	}
+	recipients, err := mail.ParseAddressList(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %w", to, err)
+	}
+
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.StartTLS {
+		if err = c.StartTLS(&tls.Config{ServerName: host, RootCAs: mailRootCAs}); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(sender.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err = c.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeBase64Lines(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("\r\n", string(encodeBase64Lines(nil)))
+	assert.Equal("Zm9v\r\n", string(encodeBase64Lines([]byte("foo"))))
+
+	// 57 bytes fill exactly one line of 76 characters
+	data := bytes.Repeat([]byte("0123456789"), 20)
+	encoded := string(encodeBase64Lines(data))
+	assert.True(strings.HasSuffix(encoded, "\r\n"))
+	lines := strings.Split(strings.TrimSuffix(encoded, "\r\n"), "\r\n")
+	assert.Len(lines, 4)
+	for i, line := range lines[:len(lines)-1] {
+		assert.Len(line, base64LineLength, "line %d", i)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	assert.NoError(err)
+	assert.Equal(data, decoded)
+
+	assert.Equal(strings.Repeat("A", 76)+"\r\n", string(encodeBase64Lines(make([]byte, 57))))
+}
+
+func TestReadMailMap(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "faxmail.map")
+	must(t, ioutil.WriteFile(filename, []byte("# recipient address\n4930100 sales@example.com\n\n  4930200\tsupport@example.com  \n"), 0644))
+	m, err := readMailMap(filename)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"4930100": "sales@example.com", "4930200": "support@example.com"}, m)
+
+	must(t, ioutil.WriteFile(filename, []byte("4930100 sales@example.com\n4930200\n"), 0644))
+	_, err = readMailMap(filename)
+	assert.EqualError(err, filename+": error parsing line 2")
+
+	_, err = readMailMap(filepath.Join(dir, "missing"))
+	assert.Error(err)
+}
+
+// parseMail parses a message built by buildMail and returns the
+// header, the decoded body and the decoded attachment part
+func parseMail(t *testing.T, msg []byte) (mail.Header, string, *multipart.Part, []byte) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	must(t, err)
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	must(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+	mr := multipart.NewReader(m.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	must(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+	must(t, err)
+
+	attachment, err := mr.NextPart()
+	must(t, err)
+	data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	must(t, err)
+
+	_, err = mr.NextPart()
+	assert.Error(t, err)
+	return m.Header, string(body), attachment, data
+}
+
+func TestBuildMail(t *testing.T) {
+	assert := assert.New(t)
+	attachment := bytes.Repeat([]byte{0, 1, 2, 0xff}, 100)
+
+	msg, err := buildMail(`"GOfax.IP" <fax@example.com>`, "sales@example.com", "Fax von Müller", "Body\n", "fax00000001.tif", "image/tiff", attachment)
+	assert.NoError(err)
+
+	header, body, part, data := parseMail(t, msg)
+	assert.Equal(`"GOfax.IP" <fax@example.com>`, header.Get("From"))
+	assert.Equal("sales@example.com", header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	assert.NoError(err)
+	assert.Equal("Fax von Müller", subject)
+	assert.Equal("1.0", header.Get("MIME-Version"))
+	_, err = header.Date()
+	assert.NoError(err)
+	assert.Regexp(`^<[0-9a-f]{32}@.*>$`, header.Get("Message-ID"))
+
+	assert.Equal("Body\n", body)
+	assert.Equal(`image/tiff; name="fax00000001.tif"`, part.Header.Get("Content-Type"))
+	assert.Equal("fax00000001.tif", part.FileName())
+	assert.Equal(attachment, data)
+}
+
+// fakeSMTP is a minimal SMTP server supporting STARTTLS and AUTH PLAIN
+type fakeSMTP struct {
+	listener net.Listener
+	tls      *tls.Config
+	auth     string
+
+	commands chan string
+	messages chan []byte
+}
+
+func startFakeSMTP(t *testing.T, cert tls.Certificate, auth string) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(t, err)
+	s := &fakeSMTP{
+		listener: l,
+		tls:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		auth:     auth,
+		commands: make(chan string, 100),
+		messages: make(chan []byte, 10),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	encrypted := false
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		s.commands <- line
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO":
+			if encrypted {
+				tp.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250-localhost\r\n250 STARTTLS")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			encrypted = true
+		case "AUTH":
+			if line == "AUTH PLAIN "+s.auth {
+				tp.PrintfLine("235 Authentication successful")
+			} else {
+				tp.PrintfLine("535 Authentication failed")
+			}
+		case "MAIL", "RCPT":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- data
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	must(t, os.Mkdir(filepath.Join(dir, recvqDir), 0755))
+	must(t, ioutil.WriteFile(filepath.Join(dir, recvqDir, "fax00000001.tif"), []byte("II*\x00"), 0644))
+
+	// Borrow the certificate of a TLS test server, it is valid for 127.0.0.1
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := tlsServer.TLS.Certificates[0]
+	mailRootCAs = x509.NewCertPool()
+	mailRootCAs.AddCert(tlsServer.Certificate())
+	tlsServer.Close()
+
+	smtpServer := startFakeSMTP(t, cert, base64.StdEncoding.EncodeToString([]byte("\x00gofax\x00secret")))
+
+	savedConfig := gofaxlib.Config.Mail
+	gofaxlib.Config.Hylafax.Spooldir = dir
+	gofaxlib.Config.Mail.Server = smtpServer.listener.Addr().String()
+	gofaxlib.Config.Mail.StartTLS = true
+	gofaxlib.Config.Mail.Username = "gofax"
+	gofaxlib.Config.Mail.Password = "secret"
+	gofaxlib.Config.Mail.From = "GOfax.IP <fax@example.com>"
+	gofaxlib.Config.Mail.Subject = "Fax from {{.Cidnum}}"
+	defer func() {
+		gofaxlib.Config.Hylafax.Spooldir = ""
+		gofaxlib.Config.Mail = savedConfig
+		mailRootCAs = nil
+	}()
+	must(t, loadMailConfig())
+
+	d := &delivery{Fax: receivedFax{
+		Filename:  "recvq/fax00000001.tif",
+		CommID:    "000000001",
+		Cidnum:    "4940123",
+		Recipient: "4930100",
+		MailTo:    "Sales <sales@example.com>",
+		Result:    &gofaxlib.FaxResult{Success: true, ResultText: "OK", TransferredPages: 1},
+	}}
+	must(t, sendMail(d, testLog{}, 5*time.Second))
+
+	var commands []string
+	for len(smtpServer.commands) > 0 {
+		commands = append(commands, <-smtpServer.commands)
+	}
+	assert.Equal([]string{
+		"EHLO localhost",
+		"STARTTLS",
+		"EHLO localhost",
+		"AUTH PLAIN " + smtpServer.auth,
+		"MAIL FROM:<fax@example.com>",
+		"RCPT TO:<sales@example.com>",
+		"DATA",
+		"QUIT",
+	}, commands)
+
+	header, body, part, data := parseMail(t, <-smtpServer.messages)
+	assert.Equal("Fax from 4940123", header.Get("Subject"))
+	assert.Equal("Sales <sales@example.com>", header.Get("To"))
+	assert.Contains(body, "Pages:       1\n")
+	assert.Equal("fax00000001.tif", part.FileName())
+	assert.Equal("II*\x00", string(data))
+
+	// Failed receptions are reported without attachment
+	failed := *d
+	failed.Fax.Filename = "recvq/fax00000002.tif"
+	failed.Fax.Result = &gofaxlib.FaxResult{ResultText: "Disconnected after permitted retries"}
+	must(t, sendMail(&failed, testLog{}, 5*time.Second))
+	m, err := mail.ReadMessage(bytes.NewReader(<-smtpServer.messages))
+	must(t, err)
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	must(t, err)
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	part, err = mr.NextPart()
+	must(t, err)
+	text, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+	must(t, err)
+	assert.Contains(string(text), "Result:      Disconnected after permitted retries\n")
+	_, err = mr.NextPart()
+	assert.Equal(io.EOF, err)
+
+	// Wrong credentials
+	gofaxlib.Config.Mail.Password = "wrong"
+	err = sendMail(d, testLog{}, 5*time.Second)
+	if assert.IsType(&textproto.Error{}, err) {
+		assert.Equal(535, err.(*textproto.Error).Code)
+	}
+
+	// The certificate of the server has to be trusted
+	mailRootCAs = nil
+	err = sendMail(d, testLog{}, 5*time.Second)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "certificate signed by unknown authority")
+	}
+}
@@ -28,12 +28,16 @@ import (
 
 	"github.com/gonicus/gofaxip/gofaxlib"
 	"github.com/gonicus/gofaxip/gofaxlib/logger"
+	"github.com/gonicus/gofaxip/gofaxsend"
 )
 
 const (
 	defaultConfigfile = "/etc/gofax.conf"
 	productName       = "GOfax.IP"
 	modemPrefix       = "freeswitch"
+
+	// Time to wait for handlers to end after killing all channels
+	killTimeout = 3 * time.Second
 )
 
 var (
@@ -71,22 +75,74 @@ func main() {
 	logger.Logger.Printf("%v gofaxd %v starting", productName, version)
 	gofaxlib.LoadConfig(*configFile)
 
+	if gofaxlib.Config.Hylafax.Standalone {
+		logger.Logger.Print("Running in standalone mode using ", gofaxlib.Config.Hylafax.Spooldir)
+		if err := gofaxlib.CreateSpool(); err != nil {
+			logger.Logger.Print(err)
+			log.Fatal(err)
+		}
+		// Outbound faxes are sent by gofaxd
+		for _, load := range []func() error{
+			gofaxsend.LoadRetryPolicies,
+			gofaxsend.LoadGateways,
+			gofaxsend.LoadDialPlan,
+			gofaxsend.LoadSendWindows,
+			gofaxsend.LoadSIPHeaders,
+		} {
+			if err := load(); err != nil {
+				logger.Logger.Print("Config: ", err)
+				log.Fatal("Config: ", err)
+			}
+		}
+	}
+
 	if err := os.Chdir(gofaxlib.Config.Hylafax.Spooldir); err != nil {
 		logger.Logger.Print(err)
 		log.Fatal(err)
 	}
 
-	// Shut down receiving lines when killed
-	sigchan := make(chan os.Signal, 1)
+	var err error
+	if recipientRules, err = loadRecipientRules(gofaxlib.Config.Gofaxd.Recipient, gofaxlib.Config.Gofaxd.RecipientFromDiversionHeader); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if err = validWebhook(gofaxlib.Config.Gofaxd.Webhook); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if err = loadMailConfig(); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if didRoutes, err = loadDidTable(gofaxlib.Config.Did); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+
+	// Drain or shut down receiving lines when killed
+	sigchan := make(chan os.Signal, 2)
 	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
 
 	// Start modem device manager
-	var err error
 	devmanager, err = newManager(modemPrefix, gofaxlib.Config.Hylafax.Modems)
 	if err != nil {
 		logger.Logger.Fatal(err)
 	}
 
+	// Start delivery of received faxes
+	if deliveries, err = newDeliveryQueue(); err != nil {
+		logger.Logger.Fatal(err)
+	}
+	if err = deliveries.Resume(); err != nil {
+		logger.Logger.Print(err)
+	}
+
+	// Without faxq, outbound jobs are scheduled by gofaxd
+	if gofaxlib.Config.Hylafax.Standalone {
+		sendq = newSendQueue()
+		sendq.Start()
+	}
+
 	// Start event socket server to handle incoming calls
 	server := NewEventSocketServer()
 	server.Start()
@@ -96,12 +152,37 @@ func main() {
 	case err := <-server.Errors():
 		logger.Logger.Fatal(err)
 	case sig := <-sigchan:
-		logger.Logger.Print("Received ", sig, ", killing all channels")
+		server.Drain()
+		if timeout := gofaxlib.Config.Gofaxd.DrainTimeout; timeout > 0 {
+			logger.Logger.Printf("Received %v, draining for up to %d seconds", sig, timeout)
+			select {
+			case <-server.Done():
+				logger.Logger.Print("All calls ended")
+				shutdown()
+			case <-time.After(time.Duration(timeout) * time.Second):
+				logger.Logger.Print("Drain timeout reached, killing all channels")
+			case sig = <-sigchan:
+				logger.Logger.Print("Received ", sig, " while draining, killing all channels")
+			}
+		} else {
+			logger.Logger.Print("Received ", sig, ", killing all channels")
+		}
 		server.Kill()
-		devmanager.SetAllDown()
-		time.Sleep(3 * time.Second)
-		logger.Logger.Print("Terminating")
-		os.Exit(0)
+		select {
+		case <-server.Done():
+		case <-time.After(killTimeout):
+			logger.Logger.Print("Not all calls ended after killing channels")
+		}
+		shutdown()
 	}
 
 }
+
+func shutdown() {
+	if sendq != nil {
+		sendq.Stop()
+	}
+	devmanager.SetAllDown()
+	logger.Logger.Print("Terminating")
+	os.Exit(0)
+}
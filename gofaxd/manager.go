@@ -20,10 +20,14 @@ package main
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type manager struct {
 	devices []*Device
+
+	// Serializes FindDevice, so a device is not allocated twice
+	mu sync.Mutex
 }
 
 func newManager(nameprefix string, count uint) (*manager, error) {
@@ -52,10 +56,23 @@ func (m *manager) SetAllDown() {
 	}
 }
 
+// FindDevice allocates a device for receiving and sets it to busy.
+// The device has to be released using Release.
 func (m *manager) FindDevice(msg string) (*Device, error) {
+	return m.find(msg, false)
+}
+
+// FindSendingDevice allocates a device for sending and sets it to busy.
+// The device has to be released using Release.
+func (m *manager) FindSendingDevice() (*Device, error) {
+	return m.find("Sending facsimile", true)
+}
+
+func (m *manager) find(msg string, outbound bool) (*Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, d := range m.devices {
-		if d.GetState() == stateReady {
-			d.SetBusy(msg, false)
+		if d.allocate(msg, outbound) {
 			return d, nil
 		}
 	}
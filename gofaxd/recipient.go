@@ -0,0 +1,220 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fiorix/go-eventsocket/eventsocket"
+)
+
+const (
+	sourceHeaderPrefix   = "header:"
+	sourceVariablePrefix = "var:"
+
+	normalizeNone   = "none"
+	normalizeDigits = "digits"
+	normalizeE164   = "e164"
+)
+
+// recipientRule extracts the recipient of an incoming call from
+// a channel variable or SIP header of the connect event
+type recipientRule struct {
+	rule      string
+	header    string
+	index     int
+	regex     *regexp.Regexp
+	normalize string
+	// Accept calls without a recipient
+	allowEmpty bool
+}
+
+var recipientRules []*recipientRule
+
+// parseRecipientRule parses a rule in the format "source regex [normalization]".
+// Source is either "header:<SIP header>", "var:<channel variable>" or
+// the name of a header of the connect event. An index can be appended
+// to the source to select an entry of a comma separated list, e.g. "header:Diversion[1]".
+func parseRecipientRule(rule string) (*recipientRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("recipient rule %q: expected \"source regex [normalization]\"", rule)
+	}
+
+	r := &recipientRule{
+		rule:      rule,
+		index:     -1,
+		normalize: normalizeNone,
+	}
+
+	source := fields[0]
+	if i := strings.IndexByte(source, '['); i > 0 && strings.HasSuffix(source, "]") {
+		index, err := strconv.Atoi(source[i+1 : len(source)-1])
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("recipient rule %q: invalid index in %v", rule, source)
+		}
+		r.index = index
+		source = source[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(source, sourceHeaderPrefix):
+		r.header = "Variable_sip_h_" + strings.TrimPrefix(source, sourceHeaderPrefix)
+	case strings.HasPrefix(source, sourceVariablePrefix):
+		r.header = "Variable_" + strings.TrimPrefix(source, sourceVariablePrefix)
+	default:
+		r.header = source
+	}
+
+	var err error
+	if r.regex, err = regexp.Compile(fields[1]); err != nil {
+		return nil, fmt.Errorf("recipient rule %q: %w", rule, err)
+	}
+	if r.regex.NumSubexp() < 1 {
+		return nil, fmt.Errorf("recipient rule %q: regex has no capture group", rule)
+	}
+
+	if len(fields) == 3 {
+		switch fields[2] {
+		case normalizeNone, normalizeDigits, normalizeE164:
+			r.normalize = fields[2]
+		default:
+			return nil, fmt.Errorf("recipient rule %q: unknown normalization %v", rule, fields[2])
+		}
+	}
+
+	return r, nil
+}
+
+// loadRecipientRules parses the configured recipient rules. If no rules are
+// configured, the rules resulting from recipientfromdiversionheader are returned.
+// Like before recipient rules existed, the default rule accepts calls without
+// a To user, the recipient is empty then.
+func loadRecipientRules(rules []string, fromDiversion bool) ([]*recipientRule, error) {
+	if len(rules) == 0 {
+		if fromDiversion {
+			rules = []string{`header:Diversion sip:(\d+)@`}
+		} else {
+			r, err := parseRecipientRule(`var:sip_to_user ^(.*)$`)
+			if err != nil {
+				return nil, err
+			}
+			r.allowEmpty = true
+			return []*recipientRule{r}, nil
+		}
+	}
+
+	result := make([]*recipientRule, 0, len(rules))
+	for _, rule := range rules {
+		r, err := parseRecipientRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// Extract returns the recipient found in given event and true, if the rule matched.
+func (r *recipientRule) Extract(ev *eventsocket.Event) (string, bool) {
+	value, ok := eventHeader(ev, r.header)
+	if !ok {
+		return "", r.allowEmpty
+	}
+
+	if r.index >= 0 {
+		entries := strings.Split(value, ",")
+		if r.index >= len(entries) {
+			return "", false
+		}
+		value = entries[r.index]
+	}
+
+	matches := r.regex.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return "", false
+	}
+
+	recipient := matches[1]
+	switch r.normalize {
+	case normalizeDigits:
+		recipient = digitsOnly(recipient)
+	case normalizeE164:
+		recipient = "+" + digitsOnly(recipient)
+	}
+
+	return recipient, recipient != "" || r.allowEmpty
+}
+
+func (r *recipientRule) String() string {
+	return r.rule
+}
+
+// extractRecipient applies the rules in order and returns the
+// recipient found by the first matching rule
+func extractRecipient(ev *eventsocket.Event, rules []*recipientRule) (string, *recipientRule, error) {
+	for _, rule := range rules {
+		if recipient, ok := rule.Extract(ev); ok {
+			return recipient, rule, nil
+		}
+	}
+	return "", nil, fmt.Errorf("Recipient could not be extracted, no rule matched")
+}
+
+// eventHeader looks up an event header ignoring case,
+// as FreeSWITCH sends SIP header variables in lower case
+func eventHeader(ev *eventsocket.Event, name string) (string, bool) {
+	if _, ok := ev.Header[name]; ok {
+		return ev.Get(name), true
+	}
+	for key := range ev.Header {
+		if strings.EqualFold(key, name) {
+			return ev.Get(key), true
+		}
+	}
+	return "", false
+}
+
+// eventSIPHeaders returns the X- headers of the INVITE
+// found in the channel variables of an event.
+// The event socket library lowercases channel variable names, so the original
+// case of the header names is lost. As SIP header names are case-insensitive,
+// the names are returned in canonical form like X-Customer-Id.
+func eventSIPHeaders(ev *eventsocket.Event) map[string]string {
+	headers := make(map[string]string)
+	prefix := strings.ToLower("Variable_sip_h_X-")
+	for key := range ev.Header {
+		if len(key) > len(prefix) && strings.ToLower(key[:len(prefix)]) == prefix {
+			headers[textproto.CanonicalMIMEHeaderKey("X-"+key[len(prefix):])] = ev.Get(key)
+		}
+	}
+	return headers
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
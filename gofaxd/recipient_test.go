@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fiorix/go-eventsocket/eventsocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractRecipient(t *testing.T) {
+	assert := assert.New(t)
+
+	ev := &eventsocket.Event{Header: eventsocket.EventHeader{
+		"Variable_sip_to_user":              "4930100",
+		"Variable_sip_req_uri":              "tel:+49-30-200",
+		"Variable_sip_h_p-called-party-id":  "<sip:+4930300@example.com>",
+		"Variable_sip_h_diversion":          "<sip:4930400@example.com>;reason=unconditional, <sip:4930500@example.com>;reason=user-busy",
+		"Channel-Caller-Id-Number":          "4940123",
+		"Variable_sip_h_x-unrelated-header": "foo",
+		"Variable_sip_h_x-another-header":   "bar",
+	}}
+
+	tests := []struct {
+		rules     []string
+		recipient string
+		rule      string
+	}{
+		{[]string{`var:sip_to_user ^(.*)$`}, "4930100", `var:sip_to_user ^(.*)$`},
+		{[]string{`header:P-Called-Party-ID sip:\+?(\d+)@`}, "4930300", `header:P-Called-Party-ID sip:\+?(\d+)@`},
+		{[]string{`header:P-Called-Party-ID sip:(\+?\d+)@ e164`}, "+4930300", `header:P-Called-Party-ID sip:(\+?\d+)@ e164`},
+		{[]string{`var:sip_req_uri ^tel:(.*)$ digits`}, "4930200", `var:sip_req_uri ^tel:(.*)$ digits`},
+		{[]string{`header:Diversion[1] sip:(\d+)@`}, "4930500", `header:Diversion[1] sip:(\d+)@`},
+		{[]string{`header:Diversion[2] sip:(\d+)@`, `header:Diversion sip:(\d+)@`}, "4930400", `header:Diversion sip:(\d+)@`},
+		{[]string{`header:X-Missing (.*)`, `Channel-Caller-Id-Number ^(\d+)$`}, "4940123", `Channel-Caller-Id-Number ^(\d+)$`},
+	}
+
+	for _, test := range tests {
+		rules, err := loadRecipientRules(test.rules, false)
+		assert.NoError(err)
+		recipient, rule, err := extractRecipient(ev, rules)
+		assert.NoError(err, test.rules)
+		assert.Equal(test.recipient, recipient, test.rules)
+		assert.Equal(test.rule, rule.String())
+	}
+
+	rules, err := loadRecipientRules(nil, true)
+	assert.NoError(err)
+	recipient, _, err := extractRecipient(ev, rules)
+	assert.NoError(err)
+	assert.Equal("4930400", recipient)
+
+	// The default rule accepts calls without a To user
+	rules, err = loadRecipientRules(nil, false)
+	assert.NoError(err)
+	for _, header := range []eventsocket.EventHeader{{"Variable_sip_to_user": ""}, {}} {
+		recipient, rule, err := extractRecipient(&eventsocket.Event{Header: header}, rules)
+		assert.NoError(err)
+		assert.Equal("", recipient)
+		assert.Equal(`var:sip_to_user ^(.*)$`, rule.String())
+	}
+
+	// Configured rules need a recipient
+	rules, err = loadRecipientRules([]string{`var:sip_to_user ^(.*)$`}, false)
+	assert.NoError(err)
+	_, _, err = extractRecipient(&eventsocket.Event{Header: eventsocket.EventHeader{"Variable_sip_to_user": ""}}, rules)
+	assert.Error(err)
+
+	rules, err = loadRecipientRules([]string{`header:X-Missing (.*)`}, false)
+	assert.NoError(err)
+	_, _, err = extractRecipient(ev, rules)
+	assert.Error(err)
+
+	for _, invalid := range []string{`header:Diversion`, `header:Diversion \d+`, `header:Diversion (\d+) unknown`, `header:Diversion[x] (\d+)`} {
+		_, err = parseRecipientRule(invalid)
+		assert.Error(err, invalid)
+	}
+}
+
+func TestEventSIPHeaders(t *testing.T) {
+	ev := &eventsocket.Event{Header: eventsocket.EventHeader{
+		"Variable_sip_to_user":             "4930100",
+		"Variable_sip_h_diversion":         "<sip:4930400@example.com>",
+		"Variable_sip_h_x-gofax-jobid":     "42",
+		"Variable_sip_h_X-Customer":        "Doe, John",
+		"Variable_sip_h_x-":                "empty name",
+		"Variable_sip_h_x-another-header":  "bar",
+		"Variable_sip_i_x-unrelated-value": "foo",
+	}}
+	assert.Equal(t, map[string]string{
+		"X-Gofax-Jobid":    "42",
+		"X-Customer":       "Doe, John",
+		"X-Another-Header": "bar",
+	}, eventSIPHeaders(ev))
+}
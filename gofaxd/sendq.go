@@ -0,0 +1,306 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+const (
+	sendqDir = "sendq"
+	doneqDir = "doneq"
+	docqDir  = "docq"
+
+	// Job states as used by HylaFAX
+	jobStateSleeping = 3
+	jobStateReady    = 5
+	jobStateActive   = 6
+	jobStateDone     = 7
+	jobStateFailed   = 8
+
+	defaultMaxTries     = 3
+	defaultMaxDials     = 12
+	defaultRequeueDelay = 300 // seconds
+
+	sendqScanInterval = 5 * time.Second
+)
+
+// sendQueue schedules the jobs in sendq in standalone mode like faxq
+// would: due jobs are sent using a free modem, failed jobs are requeued
+// until they run out of tries and finished jobs are moved to doneq.
+type sendQueue struct {
+	requeueDelay time.Duration
+
+	ctx     context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+
+	// Queue files of running jobs
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+var sendq *sendQueue
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{
+		requeueDelay: defaultRequeueDelay * time.Second,
+		active:       make(map[string]bool),
+	}
+	if delay := gofaxlib.Config.Gofaxd.RequeueDelay; delay != 0 {
+		q.requeueDelay = time.Duration(delay) * time.Second
+	}
+	q.ctx, q.stop = context.WithCancel(context.Background())
+	return q
+}
+
+// Start periodically looks for jobs to send
+func (q *sendQueue) Start() {
+	go func() {
+		ticker := time.NewTicker(sendqScanInterval)
+		defer ticker.Stop()
+		for {
+			q.scan()
+			select {
+			case <-ticker.C:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop hangs up all running transmissions and waits until their jobs
+// are requeued.
+func (q *sendQueue) Stop() {
+	q.mu.Lock()
+	q.stop()
+	q.mu.Unlock()
+	q.running.Wait()
+}
+
+// scan starts all due jobs for which a modem is available
+func (q *sendQueue) scan() {
+	files, err := filepath.Glob(filepath.Join(sendqDir, "q*"))
+	if err != nil {
+		logger.Logger.Print(err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return jobNumber(files[i]) < jobNumber(files[j])
+	})
+
+	for _, file := range files {
+		q.mu.Lock()
+		skip := q.active[file] || q.ctx.Err() != nil
+		q.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		due, err := q.due(file)
+		if err != nil {
+			logger.Logger.Printf("Error reading queue file %v: %v", file, err)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		device, err := devmanager.FindSendingDevice()
+		if err != nil {
+			// Try again with the next scan
+			return
+		}
+
+		q.mu.Lock()
+		if q.ctx.Err() != nil {
+			q.mu.Unlock()
+			device.Release()
+			return
+		}
+		q.active[file] = true
+		q.running.Add(1)
+		q.mu.Unlock()
+		go q.send(file, device)
+	}
+}
+
+// due returns true if a job should be sent now.
+// Jobs that reached their kill time are failed.
+func (q *sendQueue) due(file string) (bool, error) {
+	qf, err := gofaxsend.OpenQfile(file)
+	if err != nil {
+		return false, err
+	}
+	defer qf.Close()
+
+	if state, _ := qf.GetInt("state"); state == jobStateDone || state == jobStateFailed {
+		return false, nil
+	}
+
+	now := time.Now().Unix()
+	if killtime, _ := qf.GetInt("killtime"); killtime > 0 && int64(killtime) <= now {
+		logger.Logger.Printf("Job %v: Kill time expired", qf.GetString("jobid"))
+		qf.Set("state", strconv.Itoa(jobStateFailed))
+		qf.Set("status", "Kill time expired")
+		if err = qf.Write(); err != nil {
+			return false, err
+		}
+		q.done(file, qf)
+		return false, nil
+	}
+
+	tts, _ := qf.GetInt("tts")
+	return int64(tts) <= now, nil
+}
+
+// send sends a job using the given device
+func (q *sendQueue) send(file string, device *Device) {
+	defer func() {
+		device.Release()
+		q.mu.Lock()
+		delete(q.active, file)
+		q.mu.Unlock()
+		q.running.Done()
+	}()
+
+	qf, err := gofaxsend.OpenQfile(file)
+	if err != nil {
+		logger.Logger.Printf("Error opening queue file %v: %v", file, err)
+		return
+	}
+	defer qf.Close()
+
+	qf.Set("state", strconv.Itoa(jobStateActive))
+	qf.Set("modem", device.Name)
+	if err = qf.Write(); err != nil {
+		logger.Logger.Printf("Error updating queue file %v: %v", file, err)
+		return
+	}
+
+	returned, _, err := gofaxsend.SendQfileContext(q.ctx, qf, device.Name)
+	if err != nil {
+		logger.Logger.Printf("Job %v: Error sending fax: %v", qf.GetString("jobid"), err)
+	}
+
+	finished := q.finish(qf, returned, err)
+	if err = qf.Write(); err != nil {
+		logger.Logger.Printf("Error updating queue file %v: %v", file, err)
+	}
+	if finished {
+		q.done(file, qf)
+	}
+}
+
+// finish sets the state of a job after an attempt.
+// It returns true if the job will not be sent again.
+func (q *sendQueue) finish(qf gofaxsend.Qfiler, returned gofaxsend.SendResult, err error) bool {
+	status := qf.GetString("status")
+	tries, _ := qf.GetInt("tottries")
+	dials, _ := qf.GetInt("totdials")
+	maxTries, e := qf.GetInt("maxtries")
+	if e != nil || maxTries <= 0 {
+		maxTries = defaultMaxTries
+	}
+	maxDials, e := qf.GetInt("maxdials")
+	if e != nil || maxDials <= 0 {
+		maxDials = defaultMaxDials
+	}
+
+	// Invalid queue files can't be sent, other errors are local
+	// problems like a full disk and count as failed attempt
+	var faxErr gofaxsend.FaxError
+	invalid := errors.As(err, &faxErr) && !faxErr.Retry()
+	if err != nil {
+		status = err.Error()
+		qf.Set("status", status)
+		if !invalid {
+			tries++
+			qf.Set("tottries", strconv.Itoa(tries))
+		}
+	}
+
+	state := jobStateSleeping
+	switch {
+	case invalid:
+		state = jobStateFailed
+	case returned == gofaxsend.SendDone:
+		state = jobStateDone
+	case q.ctx.Err() != nil:
+		// Stopped while sending, try again after the next start
+		state = jobStateReady
+		qf.Set("tts", "0")
+	case err == nil && (returned == gofaxsend.SendFailed || returned == gofaxsend.SendReformat):
+		// Documents can't be converted again without HylaFAX
+		state = jobStateFailed
+	case tries >= maxTries:
+		state = jobStateFailed
+		qf.Set("status", fmt.Sprintf("%s (giving up after %d attempts)", status, tries))
+	case dials >= maxDials:
+		state = jobStateFailed
+		qf.Set("status", fmt.Sprintf("%s (giving up after %d dials)", status, dials))
+	default:
+		// Keep a later time requested by gofaxsend
+		next := time.Now().Add(q.requeueDelay).Unix()
+		if tts, e := qf.GetInt("tts"); e != nil || int64(tts) < next {
+			qf.Set("tts", strconv.FormatInt(next, 10))
+		}
+	}
+	qf.Set("state", strconv.Itoa(state))
+
+	logger.Logger.Printf("Job %v: State %d, %v", qf.GetString("jobid"), state, qf.GetString("status"))
+	return state == jobStateDone || state == jobStateFailed
+}
+
+// done moves the queue file of a finished job to doneq
+// and removes its documents
+func (q *sendQueue) done(file string, qf gofaxsend.Qfiler) {
+	for _, entry := range qf.GetAll("fax") {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || filepath.Dir(parts[2]) != docqDir {
+			continue
+		}
+		if err := os.Remove(parts[2]); err != nil && !os.IsNotExist(err) {
+			logger.Logger.Print(err)
+		}
+	}
+
+	if err := os.Rename(file, filepath.Join(doneqDir, filepath.Base(file))); err != nil {
+		logger.Logger.Print(err)
+	}
+}
+
+// jobNumber returns the job ID of a queue file name
+func jobNumber(file string) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimPrefix(filepath.Base(file), "q"), 10, 64)
+	return n
+}
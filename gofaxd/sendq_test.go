@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxsend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendQueueFinish(t *testing.T) {
+	q := newSendQueue()
+	later := time.Now().Add(time.Hour).Unix()
+
+	for _, tc := range []struct {
+		name     string
+		params   map[string][]string
+		returned gofaxsend.SendResult
+		err      error
+		state    int
+		status   string
+		tries    string
+		tts      int64
+	}{
+		{name: "done", returned: gofaxsend.SendDone, state: jobStateDone, status: "OK"},
+		{name: "failed", returned: gofaxsend.SendFailed, state: jobStateFailed, status: "OK"},
+		{name: "reformat", returned: gofaxsend.SendReformat, state: jobStateFailed, status: "OK"},
+		{name: "invalid", returned: gofaxsend.SendFailed, err: gofaxsend.NewFaxError("Error parsing jobid", false), state: jobStateFailed, status: "Error parsing jobid"},
+		{
+			name:     "local error",
+			returned: gofaxsend.SendFailed, err: errors.New("open log/c000000001: no space left on device"),
+			state: jobStateSleeping, status: "open log/c000000001: no space left on device", tries: "1",
+			tts: time.Now().Add(q.requeueDelay).Unix(),
+		},
+		{
+			name:     "local error max tries",
+			params:   map[string][]string{"tottries": {"1"}, "maxtries": {"2"}},
+			returned: gofaxsend.SendFailed, err: errors.New("lock seqf: resource temporarily unavailable"),
+			state: jobStateFailed, status: "lock seqf: resource temporarily unavailable (giving up after 2 attempts)", tries: "2",
+		},
+		{name: "retry", returned: gofaxsend.SendRetry, state: jobStateSleeping, status: "OK", tts: time.Now().Add(q.requeueDelay).Unix()},
+		{
+			name:     "retry at tts",
+			params:   map[string][]string{"tts": {strconv.FormatInt(later, 10)}},
+			returned: gofaxsend.SendRetry, state: jobStateSleeping, status: "OK", tts: later,
+		},
+		{
+			name:     "max tries",
+			params:   map[string][]string{"tottries": {"2"}, "maxtries": {"2"}},
+			returned: gofaxsend.SendRetry, state: jobStateFailed, status: "OK (giving up after 2 attempts)",
+		},
+		{
+			name:     "default max dials",
+			params:   map[string][]string{"totdials": {"12"}},
+			returned: gofaxsend.SendV17fail, state: jobStateFailed, status: "OK (giving up after 12 dials)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := map[string][]string{"status": {"OK"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+			qf := gofaxsend.NewQmemory(params)
+
+			finished := q.finish(qf, tc.returned, tc.err)
+			assert.Equal(t, tc.state == jobStateDone || tc.state == jobStateFailed, finished)
+			assert.Equal(t, strconv.Itoa(tc.state), qf.GetString("state"))
+			assert.Equal(t, tc.status, qf.GetString("status"))
+			if tc.tries != "" {
+				assert.Equal(t, tc.tries, qf.GetString("tottries"))
+			}
+			if tc.tts != 0 {
+				tts, err := qf.GetInt("tts")
+				assert.NoError(t, err)
+				assert.InDelta(t, tc.tts, tts, 2)
+			}
+		})
+	}
+
+	// Jobs interrupted by stopping are sent again after the next start
+	q.Stop()
+	qf := gofaxsend.NewQmemory(map[string][]string{"status": {"Transmission cancelled"}})
+	assert.False(t, q.finish(qf, gofaxsend.SendFailed, nil))
+	assert.Equal(t, strconv.Itoa(jobStateReady), qf.GetString("state"))
+}
+
+func TestSendQueueKilltime(t *testing.T) {
+	spooldir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	gofaxlib.Config.Hylafax.Spooldir = spooldir
+	must(t, gofaxlib.CreateSpool())
+	wd, err := os.Getwd()
+	must(t, err)
+	must(t, os.Chdir(spooldir))
+	defer func() {
+		os.Chdir(wd)
+		os.RemoveAll(spooldir)
+	}()
+
+	now := time.Now()
+	writeQfile := func(name string, tts, killtime time.Time) {
+		must(t, ioutil.WriteFile(filepath.Join(docqDir, name+".tif"), []byte("II*\x00"), 0644))
+		qf, err := gofaxsend.CreateQfile(filepath.Join(sendqDir, name))
+		must(t, err)
+		qf.Add("jobid", name[1:])
+		qf.Add("state", strconv.Itoa(jobStateSleeping))
+		qf.Add("tts", strconv.FormatInt(tts.Unix(), 10))
+		qf.Add("killtime", strconv.FormatInt(killtime.Unix(), 10))
+		qf.Add("fax", "0::"+filepath.Join(docqDir, name+".tif"))
+		must(t, qf.Write())
+		must(t, qf.Close())
+	}
+	writeQfile("q1", now.Add(-time.Hour), now.Add(-time.Minute))
+	writeQfile("q2", now.Add(time.Hour), now.Add(2*time.Hour))
+
+	// No modem is needed as no job is due
+	q := newSendQueue()
+	q.scan()
+
+	// Expired job was moved to doneq
+	assert.NoFileExists(t, filepath.Join(sendqDir, "q1"))
+	assert.NoFileExists(t, filepath.Join(docqDir, "q1.tif"))
+	qf, err := gofaxsend.OpenQfile(filepath.Join(doneqDir, "q1"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, strconv.Itoa(jobStateFailed), qf.GetString("state"))
+		assert.Equal(t, "Kill time expired", qf.GetString("status"))
+		qf.Close()
+	}
+
+	// Job to be sent later is left alone
+	assert.FileExists(t, filepath.Join(sendqDir, "q2"))
+	assert.FileExists(t, filepath.Join(docqDir, "q2.tif"))
+}
@@ -20,10 +20,10 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gonicus/gofaxip/gofaxlib"
 	"github.com/gonicus/gofaxip/gofaxlib/logger"
@@ -36,13 +36,24 @@ const (
 	recvqFileFormat   = "fax%08d.tif"
 	recvqDir          = "recvq"
 	defaultFaxrcvdCmd = "bin/faxrcvd"
-	defaultDevice     = "freeswitch"
+	// FaxRcvdCmd value to disable calling FaxRcvdCmd, i.e. if only webhooks are used
+	disabledFaxrcvdCmd = "none"
+	defaultDevice      = "freeswitch"
+
+	// SIP response sent to calls arriving while draining (486 Busy Here)
+	defaultDrainResponse = "486"
 )
 
 // EventSocketServer is a server for handling outgoing event socket connections from FreeSWITCH
 type EventSocketServer struct {
 	errorChan chan error
 	killChan  chan struct{}
+
+	// Protects draining and the handlers WaitGroup, so that no new handler
+	// can be added after Drain() was called
+	mu       sync.Mutex
+	draining bool
+	handlers sync.WaitGroup
 }
 
 // NewEventSocketServer initializes a EventSocketServer
@@ -53,19 +64,6 @@ func NewEventSocketServer() *EventSocketServer {
 	return e
 }
 
-func getNumberFromSIPURI(uri string) (string, error) {
-	re := regexp.MustCompile(`sip:(\d+)@`)
-
-	matches := re.FindStringSubmatch(uri)
-
-	if len(matches) < 2 {
-		return "", fmt.Errorf("Number could not be extracted from SIP URI")
-	}
-
-	number := matches[1]
-	return number, nil
-}
-
 // Start starts a goroutine to listen for ESL connections and handle incoming calls
 func (e *EventSocketServer) Start() {
 	go func() {
@@ -81,15 +79,48 @@ func (e *EventSocketServer) Errors() <-chan error {
 	return e.errorChan
 }
 
+// Drain stops accepting new calls. Calls arriving after Drain() was called
+// are rejected with the configured SIP response, running calls are not affected.
+// The listener is kept open on purpose: if the event socket was closed,
+// FreeSWITCH's socket application would fail and the call would continue in
+// the dialplan instead of being rejected with a response the carrier can
+// use to fail over to another destination.
+func (e *EventSocketServer) Drain() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.draining = true
+}
+
+// Done returns a channel that is closed when all running calls have ended.
+// It must only be used after calling Drain().
+func (e *EventSocketServer) Done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		e.handlers.Wait()
+		close(done)
+	}()
+	return done
+}
+
 // Kill aborts all running connections and kills the
 // corresponding FreeSWITCH channels.
-// TODO: Right now we have not way implemented to wait until
-// all connections have closed and signal to the caller,
-// so we have to wait a few seconds after calling Kill()
+// Use Done() to wait until all connections have closed.
 func (e *EventSocketServer) Kill() {
 	close(e.killChan)
 }
 
+// track registers a new call handler. It returns false if the
+// server is draining and the call must not be accepted.
+func (e *EventSocketServer) track() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.draining {
+		return false
+	}
+	e.handlers.Add(1)
+	return true
+}
+
 // Handle incoming call
 func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 	logger.Logger.Println("Incoming Event Socket connection from", c.RemoteAddr())
@@ -101,6 +132,18 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 		return
 	}
 
+	if !e.track() {
+		response := gofaxlib.Config.Gofaxd.DrainResponse
+		if response == "" {
+			response = defaultDrainResponse
+		}
+		logger.Logger.Printf("Draining, rejecting call %v with %v", connectev.Get("Unique-Id"), response)
+		c.Execute("respond", response, true)
+		c.Send("exit")
+		return
+	}
+	defer e.handlers.Done()
+
 	channelUUID, err := uuid.Parse(connectev.Get("Unique-Id"))
 	if err != nil {
 		c.Send("exit")
@@ -115,36 +158,32 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 	c.Send("event plain CHANNEL_CALLSTATE CUSTOM spandsp::rxfaxnegociateresult spandsp::rxfaxpageresult spandsp::rxfaxresult")
 
 	// Extract Caller/Callee
-	var recipient string
-	if gofaxlib.Config.Gofaxd.RecipientFromDiversionHeader {
-		recipient, err = getNumberFromSIPURI(connectev.Get("Variable_sip_h_diversion"))
-		if err != nil {
-			logger.Logger.Println(err)
-			c.Execute("respond", "404", true)
-			c.Send("exit")
-			return
-		}
-	} else {
-		recipient = connectev.Get("Variable_sip_to_user")
+	recipient, recipientRule, err := extractRecipient(connectev, recipientRules)
+	if err != nil {
+		logger.Logger.Println(channelUUID, err)
+		c.Execute("respond", "404", true)
+		c.Send("exit")
+		return
 	}
 
 	gateway := connectev.Get("Variable_sip_gateway")
 	cidname := connectev.Get("Channel-Caller-Id-Name")
 	cidnum := connectev.Get("Channel-Caller-Id-Number")
+	sipHeaders := eventSIPHeaders(connectev)
 
 	logger.Logger.Printf("Incoming call to %v from %v <%v> via gateway %v", recipient, cidname, cidnum, gateway)
 
 	var device *Device
 	if gofaxlib.Config.Gofaxd.AllocateInboundDevices {
 		// Find free device
-		device, err := devmanager.FindDevice(fmt.Sprintf("Receiving facsimile"))
+		device, err = devmanager.FindDevice("Receiving facsimile")
 		if err != nil {
 			logger.Logger.Println(err)
 			c.Execute("respond", "404", true)
 			c.Send("exit")
 			return
 		}
-		defer device.SetReady()
+		defer device.Release()
 	}
 
 	var usedDevice string
@@ -154,7 +193,17 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 		usedDevice = defaultDevice
 	}
 
-	csi := gofaxlib.Config.Freeswitch.Ident
+	cc := newCallConfig()
+	if device != nil {
+		// Parameters set through the modem FIFO
+		if err = cc.applyDynamicConfig(device.Config()); err != nil {
+			logger.Logger.Println("Error in modem configuration:", err)
+		}
+	}
+	if route := didRoutes.Match(recipient); route != nil {
+		logger.Logger.Printf("Using did %q for recipient %v", route.name, recipient)
+		cc.applyDid(route)
+	}
 
 	// Query DynamicConfig
 	if dcCmd := gofaxlib.Config.Gofaxd.DynamicConfig; dcCmd != "" {
@@ -162,23 +211,19 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 		dc, err := gofaxlib.DynamicConfig(dcCmd, usedDevice, cidnum, cidname, recipient, gateway)
 		if err != nil {
 			logger.Logger.Println("Error calling DynamicConfig:", err)
-		} else {
-			// Check if call should be rejected
-			if gofaxlib.DynamicConfigBool(dc.GetString("RejectCall")) {
-				logger.Logger.Println("DynamicConfig decided to reject this call")
-				c.Execute("respond", "404", true)
-				c.Send("exit")
-				return
-			}
-
-			// Check if a custom identifier should be set
-			if dynamicCsi := dc.GetString("LocalIdentifier"); dynamicCsi != "" {
-				csi = dynamicCsi
-			}
-
+		} else if err = cc.applyDynamicConfig(dc); err != nil {
+			logger.Logger.Println("Error in DynamicConfig output:", err)
 		}
 	}
 
+	// Check if call should be rejected
+	if cc.reject {
+		logger.Logger.Printf("Rejecting call to %v", recipient)
+		c.Execute("respond", "404", true)
+		c.Send("exit")
+		return
+	}
+
 	sessionlog, err := gofaxlib.NewSessionLogger(0)
 	if err != nil {
 		c.Send("exit")
@@ -188,10 +233,14 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 
 	logger.Logger.Println(channelUUID, "Logging events for commid", sessionlog.CommID(), "to", sessionlog.Logfile())
 	sessionlog.Log("Inbound channel UUID: ", channelUUID)
+	sessionlog.Logf("Recipient %v extracted using rule \"%v\"", recipient, recipientRule)
+	for name, value := range sipHeaders {
+		sessionlog.Logf("SIP header %s: %s", name, value)
+	}
 
 	// Check if T.38 should be enabled
-	requestT38 := gofaxlib.Config.Gofaxd.RequestT38
-	enableT38 := gofaxlib.Config.Gofaxd.EnableT38
+	requestT38 := cc.requestT38
+	enableT38 := cc.enableT38
 
 	fallback, err := gofaxlib.GetSoftmodemFallback(nil, cidnum)
 	if err != nil {
@@ -214,9 +263,17 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 
 	// Start interacting with the caller
 
-	if gofaxlib.Config.Gofaxd.Answerafter != 0 {
+	if cc.answerafter != 0 {
 		c.Execute("ring_ready", "", true)
-		c.Execute("sleep", strconv.FormatUint(gofaxlib.Config.Gofaxd.Answerafter, 10), true)
+		var answers <-chan struct{}
+		if device != nil {
+			answers = device.AnswerRequests()
+		}
+		select {
+		case <-time.After(time.Duration(cc.answerafter) * time.Millisecond):
+		case <-answers:
+			sessionlog.Log("Answering call as requested by faxanswer")
+		}
 	}
 
 	c.Execute("answer", "", true)
@@ -232,14 +289,21 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 		sessionlog.Log(err)
 		return
 	}
-	filename := filepath.Join(recvqDir, fmt.Sprintf(recvqFileFormat, seq))
+	filename := filepath.Join(recvqDir, cc.subdir, fmt.Sprintf(recvqFileFormat, seq))
+	if cc.subdir != "" {
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			c.Send("exit")
+			sessionlog.Log(err)
+			return
+		}
+	}
 	filenameAbs := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, filename)
 
 	sessionlog.Log("Rxfax to", filenameAbs)
 
 	c.Execute("set", fmt.Sprintf("fax_enable_t38=%s", strconv.FormatBool(enableT38)), true)
 	c.Execute("set", fmt.Sprintf("fax_enable_t38_request=%s", strconv.FormatBool(requestT38)), true)
-	c.Execute("set", fmt.Sprintf("fax_ident=%s", csi), true)
+	c.Execute("set", fmt.Sprintf("fax_ident=%s", cc.csi), true)
 	c.Execute("rxfax", filenameAbs, true)
 	c.Execute("hangup", "", true)
 
@@ -247,6 +311,12 @@ func (e *EventSocketServer) handler(c *eventsocket.Connection) {
 	es := gofaxlib.NewEventStream(c)
 
 	pages := result.TransferredPages
+	status := ""
+
+	var aborts <-chan struct{}
+	if device != nil {
+		aborts = device.Aborts()
+	}
 
 EventLoop:
 	for {
@@ -269,6 +339,13 @@ EventLoop:
 						gofaxlib.Faxq.ReceiveStatus(device.Name, "P")
 					}
 				}
+
+				if device != nil {
+					if newStatus := receiveStatus(result); newStatus != status {
+						status = newStatus
+						device.WriteStatusFile(status)
+					}
+				}
 			}
 		case err := <-es.Errors():
 			if err.Error() == "EOF" {
@@ -277,6 +354,10 @@ EventLoop:
 				sessionlog.Log("Error:", err)
 			}
 			break EventLoop
+		case <-aborts:
+			// Wait for the hangup to record the result
+			sessionlog.Log("Abort request received, destroying channel")
+			c.Send(fmt.Sprintf("api uuid_kill %v", channelUUID))
 		case _ = <-e.killChan:
 			sessionlog.Log("Kill reqeust received, destroying channel")
 			c.Send(fmt.Sprintf("api uuid_kill %v", channelUUID))
@@ -288,7 +369,7 @@ EventLoop:
 	if device != nil {
 		gofaxlib.Faxq.ReceiveStatus(device.Name, "D")
 	}
-	sessionlog.Logf("Success: %v, Hangup Cause: %v, Result: %v", result.Success, result.Hangupcause, result.ResultText)
+	sessionlog.Logf("Success: %v, Outcome: %v, Hangup Cause: %v, Result: %v", result.Success, result.Outcome, result.Hangupcause, result.ResultText)
 
 	xfl := &gofaxlib.XFRecord{}
 	xfl.Commid = sessionlog.CommID()
@@ -333,28 +414,56 @@ EventLoop:
 	}
 
 	// Process received file
-	rcvdcmd := gofaxlib.Config.Gofaxd.FaxRcvdCmd
-	if rcvdcmd == "" {
-		rcvdcmd = defaultFaxrcvdCmd
+	fax := &receivedFax{
+		Filename:   filename,
+		Device:     usedDevice,
+		CommID:     sessionlog.CommID(),
+		UUID:       channelUUID.String(),
+		Cidnum:     cidnum,
+		Cidname:    cidname,
+		Recipient:  recipient,
+		Gateway:    gateway,
+		SIPHeaders: sipHeaders,
+		FaxRcvdCmd: cc.faxrcvdCmd,
+		Result:     result,
+		Record:     xfl,
 	}
-	errmsg := ""
-	if !result.Success {
-		errmsg = result.ResultText
+	if cc.faxrcvdCmd != disabledFaxrcvdCmd {
+		if err = deliveries.Enqueue(deliveryFaxRcvd, fax); err != nil {
+			sessionlog.Log("Error queueing delivery:", err)
+		}
 	}
-
-	cmd := exec.Command(rcvdcmd, filename, usedDevice, sessionlog.CommID(), errmsg, cidnum, cidname, recipient, gateway)
-	extraEnv := []string{
-		fmt.Sprintf("HANGUPCAUSE=%s", result.Hangupcause),
-		fmt.Sprintf("TRANSFER_RATE=%d", result.TransferRate),
+	if cc.webhook != "" {
+		fax.Webhook = cc.webhook
+		if err = deliveries.Enqueue(deliveryWebhook, fax); err != nil {
+			sessionlog.Log("Error queueing delivery:", err)
+		}
 	}
-	cmd.Env = append(os.Environ(), extraEnv...)
-	sessionlog.Log("Calling", cmd.Path, cmd.Args)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		sessionlog.Log(cmd.Path, "ended with", err)
-		sessionlog.Log(output)
-	} else {
-		sessionlog.Log(cmd.Path, "ended successfully")
+	if gofaxlib.Config.Mail.Server != "" {
+		fax.MailTo = cc.mailTo
+		if fax.MailTo == "" {
+			fax.MailTo = mailRecipient(recipient)
+		}
+		if fax.MailTo != "" {
+			if err = deliveries.Enqueue(deliveryMail, fax); err != nil {
+				sessionlog.Log("Error queueing delivery:", err)
+			}
+		}
 	}
 
 	return
 }
+
+// receiveStatus returns the modem status shown by faxstat during a reception
+func receiveStatus(result *gofaxlib.FaxResult) string {
+	status := "Receiving facsimile"
+	if result.RemoteID != "" {
+		status = fmt.Sprintf("Receiving from \"%s\"", result.RemoteID)
+	}
+	if result.TransferredPages == 1 {
+		status += ", 1 page received"
+	} else if result.TransferredPages > 1 {
+		status += fmt.Sprintf(", %d pages received", result.TransferredPages)
+	}
+	return status
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFaxq collects the messages sent to faxq's FIFO
+type fakeFaxq struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func startFakeFaxq(t *testing.T, spooldir string) *fakeFaxq {
+	name := filepath.Join(spooldir, "FIFO")
+	must(t, syscall.Mkfifo(name, 0600))
+
+	// Opening the FIFO read-write does not block and never returns EOF
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	must(t, err)
+
+	q := &fakeFaxq{}
+	go func() {
+		r := bufio.NewReader(f)
+		for {
+			msg, err := r.ReadString(0)
+			if err != nil {
+				return
+			}
+			q.mu.Lock()
+			q.messages = append(q.messages, strings.TrimSuffix(msg, "\x00"))
+			q.mu.Unlock()
+		}
+	}()
+	return q
+}
+
+// Messages returns and clears all messages received so far
+func (q *fakeFaxq) Messages() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages := q.messages
+	q.messages = nil
+	return messages
+}
+
+// fakeFreeswitch acts as FreeSWITCH connecting to the outbound event socket of gofaxd
+type fakeFreeswitch struct {
+	conn net.Conn
+	r    *textproto.Reader
+}
+
+func dialFakeFreeswitch(t *testing.T, addr string) *fakeFreeswitch {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	must(t, err)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &fakeFreeswitch{conn: conn, r: textproto.NewReader(bufio.NewReader(conn))}
+}
+
+// command reads the next command including all header lines
+func (f *fakeFreeswitch) command() (string, error) {
+	var lines []string
+	for {
+		line, err := f.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if line == "" {
+			if len(lines) == 0 {
+				continue
+			}
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (f *fakeFreeswitch) reply(headers map[string]string) {
+	msg := "Content-Type: command/reply\nReply-Text: +OK\n"
+	for k, v := range headers {
+		msg += fmt.Sprintf("%s: %s\n", k, v)
+	}
+	fmt.Fprint(f.conn, msg+"\n")
+}
+
+func (f *fakeFreeswitch) event(headers map[string]string) {
+	body := ""
+	for k, v := range headers {
+		body += fmt.Sprintf("%s: %s\n", k, url.QueryEscape(v))
+	}
+	body += "\n"
+	fmt.Fprintf(f.conn, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(body), body)
+}
+
+// call answers all commands until a command containing last was received
+func (f *fakeFreeswitch) call(t *testing.T, connect map[string]string, last string) []string {
+	var commands []string
+	for {
+		cmd, err := f.command()
+		must(t, err)
+		commands = append(commands, cmd)
+		if cmd == "connect" {
+			f.reply(connect)
+		} else {
+			f.reply(nil)
+		}
+		if strings.Contains(cmd, last) {
+			return commands
+		}
+	}
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 250; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func setupHandlerTest(t *testing.T) (*fakeFaxq, string) {
+	spooldir, err := ioutil.TempDir("", "gofaxd")
+	must(t, err)
+	for _, dir := range []string{statusDir, recvqDir, "log"} {
+		must(t, os.Mkdir(filepath.Join(spooldir, dir), 0755))
+	}
+
+	gofaxlib.Config.Hylafax.Spooldir = spooldir
+	gofaxlib.Config.Gofaxd.AllocateInboundDevices = true
+	gofaxlib.Config.Gofaxd.FaxRcvdCmd = disabledFaxrcvdCmd
+	gofaxlib.Config.Freeswitch.SoftmodemFallback = false
+
+	// Session logs are written relative to the spool directory
+	wd, err := os.Getwd()
+	must(t, err)
+	must(t, os.Chdir(spooldir))
+
+	faxq := startFakeFaxq(t, spooldir)
+
+	recipientRules, err = loadRecipientRules(nil, false)
+	must(t, err)
+	reject := true
+	didRoutes, err = loadDidTable(map[string]*gofaxlib.DidConfig{
+		"blocked": {Number: []string{"4930666"}, Reject: &reject},
+		"sales":   {Number: []string{"4930200"}, Ident: "Sales"},
+	})
+	must(t, err)
+
+	devmanager, err = newManager(modemPrefix, 1)
+	must(t, err)
+
+	// Pick a free port for the event socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(t, err)
+	gofaxlib.Config.Gofaxd.Socket = l.Addr().String()
+	l.Close()
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(spooldir)
+	})
+
+	return faxq, spooldir
+}
+
+// startServer starts an event socket server. The handlers of all calls
+// have to end before the test ends, as they use the global configuration.
+func startServer(t *testing.T) *EventSocketServer {
+	server := NewEventSocketServer()
+	server.Start()
+	t.Cleanup(func() {
+		server.Drain()
+		server.Kill()
+		select {
+		case <-server.Done():
+		case <-time.After(10 * time.Second):
+			t.Error("call handlers still running")
+		}
+	})
+	return server
+}
+
+func TestHandlerAllocatesDevice(t *testing.T) {
+	faxq, spooldir := setupHandlerTest(t)
+	device := devmanager.devices[0]
+	modemReady := "+" + device.Name + ":R" + "pcbffff01"
+
+	// Initial state of the device
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+	assert.True(t, waitFor(func() bool {
+		messages := faxq.Messages()
+		return len(messages) > 0 && messages[len(messages)-1] == modemReady
+	}))
+
+	startServer(t)
+
+	connect := map[string]string{
+		"Unique-ID":                uuid.New().String(),
+		"Channel-Caller-ID-Number": "4940123",
+		"Channel-Caller-ID-Name":   "Test",
+		"variable_sip_to_user":     "4930123",
+	}
+
+	// Successful reception of two pages
+	fs := dialFakeFreeswitch(t, gofaxlib.Config.Gofaxd.Socket)
+	commands := fs.call(t, connect, "execute-app-name: hangup")
+	assert.Contains(t, strings.Join(commands, "\n"), "execute-app-name: rxfax")
+	assert.Equal(t, stateBusy, int(device.GetState()))
+
+	fs.event(map[string]string{
+		"Event-Name":            "CUSTOM",
+		"Event-Subclass":        "spandsp::rxfaxnegociateresult",
+		"Fax-Remote-Station-Id": "+49 40 123",
+		"Fax-Transfer-Rate":     "14400",
+	})
+	for page := 1; page <= 2; page++ {
+		fs.event(map[string]string{
+			"Event-Name":                     "CUSTOM",
+			"Event-Subclass":                 "spandsp::rxfaxpageresult",
+			"Fax-Document-Transferred-Pages": fmt.Sprint(page),
+		})
+	}
+
+	statusfile := filepath.Join(spooldir, statusDir, device.Name)
+	assert.True(t, waitFor(func() bool {
+		status, _ := ioutil.ReadFile(statusfile)
+		return string(status) == `Receiving from "+49 40 123", 2 pages received`
+	}))
+
+	fs.event(map[string]string{
+		"Event-Name":                     "CUSTOM",
+		"Event-Subclass":                 "spandsp::rxfaxresult",
+		"Fax-Document-Transferred-Pages": "2",
+		"Fax-Success":                    "1",
+		"Fax-Result-Code":                "0",
+		"Fax-Result-Text":                "OK",
+	})
+	fs.event(map[string]string{
+		"Event-Name":         "CHANNEL_CALLSTATE",
+		"Channel-Call-State": "HANGUP",
+		"Hangup-Cause":       "NORMAL_CLEARING",
+	})
+
+	// The device is released after the call
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+	var messages []string
+	assert.True(t, waitFor(func() bool {
+		messages = append(messages, faxq.Messages()...)
+		return len(messages) > 0 && messages[len(messages)-1] == modemReady
+	}))
+
+	modem := device.Name
+	expected := []string{"+" + modem + ":B", "+" + modem + ":I", "@" + modem + ":B", "@" + modem + ":S",
+		"@" + modem + ":P", "@" + modem + ":P", "@" + modem + ":D", "@" + modem + ":E", "+" + modem + ":N", modemReady}
+	if assert.Len(t, messages, len(expected)) {
+		for i := range expected {
+			assert.True(t, strings.HasPrefix(messages[i], expected[i]), "expected %v, got %v", expected[i], messages[i])
+		}
+	}
+	status, _ := ioutil.ReadFile(statusfile)
+	assert.Equal(t, "Running and idle", string(status))
+
+	// A rejected call releases the device as well
+	connect["variable_sip_to_user"] = "4930666"
+	fs = dialFakeFreeswitch(t, gofaxlib.Config.Gofaxd.Socket)
+	commands = fs.call(t, connect, "exit")
+	assert.Contains(t, strings.Join(commands, "\n"), "execute-app-arg: 404")
+
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+	messages = nil
+	assert.True(t, waitFor(func() bool {
+		messages = append(messages, faxq.Messages()...)
+		return len(messages) > 0 && messages[len(messages)-1] == modemReady
+	}))
+	assert.Equal(t, []string{"+" + modem + ":B", "+" + modem + ":N", modemReady}, messages)
+}
+
+func TestServerDrain(t *testing.T) {
+	setupHandlerTest(t)
+	device := devmanager.devices[0]
+	assert.True(t, waitFor(func() bool { return device.GetState() == stateReady }))
+	gofaxlib.Config.Gofaxd.DrainResponse = "503"
+	defer func() { gofaxlib.Config.Gofaxd.DrainResponse = "" }()
+
+	server := startServer(t)
+
+	connect := map[string]string{
+		"Unique-ID":                uuid.New().String(),
+		"Channel-Caller-ID-Number": "4940123",
+		"variable_sip_to_user":     "4930123",
+	}
+
+	// A call running while draining
+	running := dialFakeFreeswitch(t, gofaxlib.Config.Gofaxd.Socket)
+	running.call(t, connect, "execute-app-name: hangup")
+	server.Drain()
+	done := server.Done()
+
+	// New calls are rejected
+	connect["Unique-ID"] = uuid.New().String()
+	rejected := dialFakeFreeswitch(t, gofaxlib.Config.Gofaxd.Socket)
+	commands := rejected.call(t, connect, "exit")
+	assert.Contains(t, strings.Join(commands, "\n"), "execute-app-arg: 503")
+	assert.NotContains(t, strings.Join(commands, "\n"), "execute-app-name: answer")
+
+	select {
+	case <-done:
+		t.Fatal("drained before the running call ended")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Done is closed when the running call has ended
+	running.event(map[string]string{
+		"Event-Name":         "CHANNEL_CALLSTATE",
+		"Channel-Call-State": "HANGUP",
+		"Hangup-Cause":       "NORMAL_CLEARING",
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not drained after the running call ended")
+	}
+	assert.False(t, server.track())
+}
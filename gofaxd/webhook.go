@@ -0,0 +1,212 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+const (
+	deliveryWebhook = "webhook"
+
+	webhookUserAgent       = "GOfax.IP"
+	webhookSignatureHeader = "X-Gofax-Signature"
+	webhookTimestampHeader = "X-Gofax-Timestamp"
+)
+
+func init() {
+	deliverers[deliveryWebhook] = postWebhook
+}
+
+// validWebhook checks if a webhook URL template can be parsed
+func validWebhook(webhook string) error {
+	if _, err := parseWebhook(webhook); err != nil {
+		return fmt.Errorf("invalid webhook: %w", err)
+	}
+	return nil
+}
+
+// parseWebhook parses a webhook URL template. The output of all actions
+// is escaped using urlquery, as fields like the caller ID name are chosen
+// by the caller and must not change the path or query of the URL.
+func parseWebhook(webhook string) (*template.Template, error) {
+	tmpl, err := template.New("webhook").Parse(webhook)
+	if err != nil {
+		return nil, err
+	}
+	escapeActions(tmpl.Tree.Root)
+	return tmpl, nil
+}
+
+// escapeActions adds urlquery to the pipelines of all actions printing a value
+func escapeActions(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeActions(child)
+		}
+	case *parse.ActionNode:
+		cmds := n.Pipe.Cmds
+		if len(n.Pipe.Decl) > 0 || len(cmds) == 0 {
+			return
+		}
+		// Templates written for earlier versions may escape fields themselves
+		last := cmds[len(cmds)-1].Args
+		if ident, ok := last[0].(*parse.IdentifierNode); ok && len(last) == 1 && ident.Ident == "urlquery" {
+			return
+		}
+		n.Pipe.Cmds = append(cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Args:     []parse.Node{parse.NewIdentifier("urlquery")},
+		})
+	case *parse.IfNode:
+		escapeActions(n.List)
+		escapeActions(n.ElseList)
+	case *parse.RangeNode:
+		escapeActions(n.List)
+		escapeActions(n.ElseList)
+	case *parse.WithNode:
+		escapeActions(n.List)
+		escapeActions(n.ElseList)
+	}
+}
+
+// webhookURL expands the URL template of a webhook delivery
+func webhookURL(fax *receivedFax) (string, error) {
+	tmpl, err := parseWebhook(fax.Webhook)
+	if err != nil {
+		return "", err
+	}
+
+	var url bytes.Buffer
+	if err = tmpl.Execute(&url, fax); err != nil {
+		return "", err
+	}
+	return url.String(), nil
+}
+
+// signWebhook calculates the HMAC-SHA256 signature of a request body
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends a received fax as multipart HTTP POST
+func postWebhook(d *delivery, sessionlog gofaxlib.SessionLogger, timeout time.Duration) error {
+	fax := &d.Fax
+
+	url, err := webhookURL(fax)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(fax.metadata())
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="metadata"`)
+	header.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err = part.Write(metadata); err != nil {
+		return err
+	}
+
+	// Failed receptions may not have written a file, only the metadata is posted then
+	tiff, err := os.Open(filepath.Join(gofaxlib.Config.Hylafax.Spooldir, fax.Filename))
+	if os.IsNotExist(err) {
+		sessionlog.Log("No fax file received, posting metadata only")
+	} else if err != nil {
+		return err
+	} else {
+		defer tiff.Close()
+
+		header = make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="fax"; filename="%s"`, filepath.Base(fax.Filename)))
+		header.Set("Content-Type", "image/tiff")
+		if part, err = mw.CreatePart(header); err != nil {
+			return err
+		}
+		if _, err = io.Copy(part, tiff); err != nil {
+			return err
+		}
+	}
+	if err = mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("User-Agent", webhookUserAgent)
+	if secret := gofaxlib.Config.Gofaxd.WebhookSecret; secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhook(secret, timestamp, body.Bytes()))
+	}
+
+	sessionlog.Log("Posting fax to webhook", url)
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	sessionlog.Log("Webhook returned", resp.Status)
+	return nil
+}
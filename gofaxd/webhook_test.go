@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// Reference signature calculated using Python's hmac module
+	assert.Equal(t, "sha256=0aad22a5f548b61b06fb1038d3180a7adf20268ad008f3d596164cf547d51884",
+		signWebhook("secret", "1700000000", []byte(`{"CommID":"000000001"}`)))
+}
+
+func TestWebhookURL(t *testing.T) {
+	assert := assert.New(t)
+	fax := &receivedFax{CommID: "000000001", Recipient: "4930100", Webhook: "https://example.com/fax/{{.Recipient}}?commid={{.CommID}}"}
+
+	url, err := webhookURL(fax)
+	assert.NoError(err)
+	assert.Equal("https://example.com/fax/4930100?commid=000000001", url)
+
+	// Fields are escaped, unless the template does it already
+	fax.Cidname = "Doe & Sons/Ltd?"
+	fax.SIPHeaders = map[string]string{"X-Customer-Id": "1#2"}
+	fax.Webhook = `https://example.com/fax/{{.Cidname}}?name={{.Cidname | urlquery}}{{if .SIPHeaders}}&customer={{index .SIPHeaders "X-Customer-Id"}}{{end}}{{$r := .Recipient}}&to={{$r}}`
+	url, err = webhookURL(fax)
+	assert.NoError(err)
+	assert.Equal("https://example.com/fax/Doe+%26+Sons%2FLtd%3F?name=Doe+%26+Sons%2FLtd%3F&customer=1%232&to=4930100", url)
+
+	fax.Webhook = "https://example.com/fax/{{.Unknown}}"
+	_, err = webhookURL(fax)
+	assert.Error(err)
+
+	assert.NoError(validWebhook("https://example.com/{{.Cidnum}}"))
+	assert.Error(validWebhook("https://example.com/{{.Cidnum"))
+}
+
+func TestPostWebhook(t *testing.T) {
+	assert := assert.New(t)
+	q, _ := setupDeliveryTest(t, 0)
+	q.retries = 0
+	spooldir, err := os.Getwd()
+	must(t, err)
+	gofaxlib.Config.Hylafax.Spooldir = spooldir
+	gofaxlib.Config.Gofaxd.WebhookSecret = "secret"
+	defer func() {
+		gofaxlib.Config.Hylafax.Spooldir = ""
+		gofaxlib.Config.Gofaxd.WebhookSecret = ""
+	}()
+	must(t, os.Mkdir(recvqDir, 0755))
+	must(t, ioutil.WriteFile(filepath.Join(recvqDir, "fax00000001.tif"), []byte("II*\x00"), 0644))
+
+	status := http.StatusOK
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(err)
+		assert.Equal(signWebhook("secret", r.Header.Get(webhookTimestampHeader), body), r.Header.Get(webhookSignatureHeader))
+		r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		requests <- r
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	fax := receivedFax{
+		Filename:  "recvq/fax00000001.tif",
+		CommID:    "000000001",
+		Recipient: "4930100",
+		Webhook:   server.URL + "/fax/{{.Recipient}}",
+		Result:    &gofaxlib.FaxResult{Success: true},
+	}
+	must(t, postWebhook(&delivery{Fax: fax}, testLog{}, q.timeout))
+
+	r := <-requests
+	assert.Equal("/fax/4930100", r.URL.Path)
+	assert.Equal(webhookUserAgent, r.Header.Get("User-Agent"))
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	must(t, err)
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	must(t, err)
+	assert.Equal("metadata", part.FormName())
+	var metadata faxMetadata
+	must(t, json.NewDecoder(part).Decode(&metadata))
+	assert.Equal(fax.metadata(), &metadata)
+
+	part, err = mr.NextPart()
+	must(t, err)
+	assert.Equal("fax", part.FormName())
+	assert.Equal("fax00000001.tif", part.FileName())
+	assert.Equal("image/tiff", part.Header.Get("Content-Type"))
+	tiff, err := ioutil.ReadAll(part)
+	must(t, err)
+	assert.Equal("II*\x00", string(tiff))
+
+	// Only the metadata is posted if no file was received
+	failed := fax
+	failed.Filename = "recvq/fax00000002.tif"
+	failed.Result = &gofaxlib.FaxResult{ResultText: "Disconnected after permitted retries"}
+	must(t, postWebhook(&delivery{Fax: failed}, testLog{}, q.timeout))
+	r = <-requests
+	_, params, err = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	must(t, err)
+	mr = multipart.NewReader(r.Body, params["boundary"])
+	part, err = mr.NextPart()
+	must(t, err)
+	assert.Equal("metadata", part.FormName())
+	_, err = mr.NextPart()
+	assert.Equal(io.EOF, err)
+
+	// Error responses are retried, the delivery is moved to the dead letter directory at last
+	status = http.StatusServiceUnavailable
+	err = postWebhook(&delivery{Fax: fax}, testLog{}, q.timeout)
+	assert.EqualError(err, "webhook returned 503 Service Unavailable: ")
+	<-requests
+
+	must(t, q.Enqueue(deliveryWebhook, &fax))
+	<-requests
+	deadLetter := filepath.Join(defaultDeliveryDeadLetter, "000000001-webhook.json")
+	assert.True(waitFor(func() bool {
+		_, err := os.Stat(deadLetter)
+		return err == nil
+	}))
+	d, err := q.load(deadLetter)
+	must(t, err)
+	assert.Equal("webhook returned 503 Service Unavailable: ", d.LastError)
+}
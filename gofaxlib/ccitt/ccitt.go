@@ -0,0 +1,187 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+// Package ccitt implements the ITU-T T.4 and T.6 (CCITT Group 3 and 4)
+// compression schemes used for facsimile images.
+package ccitt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Format is a CCITT compression scheme
+type Format int
+
+const (
+	// MH is Modified Huffman (1D) coding without EOL codes,
+	// every row starts at a byte boundary (TIFF compression 2)
+	MH Format = iota
+	// G3 is ITU-T T.4 coding with EOL codes, using
+	// 1D (MH) or 2D (MR) coding (TIFF compression 3)
+	G3
+	// G4 is ITU-T T.6 (MMR) coding (TIFF compression 4)
+	G4
+)
+
+// Options describe the encoded data
+type Options struct {
+	Format Format
+	// Width of the image in pixels
+	Width int
+
+	// G3 only: Rows are tagged as 1D or 2D coded
+	TwoD bool
+	// G3 only: Zero bits are inserted before EOL codes,
+	// so every EOL ends at a byte boundary
+	FillBits bool
+	// G3 only, encoding: Code every K-th row 1D if TwoD is set
+	K int
+}
+
+var (
+	errInvalidCode = errors.New("invalid code")
+	errEndOfData   = errors.New("unexpected end of data")
+	errRowLength   = errors.New("row exceeds image width")
+	errExtension   = errors.New("extension codes are not supported")
+	errMissingEOL  = errors.New("missing EOL")
+)
+
+// DecodeError is returned by Decode if decoding had to stop at a damaged row,
+// i.e. for damaged MH or G4 data and G3 data without further EOL codes.
+// Image contains the rows decoded so far, with missing rows added
+// as white rows and counted as bad rows if a height was given.
+type DecodeError struct {
+	// Row that could not be decoded
+	Row   int
+	Err   error
+	Image *Image
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Number of EOL codes marking the end of a G3 page (RTC)
+const rtcLength = 6
+
+func (o *Options) validate() error {
+	if o.Width <= 0 {
+		return fmt.Errorf("invalid width %d", o.Width)
+	}
+	switch o.Format {
+	case MH, G3, G4:
+	default:
+		return fmt.Errorf("unknown format %d", o.Format)
+	}
+	return nil
+}
+
+// Decode decodes CCITT compressed data. If height is not zero, decoding stops after
+// height rows and missing rows are added. Damaged rows in G3 data are replaced
+// by the previous row and reported in the BadRows field of the image.
+// Decoding MH and G4 data stops at the first damaged row as it is not possible
+// to resynchronize, a *DecodeError containing the partial image is returned then.
+func Decode(data []byte, opts Options, height int) (*Image, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{
+		r:     bitReader{data: data},
+		width: opts.Width,
+	}
+	img := NewImage(opts.Width, 0)
+
+	var ref []int
+	var decodeErr *DecodeError
+Rows:
+	for height == 0 || img.Height < height {
+		if d.r.zerosToEnd() {
+			break
+		}
+
+		var changes []int
+		var err error
+		switch opts.Format {
+		case MH:
+			changes, err = d.decode1D()
+			d.r.align()
+		case G3:
+			twoD := false
+			if d.r.skipEOL() {
+				// A missing EOL is tolerated, the row is assumed to be 1D coded then
+				twoD = opts.TwoD && d.r.bit() == 0
+				if d.r.skipEOL() || d.r.zerosToEnd() {
+					// RTC
+					break Rows
+				}
+			}
+			start := d.r.pos
+			if twoD {
+				changes, err = d.decode2D(ref)
+			} else {
+				changes, err = d.decode1D()
+			}
+			// Rows not ending at an EOL are damaged
+			if err == nil && d.r.eolAt(d.r.pos) < 0 && !d.r.zerosToEnd() {
+				err = errMissingEOL
+			}
+			if err != nil {
+				// Decoding may have run into the next EOL, resynchronize from the start of the row
+				d.r.pos = start
+			}
+		case G4:
+			if d.r.skipEOL() {
+				// EOFB
+				break Rows
+			}
+			changes, err = d.decode2D(ref)
+		}
+
+		if err != nil {
+			if opts.Format != G3 || !d.r.findEOL() {
+				decodeErr = &DecodeError{Row: img.Height, Err: err}
+				break
+			}
+			img.BadRows++
+			changes = ref
+		}
+
+		img.appendRow(changes)
+		ref = changes
+	}
+
+	if height > 0 && img.Height < height {
+		if img.BadRows > 0 || decodeErr != nil {
+			img.BadRows += height - img.Height
+		}
+		img.SetHeight(height)
+	} else if decodeErr != nil {
+		img.BadRows++
+	}
+
+	if decodeErr != nil {
+		decodeErr.Image = img
+		return nil, decodeErr
+	}
+	return img, nil
+}
@@ -0,0 +1,276 @@
+package ccitt
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeTables(t *testing.T) {
+	tables := map[string][]code{
+		"white": append(append([]code{}, whiteCodes...), extendedCodes...),
+		"black": append(append([]code{}, blackCodes...), extendedCodes...),
+		"mode":  modeCodes,
+	}
+	for name, table := range tables {
+		for i, a := range table {
+			assert.NotContains(t, a.bits, eol, "%s code for %d contains EOL", name, a.value)
+			for j, b := range table {
+				if i != j {
+					assert.False(t, strings.HasPrefix(b.bits, a.bits), "%s code for %d is a prefix of %d", name, a.value, b.value)
+				}
+			}
+		}
+	}
+
+	for length := 0; length < 64; length++ {
+		assert.Contains(t, whiteMap, length)
+		assert.Contains(t, blackMap, length)
+	}
+	for length := 64; length <= 2560; length += 64 {
+		assert.Contains(t, whiteMap, length)
+		assert.Contains(t, blackMap, length)
+	}
+}
+
+func TestEncodeWhiteRow(t *testing.T) {
+	img := NewImage(1728, 1)
+
+	data, err := Encode(img, Options{Format: MH})
+	assert.NoError(t, err)
+	// 010011011 (1728) 00110101 (0)
+	assert.Equal(t, []byte{0x4d, 0x9a, 0x80}, data)
+
+	data, err = Encode(img, Options{Format: G4})
+	assert.NoError(t, err)
+	// 1 (V0) followed by EOFB
+	assert.Equal(t, []byte{0x80, 0x08, 0x00, 0x80}, data)
+}
+
+// randomImage returns an image with random runs,
+// rows are often similar to the previous row as in real documents
+func randomImage(rnd *rand.Rand, width, height int) *Image {
+	img := NewImage(width, height)
+	for y := 0; y < height; y++ {
+		row := img.Row(y)
+		if y > 0 && rnd.Intn(3) > 0 {
+			copy(row, img.Row(y-1))
+			for i := rnd.Intn(4); i > 0; i-- {
+				x := rnd.Intn(width)
+				row[x/8] ^= 0x80 >> uint(x%8)
+			}
+			continue
+		}
+		for x := 0; x < width; {
+			length := rnd.Intn(300) + 1
+			if rnd.Intn(10) == 0 {
+				length = rnd.Intn(width)
+			}
+			if x+length > width {
+				length = width - x
+			}
+			if rnd.Intn(2) == 0 {
+				setBits(row, x, x+length)
+			}
+			x += length
+		}
+	}
+	return img
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	options := map[string]Options{
+		"MH":          {Format: MH},
+		"G3 1D":       {Format: G3},
+		"G3 1D fill":  {Format: G3, FillBits: true},
+		"G3 2D":       {Format: G3, TwoD: true, K: 4},
+		"G3 2D fill":  {Format: G3, TwoD: true, K: 2, FillBits: true},
+		"G3 2D K 1":   {Format: G3, TwoD: true, K: 1},
+		"G4":          {Format: G4},
+		"G4 odd size": {Format: G4},
+	}
+	for name, opts := range options {
+		width := 1728
+		if name == "G4 odd size" {
+			width = 2555
+		}
+		for i := 0; i < 5; i++ {
+			img := randomImage(rnd, width, 200)
+			data, err := Encode(img, opts)
+			assert.NoError(t, err)
+
+			opts.Width = width
+			decoded, err := Decode(data, opts, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, img.Height, decoded.Height, name)
+			assert.Equal(t, 0, decoded.BadRows, name)
+			assert.True(t, assert.ObjectsAreEqual(img.Pix, decoded.Pix), name)
+		}
+	}
+}
+
+func TestDecodeHeight(t *testing.T) {
+	img := randomImage(rand.New(rand.NewSource(2)), 1728, 50)
+	data, err := Encode(img, Options{Format: G4})
+	assert.NoError(t, err)
+
+	decoded, err := Decode(data, Options{Format: G4, Width: 1728}, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, decoded.Height)
+	assert.True(t, assert.ObjectsAreEqual(img.Pix[:20*img.Stride], decoded.Pix))
+
+	decoded, err = Decode(data, Options{Format: G4, Width: 1728}, 60)
+	assert.NoError(t, err)
+	assert.Equal(t, 60, decoded.Height)
+	assert.Equal(t, 0, decoded.BadRows)
+	assert.True(t, assert.ObjectsAreEqual(img.Pix, decoded.Pix[:50*img.Stride]))
+	assert.True(t, assert.ObjectsAreEqual(make([]byte, 10*img.Stride), decoded.Pix[50*img.Stride:]))
+}
+
+func TestDecodeDamaged(t *testing.T) {
+	img := randomImage(rand.New(rand.NewSource(3)), 1728, 100)
+	opts := Options{Format: G3, FillBits: true, Width: 1728}
+
+	data, err := Encode(img, opts)
+	assert.NoError(t, err)
+
+	// Garble the data of row 50 between its EOL codes,
+	// which end at byte boundaries as fill bits are used
+	r := bitReader{data: data}
+	for i := 0; i < 50; i++ {
+		assert.True(t, r.skipEOL())
+		assert.True(t, r.findEOL())
+	}
+	assert.True(t, r.skipEOL())
+	start := r.pos / 8
+	assert.True(t, r.findEOL())
+	end := r.pos / 8
+	assert.True(t, end-start > 2)
+	for i := start; i < end; i++ {
+		data[i] = 0x5a
+	}
+
+	decoded, err := Decode(data, opts, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Height, decoded.Height)
+	assert.Equal(t, 1, decoded.BadRows)
+
+	// The damaged row is replaced by the previous row
+	assert.True(t, assert.ObjectsAreEqual(img.Row(49), decoded.Row(50)))
+	assert.True(t, assert.ObjectsAreEqual(img.Pix[:50*img.Stride], decoded.Pix[:50*img.Stride]))
+	assert.True(t, assert.ObjectsAreEqual(img.Pix[51*img.Stride:], decoded.Pix[51*img.Stride:]))
+
+	// Decoding MH and MMR stops at the first error
+	for _, opts := range []Options{{Format: MH, Width: 1728}, {Format: G4, Width: 1728}} {
+		data, err = Encode(img, opts)
+		assert.NoError(t, err)
+		data[len(data)/2] ^= 0xff
+		decoded, err = Decode(data, opts, img.Height)
+		assert.Nil(t, decoded)
+		decodeErr, ok := err.(*DecodeError)
+		if !assert.True(t, ok, "format %d: %v", opts.Format, err) {
+			continue
+		}
+		assert.True(t, decodeErr.Row > 10 && decodeErr.Row < img.Height, "format %d: row %d", opts.Format, decodeErr.Row)
+		partial := decodeErr.Image
+		assert.Equal(t, img.Height, partial.Height)
+		assert.Equal(t, img.Height-decodeErr.Row, partial.BadRows)
+		assert.True(t, assert.ObjectsAreEqual(img.Pix[:10*img.Stride], partial.Pix[:10*img.Stride]))
+		assert.True(t, assert.ObjectsAreEqual(make([]byte, img.Stride), partial.Row(img.Height-1)))
+	}
+
+	// Truncated MMR data
+	data, err = Encode(img, Options{Format: G4})
+	assert.NoError(t, err)
+	_, err = Decode(data[:len(data)/2], Options{Format: G4, Width: 1728}, 0)
+	if decodeErr, ok := err.(*DecodeError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, errEndOfData, decodeErr.Err)
+		assert.Equal(t, decodeErr.Row, decodeErr.Image.Height)
+		assert.Equal(t, 1, decodeErr.Image.BadRows)
+	}
+
+	// G3 data can't be resynchronized if no EOL follows the damage
+	data, err = Encode(img, opts)
+	assert.NoError(t, err)
+	for i := len(data) / 2; i < len(data); i++ {
+		data[i] = 0x5a
+	}
+	_, err = Decode(data, opts, 0)
+	assert.IsType(t, &DecodeError{}, err)
+}
+
+func TestDecodeInvalidOptions(t *testing.T) {
+	_, err := Decode([]byte{0}, Options{Format: G4}, 0)
+	assert.Error(t, err)
+	_, err = Decode([]byte{0}, Options{Format: Format(42), Width: 1728}, 0)
+	assert.Error(t, err)
+}
+
+// readPNG returns a PNG file as bilevel image, dark pixels are black
+func readPNG(t *testing.T, filename string) *Image {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bounds := src.Bounds()
+	img := NewImage(bounds.Dx(), bounds.Dy())
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			if src.(*image.Gray).GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y < 0x80 {
+				img.Pix[y*img.Stride+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return img
+}
+
+// TestDecodeFixtures decodes data created by other encoders, see testdata/README
+func TestDecodeFixtures(t *testing.T) {
+	expected := readPNG(t, filepath.Join("testdata", "bw-gopher.png"))
+
+	for _, test := range []struct {
+		filename string
+		opts     Options
+	}{
+		{"bw-gopher.ccitt_group3", Options{Format: G3}},
+		{"bw-gopher.ccitt_group4", Options{Format: G4}},
+		{"bw-gopher-truncated0.ccitt_group4", Options{Format: G4}},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", test.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.opts.Width = expected.Width
+
+		for _, height := range []int{0, expected.Height} {
+			decoded, err := Decode(data, test.opts, height)
+			if !assert.NoError(t, err, test.filename) {
+				continue
+			}
+			assert.Equal(t, expected.Height, decoded.Height, test.filename)
+			assert.Equal(t, 0, decoded.BadRows, test.filename)
+			assert.True(t, assert.ObjectsAreEqual(expected.Pix, decoded.Pix), "%s differs", test.filename)
+		}
+
+		// Our encoder produces the same image
+		encoded, err := Encode(expected, test.opts)
+		assert.NoError(t, err)
+		decoded, err := Decode(encoded, test.opts, 0)
+		assert.NoError(t, err)
+		assert.True(t, assert.ObjectsAreEqual(expected.Pix, decoded.Pix), "%s: round trip differs", test.filename)
+	}
+}
@@ -0,0 +1,227 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ccitt
+
+// bitReader reads single bits, most significant bit first
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// bit returns the next bit, or 0 after the end of data
+func (r *bitReader) bit() int {
+	if r.pos >= len(r.data)*8 {
+		r.pos++
+		return 0
+	}
+	b := int(r.data[r.pos/8]>>uint(7-r.pos%8)) & 1
+	r.pos++
+	return b
+}
+
+func (r *bitReader) eof() bool {
+	return r.pos >= len(r.data)*8
+}
+
+// align skips to the next byte boundary
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) / 8 * 8
+}
+
+// zerosToEnd returns true if only zero bits (i.e. fill bits) are left
+func (r *bitReader) zerosToEnd() bool {
+	for pos := r.pos; pos < len(r.data)*8; pos++ {
+		if pos%8 == 0 && r.data[pos/8] == 0 {
+			pos += 7
+			continue
+		}
+		if r.data[pos/8]&(0x80>>uint(pos%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// eolAt returns the position after an EOL (at least 11 zero bits
+// followed by a one bit) starting at pos or -1
+func (r *bitReader) eolAt(pos int) int {
+	zeros := 0
+	for ; pos < len(r.data)*8; pos++ {
+		if r.data[pos/8]&(0x80>>uint(pos%8)) != 0 {
+			if zeros >= 11 {
+				return pos + 1
+			}
+			return -1
+		}
+		zeros++
+	}
+	return -1
+}
+
+// skipEOL skips an EOL code including leading fill bits
+// if it is found at the current position
+func (r *bitReader) skipEOL() bool {
+	if next := r.eolAt(r.pos); next >= 0 {
+		r.pos = next
+		return true
+	}
+	return false
+}
+
+// findEOL moves to the next EOL code, without skipping it
+func (r *bitReader) findEOL() bool {
+	zeros := 0
+	for pos := r.pos; pos < len(r.data)*8; pos++ {
+		if r.data[pos/8]&(0x80>>uint(pos%8)) == 0 {
+			zeros++
+			continue
+		}
+		if zeros >= 11 {
+			r.pos = pos - zeros
+			return true
+		}
+		zeros = 0
+	}
+	return false
+}
+
+// code reads a code from given table
+func (r *bitReader) code(table codeTable) (int, error) {
+	var key codeKey
+	for key.length < maxCodeLength {
+		if r.eof() {
+			return 0, errEndOfData
+		}
+		key.value = key.value<<1 | uint16(r.bit())
+		key.length++
+		if value, ok := table[key]; ok {
+			return value, nil
+		}
+	}
+	return 0, errInvalidCode
+}
+
+type decoder struct {
+	r     bitReader
+	width int
+}
+
+// run reads the make-up and terminating codes of a run of given color
+func (d *decoder) run(black bool) (int, error) {
+	table := whiteTable
+	if black {
+		table = blackTable
+	}
+
+	total := 0
+	for {
+		length, err := d.r.code(table)
+		if err != nil {
+			return 0, err
+		}
+		total += length
+		if total > d.width {
+			return 0, errRowLength
+		}
+		if length < 64 {
+			return total, nil
+		}
+	}
+}
+
+// decode1D decodes a MH coded row and returns its changing elements
+func (d *decoder) decode1D() ([]int, error) {
+	changes := []int{}
+	black := false
+	for pos := 0; pos < d.width; black = !black {
+		length, err := d.run(black)
+		if err != nil {
+			return nil, err
+		}
+		pos += length
+		if pos > d.width {
+			return nil, errRowLength
+		}
+		if pos < d.width {
+			changes = append(changes, pos)
+		}
+	}
+	return changes, nil
+}
+
+// decode2D decodes a MR/MMR coded row using the reference row ref
+// and returns its changing elements
+func (d *decoder) decode2D(ref []int) ([]int, error) {
+	changes := []int{}
+	black := false
+	a0, bi := -1, 0
+	for a0 < d.width {
+		mode, err := d.r.code(modeTable)
+		if err != nil {
+			return nil, err
+		}
+
+		var b1, b2 int
+		b1, b2, bi = referencePositions(ref, a0, black, d.width, bi)
+
+		switch mode {
+		case modePass:
+			a0 = b2
+
+		case modeHorizontal:
+			start := a0
+			if start < 0 {
+				start = 0
+			}
+			run1, err := d.run(black)
+			if err != nil {
+				return nil, err
+			}
+			run2, err := d.run(!black)
+			if err != nil {
+				return nil, err
+			}
+			a1 := start + run1
+			a2 := a1 + run2
+			if a2 > d.width {
+				return nil, errRowLength
+			}
+			for _, a := range []int{a1, a2} {
+				if a < d.width {
+					changes = append(changes, a)
+				}
+			}
+			a0 = a2
+
+		case modeExtension:
+			return nil, errExtension
+
+		default:
+			a1 := b1 + verticalOffset[mode]
+			if a1 < a0 || a1 < 0 || a1 > d.width {
+				return nil, errInvalidCode
+			}
+			if a1 < d.width {
+				changes = append(changes, a1)
+			}
+			a0 = a1
+			black = !black
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,184 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ccitt
+
+// bitWriter writes bits, most significant bit first
+type bitWriter struct {
+	data []byte
+	bits int
+}
+
+func (w *bitWriter) write(k codeKey) {
+	for i := int(k.length) - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if k.value&(1<<uint(i)) != 0 {
+			w.data[len(w.data)-1] |= 0x80 >> uint(w.bits%8)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) bit(b int) {
+	w.write(codeKey{1, uint16(b)})
+}
+
+// align pads with zero bits to the next byte boundary
+func (w *bitWriter) align() {
+	w.bits = (w.bits + 7) / 8 * 8
+}
+
+// eol writes an EOL code, preceded by fill bits
+// so that it ends at a byte boundary if fill is set
+func (w *bitWriter) eol(fill bool) {
+	if fill {
+		for (w.bits+len(eol))%8 != 0 {
+			w.write(codeKey{1, 0})
+		}
+	}
+	w.write(keyOf(eol))
+}
+
+type encoder struct {
+	w     bitWriter
+	width int
+}
+
+// run writes the make-up and terminating codes for a run of given color
+func (e *encoder) run(length int, black bool) {
+	codes := whiteMap
+	if black {
+		codes = blackMap
+	}
+	for length >= 2560 {
+		e.w.write(codes[2560])
+		length -= 2560
+	}
+	if length >= 64 {
+		e.w.write(codes[length/64*64])
+	}
+	e.w.write(codes[length%64])
+}
+
+// encode1D writes a MH coded row given by its changing elements
+func (e *encoder) encode1D(changes []int) {
+	pos := 0
+	black := false
+	for _, c := range changes {
+		e.run(c-pos, black)
+		pos = c
+		black = !black
+	}
+	e.run(e.width-pos, black)
+}
+
+// encode2D writes a MR/MMR coded row given by its changing elements
+// and the changing elements of the reference row
+func (e *encoder) encode2D(changes, ref []int) {
+	black := false
+	a0, ai, bi := -1, 0, 0
+	for a0 < e.width {
+		for ai < len(changes) && changes[ai] <= a0 {
+			ai++
+		}
+		a1 := e.width
+		if ai < len(changes) {
+			a1 = changes[ai]
+		}
+
+		var b1, b2 int
+		b1, b2, bi = referencePositions(ref, a0, black, e.width, bi)
+
+		if b2 < a1 {
+			e.w.write(modeMap[modePass])
+			a0 = b2
+			continue
+		}
+
+		if d := a1 - b1; d >= -3 && d <= 3 {
+			e.w.write(modeMap[verticalModes[d+3]])
+			a0 = a1
+			black = !black
+			continue
+		}
+
+		a2 := e.width
+		if ai+1 < len(changes) {
+			a2 = changes[ai+1]
+		}
+		start := a0
+		if start < 0 {
+			start = 0
+		}
+		e.w.write(modeMap[modeHorizontal])
+		e.run(a1-start, black)
+		e.run(a2-a1, !black)
+		a0 = a2
+	}
+}
+
+// Encode compresses an image
+func Encode(img *Image, opts Options) ([]byte, error) {
+	opts.Width = img.Width
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	e := &encoder{width: img.Width}
+	var ref []int
+	for y := 0; y < img.Height; y++ {
+		changes := img.changes(y)
+		switch opts.Format {
+		case MH:
+			e.encode1D(changes)
+			e.w.align()
+		case G3:
+			e.w.eol(opts.FillBits)
+			if !opts.TwoD {
+				e.encode1D(changes)
+			} else if opts.K <= 1 || y%opts.K == 0 {
+				e.w.bit(1)
+				e.encode1D(changes)
+			} else {
+				e.w.bit(0)
+				e.encode2D(changes, ref)
+			}
+		case G4:
+			e.encode2D(changes, ref)
+		}
+		ref = changes
+	}
+
+	switch opts.Format {
+	case G3:
+		for i := 0; i < rtcLength; i++ {
+			e.w.eol(opts.FillBits && i == 0)
+			if opts.TwoD {
+				e.w.bit(1)
+			}
+		}
+	case G4:
+		// EOFB
+		e.w.eol(false)
+		e.w.eol(false)
+	}
+	e.w.align()
+
+	return e.w.data[:e.w.bits/8], nil
+}
@@ -0,0 +1,137 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package ccitt
+
+// Image is a bilevel image. Set bits are black pixels,
+// the most significant bit of a byte is the leftmost pixel.
+type Image struct {
+	Width  int
+	Height int
+	// Bytes per row, rows start at byte boundaries
+	Stride int
+	Pix    []byte
+
+	// Number of rows that could not be decoded and were
+	// replaced by the previous row or left white
+	BadRows int
+}
+
+// NewImage returns a white image of given size
+func NewImage(width, height int) *Image {
+	stride := (width + 7) / 8
+	return &Image{
+		Width:  width,
+		Height: height,
+		Stride: stride,
+		Pix:    make([]byte, stride*height),
+	}
+}
+
+// Row returns the pixels of row y
+func (img *Image) Row(y int) []byte {
+	return img.Pix[y*img.Stride : (y+1)*img.Stride]
+}
+
+// Black returns true if the pixel at x, y is black
+func (img *Image) Black(x, y int) bool {
+	return img.Pix[y*img.Stride+x/8]&(0x80>>uint(x%8)) != 0
+}
+
+// SetHeight changes the height of the image,
+// new rows are white
+func (img *Image) SetHeight(height int) {
+	size := img.Stride * height
+	if size <= len(img.Pix) {
+		img.Pix = img.Pix[:size]
+	} else {
+		img.Pix = append(img.Pix, make([]byte, size-len(img.Pix))...)
+	}
+	img.Height = height
+}
+
+// appendRow adds a row given by its changing elements
+func (img *Image) appendRow(changes []int) {
+	img.SetHeight(img.Height + 1)
+	row := img.Row(img.Height - 1)
+	for i := 0; i < len(changes); i += 2 {
+		end := img.Width
+		if i+1 < len(changes) {
+			end = changes[i+1]
+		}
+		setBits(row, changes[i], end)
+	}
+}
+
+// setBits sets the bits from start up to (excluding) end
+func setBits(row []byte, start, end int) {
+	for x := start; x < end; {
+		if x%8 == 0 && end-x >= 8 {
+			row[x/8] = 0xff
+			x += 8
+			continue
+		}
+		row[x/8] |= 0x80 >> uint(x%8)
+		x++
+	}
+}
+
+// changes returns the changing elements of row y, i.e. the positions
+// of all pixels having a different color than their left neighbor.
+// The imaginary pixel left of the row is white.
+func (img *Image) changes(y int) []int {
+	var changes []int
+	row := img.Row(y)
+	black := false
+	for x := 0; x < img.Width; {
+		b := row[x/8]
+		if x%8 == 0 && x+8 <= img.Width && ((b == 0 && !black) || (b == 0xff && black)) {
+			x += 8
+			continue
+		}
+		if (b&(0x80>>uint(x%8)) != 0) != black {
+			changes = append(changes, x)
+			black = !black
+		}
+		x++
+	}
+	return changes
+}
+
+// referencePositions returns the changing elements b1 and b2 of the reference row
+// as defined in ITU-T T.4 for the coding element a0 of given color.
+// start is the index of the first element right of a0 known so far,
+// the updated index is returned.
+func referencePositions(ref []int, a0 int, black bool, width int, start int) (b1, b2, next int) {
+	i := start
+	for i < len(ref) && ref[i] <= a0 {
+		i++
+	}
+	next = i
+	// Changes to black are at even indices, b1 has the opposite color of a0
+	if (i%2 == 1) != black {
+		i++
+	}
+	b1, b2 = width, width
+	if i < len(ref) {
+		b1 = ref[i]
+	}
+	if i+1 < len(ref) {
+		b2 = ref[i+1]
+	}
+	return
+}
@@ -0,0 +1,213 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxlib
+
+import (
+	"strings"
+)
+
+// Class2Params holds the session parameters of a fax in the encoding
+// used by HylaFAX for the params field of xferfaxlog records
+type Class2Params struct {
+	VR uint // Vertical resolution
+	BR uint // Bit rate
+	WD uint // Page width
+	LN uint // Page length
+	DF uint // Data format
+	EC uint // Error correction
+	BF uint // Binary file transfer
+	ST uint // Scanline time
+}
+
+// Vertical resolutions
+const (
+	VRNormal = 0 // 3.85 line/mm
+	VRFine   = 1 // 7.7 line/mm
+	VRR8     = 2 // 15.4 line/mm
+)
+
+// Bit rates
+const (
+	BR2400  = 0
+	BR4800  = 1
+	BR7200  = 2
+	BR9600  = 3
+	BR12000 = 4
+	BR14400 = 5
+)
+
+// Page widths
+const (
+	WDA4 = 0 // 215 mm
+	WDB4 = 1 // 255 mm
+	WDA3 = 2 // 303 mm
+)
+
+// Page lengths
+const (
+	LNA4        = 0 // 297 mm
+	LNB4        = 1 // 364 mm
+	LNUnlimited = 2
+)
+
+// Data formats
+const (
+	DF1DMH  = 0
+	DF2DMR  = 1
+	DF2DMMR = 3
+	DFJBIG  = 4
+)
+
+// Error correction modes, SpanDSP uses 256 byte frames
+const (
+	ECDisable   = 0
+	ECEnable256 = 2
+)
+
+var (
+	vrNames = []string{"3.85 line/mm", "7.7 line/mm", "15.4 line/mm"}
+	brNames = []string{"2400 bit/s", "4800 bit/s", "7200 bit/s", "9600 bit/s", "12000 bit/s", "14400 bit/s"}
+	wdNames = []string{"A4 page width (215 mm)", "B4 page width (255 mm)", "A3 page width (303 mm)"}
+	lnNames = []string{"A4 page length (297 mm)", "B4 page length (364 mm)", "Unlimited page length"}
+	dfNames = []string{"1-D MH", "2-D MR", "2-D Uncompressed Mode", "2-D MMR", "JBIG"}
+	ecNames = []string{"no ECM", "T.30 Annex A, 64-byte ECM", "T.30 Annex A, 256-byte ECM"}
+)
+
+// NewClass2Params returns the parameters of a fax transmission.
+// Image parameters are taken from the first page, or from the
+// result if no page was transferred.
+func NewClass2Params(result *FaxResult) Class2Params {
+	p := Class2Params{BR: bitRateCode(result.TransferRate)}
+	if result.Ecm {
+		p.EC = ECEnable256
+	}
+
+	resolution, size, encoding := result.ImageResolution, result.ImagePixelSize, ""
+	if len(result.PageResults) > 0 {
+		page := result.PageResults[0]
+		resolution, size, encoding = page.ImageResolution, page.ImagePixelSize, page.EncodingName
+	}
+
+	// Resolutions are reported in pixels per meter
+	switch {
+	case resolution.Y < 5800:
+		p.VR = VRNormal
+	case resolution.Y < 11600:
+		p.VR = VRFine
+	default:
+		p.VR = VRR8
+	}
+
+	// Fall back to 8 pixels per mm if the horizontal resolution is unknown
+	xres := resolution.X
+	if xres == 0 {
+		xres = 8000
+	}
+	switch width := size.X * 1000 / xres; {
+	case width < 235:
+		p.WD = WDA4
+	case width < 280:
+		p.WD = WDB4
+	default:
+		p.WD = WDA3
+	}
+
+	if resolution.Y > 0 {
+		switch length := size.Y * 1000 / resolution.Y; {
+		case length <= 300:
+			p.LN = LNA4
+		case length <= 370:
+			p.LN = LNB4
+		default:
+			p.LN = LNUnlimited
+		}
+	}
+
+	p.DF = dataFormatCode(encoding)
+	return p
+}
+
+// bitRateCode returns the code of the highest bit rate not above baudrate
+func bitRateCode(baudrate uint) uint {
+	switch {
+	case baudrate > 12000:
+		return BR14400
+	case baudrate > 9600:
+		return BR12000
+	case baudrate > 7200:
+		return BR9600
+	case baudrate > 4800:
+		return BR7200
+	case baudrate > 2400:
+		return BR4800
+	}
+	return BR2400
+}
+
+// dataFormatCode returns the data format of a SpanDSP encoding name
+func dataFormatCode(encoding string) uint {
+	switch {
+	case strings.HasPrefix(encoding, "T.4 2-D"):
+		return DF2DMR
+	case strings.HasPrefix(encoding, "T.6"):
+		return DF2DMMR
+	case strings.HasPrefix(encoding, "T.85"):
+		return DFJBIG
+	}
+	return DF1DMH
+}
+
+// Encode returns the parameters encoded as integer like
+// Class2Params::encode() of HylaFAX. Bit 21 marks this layout,
+// HylaFAX decodes values without it using its original layout. There is a single bit for ECM, which is
+// set for any frame size. JBIG does not fit into the data format
+// field and is encoded as 1-D MH, like HylaFAX does.
+func (p Class2Params) Encode() uint {
+	var ec uint
+	if p.EC != ECDisable {
+		ec = 1
+	}
+	return (p.VR&7)<<0 |
+		(p.BR&15)<<3 |
+		(p.WD&7)<<9 |
+		(p.LN&3)<<12 |
+		(p.DF&3)<<14 |
+		ec<<16 |
+		(p.BF&1)<<17 |
+		(p.ST&7)<<18 |
+		1<<21
+}
+
+// String describes the parameters like HylaFAX
+func (p Class2Params) String() string {
+	return strings.Join([]string{
+		paramName(brNames, p.BR),
+		paramName(dfNames, p.DF),
+		paramName(vrNames, p.VR),
+		paramName(wdNames, p.WD),
+		paramName(lnNames, p.LN),
+		paramName(ecNames, p.EC),
+	}, ", ")
+}
+
+func paramName(names []string, code uint) string {
+	if int(code) < len(names) {
+		return names[code]
+	}
+	return "unknown"
+}
@@ -0,0 +1,138 @@
+package gofaxlib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The encoded values were computed by hand using the layout of
+// Class2Params::encode() in HylaFAX: VR at bit 0, BR at 3, WD at 9,
+// LN at 12, DF at 14, EC at 16, BF at 17, ST at 18 and bit 21 set.
+// They are not taken from records written by HylaFAX.
+func TestClass2Params(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		result   FaxResult
+		params   Class2Params
+		encoded  uint
+		describe string
+	}{
+		{
+			"fine A4 MMR ECM",
+			FaxResult{TransferRate: 14400, Ecm: true, PageResults: []PageResult{{
+				ImageResolution: Resolution{8031, 7700}, ImagePixelSize: Resolution{1728, 2292}, EncodingName: "T.6"}}},
+			Class2Params{VR: VRFine, BR: BR14400, WD: WDA4, LN: LNA4, DF: DF2DMMR, EC: ECEnable256},
+			0x21c029,
+			"14400 bit/s, 2-D MMR, 7.7 line/mm, A4 page width (215 mm), A4 page length (297 mm), T.30 Annex A, 256-byte ECM",
+		},
+		{
+			"normal A4 MH",
+			FaxResult{TransferRate: 9600, PageResults: []PageResult{{
+				ImageResolution: Resolution{8031, 3850}, ImagePixelSize: Resolution{1728, 1145}, EncodingName: "T.4 1-D"}}},
+			Class2Params{VR: VRNormal, BR: BR9600, WD: WDA4, LN: LNA4, DF: DF1DMH, EC: ECDisable},
+			0x200018,
+			"9600 bit/s, 1-D MH, 3.85 line/mm, A4 page width (215 mm), A4 page length (297 mm), no ECM",
+		},
+		{
+			"superfine A4 MR",
+			FaxResult{TransferRate: 7200, PageResults: []PageResult{{
+				ImageResolution: Resolution{16063, 15400}, ImagePixelSize: Resolution{3456, 4584}, EncodingName: "T.4 2-D"}}},
+			Class2Params{VR: VRR8, BR: BR7200, WD: WDA4, LN: LNA4, DF: DF2DMR},
+			0x204012,
+			"7200 bit/s, 2-D MR, 15.4 line/mm, A4 page width (215 mm), A4 page length (297 mm), no ECM",
+		},
+		{
+			"B4",
+			FaxResult{TransferRate: 12000, Ecm: true, PageResults: []PageResult{{
+				ImageResolution: Resolution{8031, 7700}, ImagePixelSize: Resolution{2048, 2800}, EncodingName: "T.85"}}},
+			Class2Params{VR: VRFine, BR: BR12000, WD: WDB4, LN: LNB4, DF: DFJBIG, EC: ECEnable256},
+			0x211221,
+			"12000 bit/s, JBIG, 7.7 line/mm, B4 page width (255 mm), B4 page length (364 mm), T.30 Annex A, 256-byte ECM",
+		},
+		{
+			"A3 unlimited length",
+			FaxResult{TransferRate: 4800, PageResults: []PageResult{{
+				ImageResolution: Resolution{8031, 7700}, ImagePixelSize: Resolution{2432, 4000}, EncodingName: "T.6"}}},
+			Class2Params{VR: VRFine, BR: BR4800, WD: WDA3, LN: LNUnlimited, DF: DF2DMMR},
+			0x20e409,
+			"4800 bit/s, 2-D MMR, 7.7 line/mm, A3 page width (303 mm), Unlimited page length, no ECM",
+		},
+		{
+			"result without pages",
+			FaxResult{TransferRate: 2400, ImageResolution: Resolution{8031, 7700}, ImagePixelSize: Resolution{1728, 2200}},
+			Class2Params{VR: VRFine, BR: BR2400},
+			0x200001,
+			"2400 bit/s, 1-D MH, 7.7 line/mm, A4 page width (215 mm), A4 page length (297 mm), no ECM",
+		},
+		{
+			"nothing known",
+			FaxResult{},
+			Class2Params{},
+			0x200000,
+			"2400 bit/s, 1-D MH, 3.85 line/mm, A4 page width (215 mm), A4 page length (297 mm), no ECM",
+		},
+	} {
+		params := NewClass2Params(&test.result)
+		assert.Equal(t, test.params, params, test.name)
+		assert.Equal(t, test.encoded, params.Encode(), test.name)
+		assert.Equal(t, test.describe, params.String(), test.name)
+	}
+}
+
+func TestEncodeParams(t *testing.T) {
+	assert.Equal(t, uint(0x200028), EncodeParams(14400, false))
+	assert.Equal(t, uint(0x210018), EncodeParams(9600, true))
+
+	// Earlier versions encoded the bit rate and ECM at the same
+	// positions, but without bit 21 marking the layout
+	for _, rate := range []uint{2400, 4800, 7200, 9600, 12000, 14400} {
+		old := bitRateCode(rate) << 3
+		assert.Equal(t, old|1<<21, EncodeParams(rate, false), "%d bit/s", rate)
+		assert.Equal(t, old|1<<16|1<<21, EncodeParams(rate, true), "%d bit/s with ECM", rate)
+	}
+}
+
+func TestClass2ParamsFields(t *testing.T) {
+	// Every field uses its own bits of the encoded value
+	for _, test := range []struct {
+		name   string
+		params Class2Params
+		mask   uint
+	}{
+		{"VR", Class2Params{VR: 7}, 0x7},
+		{"BR", Class2Params{BR: 15}, 0x78},
+		{"WD", Class2Params{WD: 7}, 0xe00},
+		{"LN", Class2Params{LN: 3}, 0x3000},
+		{"DF", Class2Params{DF: 3}, 0xc000},
+		{"EC", Class2Params{EC: ECEnable256}, 0x10000},
+		{"BF", Class2Params{BF: 1}, 0x20000},
+		{"ST", Class2Params{ST: 7}, 0x1c0000},
+	} {
+		assert.Equal(t, test.mask|1<<21, test.params.Encode(), test.name)
+	}
+
+	// JBIG does not fit into the data format field
+	assert.Equal(t, uint(1<<21), Class2Params{DF: DFJBIG}.Encode())
+}
+
+func TestTransmissionReport(t *testing.T) {
+	result := parseEvents(t, "tx-partial.txt")
+	result.StartTs = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	result.EndTs = result.StartTs.Add(83 * time.Second)
+
+	r := &XFRecord{
+		Commid:  "000000042",
+		Modem:   "freeswitch0",
+		Jobid:   17,
+		Jobtag:  "invoice",
+		Sender:  "bob@example.com",
+		Destnum: "04012345",
+		Owner:   "bob",
+		CallID:  "X-GOfax-JobID=17",
+	}
+	r.SetResult(result)
+	assert.Equal(t, "10/18/26 12:00\tSEND\t000000042\tfreeswitch0\t17\t\"invoice\"\tbob@example.com\t\"04012345\"\t\"FAX 040 123\"\t2097177\t1\t00:01:23\t00:01:23\t\"The call dropped prematurely\"\t\"\"\t\"\"\t\"X-GOfax-JobID=17\"\t\"bob\"\t\"9600 bit/s, 1-D MH, 7.7 line/mm, A4 page width (215 mm), A4 page length (297 mm), no ECM\"",
+		r.formatTransmissionReport())
+}
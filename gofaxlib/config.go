@@ -30,31 +30,128 @@ var (
 	Config config
 )
 
+// DidConfig holds settings for incoming calls to matching recipients.
+// Unset optional values fall back to the [gofaxd] defaults.
+type DidConfig struct {
+	// Recipients are matched exactly, by prefix or by regular expression.
+	// If none is given the subsection name is used as exact number.
+	Number []string
+	Prefix []string
+	Regex  string
+
+	Ident       string
+	EnableT38   *bool
+	RequestT38  *bool
+	FaxRcvdCmd  string
+	Webhook     string
+	MailTo      string
+	Answerafter *uint64
+	Reject      *bool
+	Subdir      string
+}
+
+// RetryPolicyConfig classifies failed transmissions matching
+// any of the given hangup causes, SpanDSP result codes, outcomes
+// or the result text regular expression.
+type RetryPolicyConfig struct {
+	Hangupcause []string
+	Resultcode  []int
+	Resulttext  string
+	Outcome     []string
+
+	// One of retry, fail, reformat or v17fallback
+	Action string
+	// Seconds to wait before the next attempt
+	Retrydelay uint64
+}
+
+// GatewayConfig holds settings for an outbound gateway
+type GatewayConfig struct {
+	// Relative weight for the weighted strategy (default 1)
+	Weight *uint
+	// Format of dialed numbers if a dial plan is configured
+	NumberFormat string
+	TechPrefix   string
+	// Maximum number of concurrent outbound calls (0 = unlimited)
+	MaxCalls uint
+}
+
+// GatewayPrefixConfig routes destinations starting with a
+// prefix to their own gateways
+type GatewayPrefixConfig struct {
+	Gateway  []string
+	Strategy string
+}
+
+// SendWindowConfig restricts the times destinations
+// starting with a prefix may be dialed
+type SendWindowConfig struct {
+	Prefix   []string
+	Timezone string
+	// Days of week, i.e. mon-fri,sat
+	Days string
+	// Time ranges, i.e. 08:00-18:00
+	Hours []string
+}
+
 type config struct {
 	Freeswitch struct {
-		Socket            string
-		Password          string
-		Gateway           []string
-		Ident             string
-		Header            string
-		Verbose           bool
-		SoftmodemFallback bool
+		Socket          string
+		Password        string
+		Gateway         []string
+		GatewayStrategy string
+		// Circuit breaker for failing gateways
+		GatewayMaxFailures uint
+		GatewayCooldown    uint64
+		CheckGatewayStatus bool
+		Ident              string
+		Header             string
+		Verbose            bool
+		SoftmodemFallback  bool
 	}
 	Hylafax struct {
 		Spooldir   string
 		Modems     uint
 		Xferfaxlog string
+		// Run without HylaFAX, see CreateSpool
+		Standalone bool
 	}
 	Gofaxd struct {
 		EnableT38                    bool
 		RequestT38                   bool
 		RecipientFromDiversionHeader bool
+		Recipient                    []string
 		Socket                       string
 		Answerafter                  uint64
 		Waittime                     uint64
 		FaxRcvdCmd                   string
-		DynamicConfig                string
-		AllocateInboundDevices       bool
+		// Write the reception result as JSON to stdin of FaxRcvdCmd
+		FaxRcvdJSON            bool
+		DynamicConfig          string
+		AllocateInboundDevices bool
+		DrainTimeout           uint64
+		DrainResponse          string
+		DeliveryWorkers        uint
+		DeliveryTimeout        uint64
+		DeliveryRetries        *uint
+		DeliveryBackoff        uint64
+		DeliveryDeadLetter     string
+		Webhook                string
+		WebhookSecret          string
+		// Outbound queue in standalone mode
+		RequeueDelay uint64
+	}
+	Did  map[string]*DidConfig
+	Mail struct {
+		Server       string
+		StartTLS     bool
+		Username     string
+		Password     string
+		From         string
+		Subject      string
+		BodyTemplate string
+		Attachment   string
+		Mapfile      string
 	}
 	Gofaxsend struct {
 		EnableT38            bool
@@ -67,7 +164,35 @@ type config struct {
 		CidName              string
 		FailedResponse       []string
 		FailedResponseMap    map[string]bool
+		// Concurrency limits for outbound calls
+		MaxCallsPerDestination uint
+		LimitRetryDelay        uint64
+		// Custom SIP headers ("X-Name: qfiletag")
+		SIPHeader []string
+	}
+	Gofaxapi struct {
+		Listen string
+		// Required as bearer token if set
+		Token       string
+		Workers     uint
+		MaxTries    uint
+		MaxDials    uint
+		RetryDelay  uint64
+		KeepDays    uint
+		Ghostscript string
 	}
+	Dialplan struct {
+		CountryCode         string
+		AreaCode            string
+		InternationalPrefix string
+		NationalPrefix      string
+		NumberFormat        string
+		TechPrefix          string
+	}
+	SendWindow    map[string]*SendWindowConfig
+	RetryPolicy   map[string]*RetryPolicyConfig
+	Gateway       map[string]*GatewayConfig
+	GatewayPrefix map[string]*GatewayPrefixConfig
 }
 
 // LoadConfig loads the configuration from given file path
@@ -77,6 +202,9 @@ func LoadConfig(filename string) {
 		logger.Logger.Print("Config: ", err)
 		log.Fatal("Config: ", err)
 	} else {
+		if Config.Hylafax.Standalone && Config.Hylafax.Spooldir == "" {
+			Config.Hylafax.Spooldir = DefaultStandaloneSpooldir
+		}
 		Config.Gofaxsend.FailedResponseMap = make(map[string]bool)
 		for _, i := range Config.Gofaxsend.FailedResponse {
 			Config.Gofaxsend.FailedResponseMap[i] = true
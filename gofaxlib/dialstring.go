@@ -0,0 +1,120 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxlib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var dialstringVarName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Dialstring builds FreeSWITCH originate dial strings of the form
+// {name='value',...}endpoint|endpoint. Variables are ordered by name,
+// endpoints are tried in the order they were added.
+//
+// The originate API splits its arguments at spaces and the variable
+// block at commas, both honoring single quotes and backslash escapes.
+// Values are quoted and escaped to survive both steps. Values which
+// can not be represented, like control characters or braces, are
+// rejected.
+type Dialstring struct {
+	vars      map[string]string
+	endpoints []string
+}
+
+// NewDialstring creates an empty Dialstring
+func NewDialstring() *Dialstring {
+	return &Dialstring{
+		vars: make(map[string]string),
+	}
+}
+
+// Set sets a channel variable, replacing a previous value
+func (d *Dialstring) Set(name, value string) error {
+	if !dialstringVarName.MatchString(name) {
+		return fmt.Errorf("invalid dialstring variable name %q", name)
+	}
+	if i := strings.IndexFunc(value, unrepresentable); i >= 0 {
+		return fmt.Errorf("dialstring variable %s: invalid character %q", name, value[i])
+	}
+	d.vars[name] = value
+	return nil
+}
+
+// Get returns the value of a channel variable
+func (d *Dialstring) Get(name string) (string, bool) {
+	value, ok := d.vars[name]
+	return value, ok
+}
+
+// AddEndpoint adds an endpoint like sofia/gateway/name/number
+func (d *Dialstring) AddEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("empty dialstring endpoint")
+	}
+	if i := strings.IndexFunc(endpoint, func(r rune) bool {
+		return unrepresentable(r) || strings.ContainsRune(" ,|'\"\\[]<>", r)
+	}); i >= 0 {
+		return fmt.Errorf("dialstring endpoint %q: invalid character %q", endpoint, endpoint[i])
+	}
+	d.endpoints = append(d.endpoints, endpoint)
+	return nil
+}
+
+// String returns the dial string
+func (d *Dialstring) String() string {
+	names := make([]string, 0, len(d.vars))
+	for name := range d.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString("='")
+		b.WriteString(dialstringEscaper.Replace(d.vars[name]))
+		b.WriteByte('\'')
+	}
+	b.WriteByte('}')
+	b.WriteString(strings.Join(d.endpoints, "|"))
+	return b.String()
+}
+
+// Escape sequences are resolved once when splitting arguments and
+// once when splitting the variable block. Commas are kept as is by
+// the first step.
+var dialstringEscaper = strings.NewReplacer(
+	`\`, `\\\\`,
+	`'`, `\\\'`,
+	`,`, `\,`,
+)
+
+// unrepresentable reports if r can not be part of a dial string.
+// Line breaks end the event socket command and braces are not
+// quoted when looking for the end of the variable block.
+func unrepresentable(r rune) bool {
+	return r < 0x20 || r == 0x7f || r == '{' || r == '}'
+}
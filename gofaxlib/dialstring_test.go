@@ -0,0 +1,96 @@
+package gofaxlib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialstringEscaping(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"", `{v=''}`},
+		{"GOfax.IP", `{v='GOfax.IP'}`},
+		{"Example Inc", `{v='Example Inc'}`},
+		{"Doe, John", `{v='Doe\, John'}`},
+		{"O'Brien", `{v='O\\\'Brien'}`},
+		{`C:\fax`, `{v='C:\\\\fax'}`},
+		{`\n`, `{v='\\\\n'}`},
+		{"+49 (40) 123-45", `{v='+49 (40) 123-45'}`},
+		{"Müller & Söhne", `{v='Müller & Söhne'}`},
+		{"[a]|<b>", `{v='[a]|<b>'}`},
+	} {
+		d := NewDialstring()
+		assert.NoError(t, d.Set("v", test.value), test.value)
+		assert.Equal(t, test.expected, d.String(), test.value)
+	}
+}
+
+func TestDialstringInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{"", "x", `invalid dialstring variable name ""`},
+		{"a b", "x", `invalid dialstring variable name "a b"`},
+		{"a=b", "x", `invalid dialstring variable name "a=b"`},
+		{"a,b", "x", `invalid dialstring variable name "a,b"`},
+		{"v", "line\nbreak", `dialstring variable v: invalid character '\n'`},
+		{"v", "cr\r", `dialstring variable v: invalid character '\r'`},
+		{"v", "nul\x00", `dialstring variable v: invalid character '\x00'`},
+		{"v", "tab\t", `dialstring variable v: invalid character '\t'`},
+		{"v", "{x}", `dialstring variable v: invalid character '{'`},
+		{"v", "x}", `dialstring variable v: invalid character '}'`},
+	} {
+		d := NewDialstring()
+		assert.EqualError(t, d.Set(test.name, test.value), test.err)
+		assert.Equal(t, "{}", d.String())
+	}
+
+	for _, test := range []struct {
+		endpoint string
+		err      string
+	}{
+		{"", `empty dialstring endpoint`},
+		{"sofia/gateway/gw/0401 23", `dialstring endpoint "sofia/gateway/gw/0401 23": invalid character ' '`},
+		{"sofia/gateway/gw/1,2", `dialstring endpoint "sofia/gateway/gw/1,2": invalid character ','`},
+		{"sofia/gateway/gw/1|2", `dialstring endpoint "sofia/gateway/gw/1|2": invalid character '|'`},
+		{"sofia/gateway/gw/'1", `dialstring endpoint "sofia/gateway/gw/'1": invalid character '\''`},
+		{"sofia/gateway/gw/1\n", `dialstring endpoint "sofia/gateway/gw/1\n": invalid character '\n'`},
+		{"sofia/gateway/{gw}/1", `dialstring endpoint "sofia/gateway/{gw}/1": invalid character '{'`},
+	} {
+		d := NewDialstring()
+		assert.EqualError(t, d.AddEndpoint(test.endpoint), test.err)
+	}
+}
+
+func TestDialstring(t *testing.T) {
+	d := NewDialstring()
+	assert.NoError(t, d.Set("origination_uuid", "0a1b"))
+	assert.NoError(t, d.Set("fax_ident", "+49 40 123"))
+	assert.NoError(t, d.Set("sip_h_X-GOfax-JobID", "42"))
+	assert.NoError(t, d.Set("fax_use_ecm", "true"))
+	assert.NoError(t, d.AddEndpoint("sofia/gateway/b/04012345"))
+	assert.NoError(t, d.AddEndpoint("sofia/gateway/a/+494012345"))
+
+	// Variables are sorted, endpoints keep their order
+	expected := `{fax_ident='+49 40 123',fax_use_ecm='true',origination_uuid='0a1b',sip_h_X-GOfax-JobID='42'}sofia/gateway/b/04012345|sofia/gateway/a/+494012345`
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, d.String())
+	}
+
+	// Overriding a variable replaces it in place
+	assert.NoError(t, d.Set("fax_use_ecm", "false"))
+	value, ok := d.Get("fax_use_ecm")
+	assert.True(t, ok)
+	assert.Equal(t, "false", value)
+	assert.Contains(t, d.String(), `,fax_use_ecm='false',`)
+
+	// Invalid values don't replace valid ones
+	assert.Error(t, d.Set("fax_ident", "a\nb"))
+	value, _ = d.Get("fax_ident")
+	assert.Equal(t, "+49 40 123", value)
+}
@@ -56,6 +56,30 @@ func (h *HylaConfig) GetString(tag string) string {
 	return ""
 }
 
+// GetAll returns all Values found matching given Tag
+func (h *HylaConfig) GetAll(tag string) []string {
+	tag = strings.ToLower(tag)
+	var values []string
+	for _, param := range h.params {
+		if param.Tag == tag {
+			values = append(values, param.Value)
+		}
+	}
+	return values
+}
+
+// Set replaces the values of given Tag
+func (h *HylaConfig) Set(tag string, value string) {
+	tag = strings.ToLower(tag)
+	params := h.params[:0]
+	for _, param := range h.params {
+		if param.Tag != tag {
+			params = append(params, param)
+		}
+	}
+	h.params = append(params, param{tag, value})
+}
+
 // DynamicConfig executes the given command and parses the output compatible to HylaFAX' DynamicConfig
 func DynamicConfig(command string, args ...string) (*HylaConfig, error) {
 
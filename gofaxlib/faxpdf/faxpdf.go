@@ -0,0 +1,193 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+// Package faxpdf converts facsimile TIFF files to PDF
+package faxpdf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gonicus/gofaxip/gofaxlib/ccitt"
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
+)
+
+// The catalog and page tree objects have fixed IDs,
+// all other objects are numbered in the order they are written
+const (
+	catalogID = 1
+	pagesID   = 2
+)
+
+// pdfWriter writes PDF objects and keeps track of their offsets for the xref table
+type pdfWriter struct {
+	w       *bufio.Writer
+	offset  int64
+	offsets map[int]int64
+	nextID  int
+	err     error
+}
+
+func newPdfWriter(w io.Writer) *pdfWriter {
+	p := &pdfWriter{
+		w:       bufio.NewWriter(w),
+		offsets: make(map[int]int64),
+		nextID:  pagesID + 1,
+	}
+	// Binary comment marks the file as binary for transfer programs
+	p.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	return p
+}
+
+func (p *pdfWriter) printf(format string, v ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, v...)
+	p.offset += int64(n)
+	p.err = err
+}
+
+func (p *pdfWriter) write(data []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	p.err = err
+}
+
+// newID allocates a new object ID
+func (p *pdfWriter) newID() int {
+	id := p.nextID
+	p.nextID++
+	return id
+}
+
+// object writes an object with given ID and dictionary
+func (p *pdfWriter) object(id int, dict string) {
+	p.offsets[id] = p.offset
+	p.printf("%d 0 obj\n%s\nendobj\n", id, dict)
+}
+
+// stream writes a stream object with given ID, dictionary entries and data
+func (p *pdfWriter) stream(id int, dict string, data []byte) {
+	p.offsets[id] = p.offset
+	p.printf("%d 0 obj\n<< %s /Length %d >>\nstream\n", id, dict, len(data))
+	p.write(data)
+	p.printf("\nendstream\nendobj\n")
+}
+
+// finish writes the xref table and trailer
+func (p *pdfWriter) finish() error {
+	xref := p.offset
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", p.nextID)
+	for id := 1; id < p.nextID; id++ {
+		p.printf("%010d 00000 n \n", p.offsets[id])
+	}
+	p.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", p.nextID, catalogID, xref)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// Convert writes all pages of a facsimile TIFF file as PDF to w.
+// Pages are scaled according to their resolution, so fine and superfine
+// pages have the same size as normal resolution pages.
+func Convert(w io.Writer, f *tiff.File) error {
+	p := newPdfWriter(w)
+
+	var kids []int
+	for i, ifd := range f.IFDs {
+		id, err := writePage(p, f, ifd)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", i+1, err)
+		}
+		kids = append(kids, id)
+	}
+
+	kidRefs := ""
+	for _, id := range kids {
+		kidRefs += fmt.Sprintf("%d 0 R ", id)
+	}
+	p.object(pagesID, fmt.Sprintf("<< /Type /Pages /Kids [ %s] /Count %d >>", kidRefs, len(kids)))
+	p.object(catalogID, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesID))
+
+	return p.finish()
+}
+
+// ConvertFile converts the TIFF file infile to the PDF file outfile
+func ConvertFile(infile, outfile string) error {
+	f, err := tiff.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+
+	if err = Convert(out, f); err != nil {
+		out.Close()
+		os.Remove(outfile)
+		return err
+	}
+
+	return out.Close()
+}
+
+// writePage writes a page object including its content and image
+// and returns the ID of the page object
+func writePage(p *pdfWriter, f *tiff.File, ifd *tiff.IFD) (int, error) {
+	img, err := f.Image(ifd)
+	if err != nil {
+		return 0, err
+	}
+
+	// Page size in points (1/72 inch)
+	xres, yres := ifd.Resolution()
+	if xres <= 0 || yres <= 0 {
+		return 0, fmt.Errorf("invalid resolution %vx%v", xres, yres)
+	}
+	pageWidth := float64(img.Width) * 72 / xres
+	pageHeight := float64(img.Height) * 72 / yres
+
+	// The image is recompressed as damaged or unusually coded
+	// input data is not handled well by all PDF viewers
+	data, err := ccitt.Encode(img, ccitt.Options{Format: ccitt.G4})
+	if err != nil {
+		return 0, err
+	}
+
+	imageID := p.newID()
+	p.stream(imageID, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 1 "+
+		"/Filter /CCITTFaxDecode /DecodeParms << /K -1 /Columns %d /Rows %d >>", img.Width, img.Height, img.Width, img.Height), data)
+
+	contentID := p.newID()
+	p.stream(contentID, "", []byte(fmt.Sprintf("q %.4f 0 0 %.4f 0 0 cm /Im0 Do Q\n", pageWidth, pageHeight)))
+
+	pageID := p.newID()
+	p.object(pageID, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.4f %.4f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		pagesID, pageWidth, pageHeight, imageID, contentID))
+
+	return pageID, p.err
+}
@@ -0,0 +1,203 @@
+package faxpdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib/ccitt"
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPage struct {
+	img         *ccitt.Image
+	compression uint32
+	t4Options   uint32
+	yres        uint32
+	fillOrder   uint32
+}
+
+// testImage returns an image with a black frame and some diagonal lines
+func testImage(width, height int) *ccitt.Image {
+	img := ccitt.NewImage(width, height)
+	set := func(x, y int) {
+		img.Pix[y*img.Stride+x/8] |= 0x80 >> uint(x%8)
+	}
+	for x := 0; x < width; x++ {
+		set(x, 0)
+		set(x, height-1)
+	}
+	for y := 0; y < height; y++ {
+		set(0, y)
+		set(width-1, y)
+		for i := 0; i < 8; i++ {
+			set((y*3+i*200)%width, y)
+		}
+	}
+	return img
+}
+
+// writeTIFF writes a little endian TIFF file with one strip per page
+func writeTIFF(pages []testPage) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8))
+
+	for i, page := range pages {
+		var data []byte
+		switch page.compression {
+		case tiff.CompressionNone:
+			data = page.img.Pix
+		case tiff.CompressionCCITTRLE:
+			data, _ = ccitt.Encode(page.img, ccitt.Options{Format: ccitt.MH})
+		case tiff.CompressionCCITTT4:
+			data, _ = ccitt.Encode(page.img, ccitt.Options{
+				Format:   ccitt.G3,
+				TwoD:     page.t4Options&tiff.T4Option2D != 0,
+				FillBits: page.t4Options&tiff.T4OptionFillBits != 0,
+				K:        4,
+			})
+		case tiff.CompressionCCITTT6:
+			data, _ = ccitt.Encode(page.img, ccitt.Options{Format: ccitt.G4})
+		}
+		if page.fillOrder == tiff.FillOrderLSB2MSB {
+			data = append([]byte(nil), data...)
+			for j := range data {
+				data[j] = bits.Reverse8(data[j])
+			}
+		}
+
+		type entry struct {
+			tag, typ uint16
+			value    uint32
+		}
+		entries := []entry{
+			{tiff.TagImageWidth, tiff.TypeLong, uint32(page.img.Width)},
+			{tiff.TagImageLength, tiff.TypeLong, uint32(page.img.Height)},
+			{tiff.TagBitsPerSample, tiff.TypeShort, 1},
+			{tiff.TagCompression, tiff.TypeShort, page.compression},
+			{tiff.TagPhotometric, tiff.TypeShort, tiff.PhotometricMinIsWhite},
+			{tiff.TagFillOrder, tiff.TypeShort, page.fillOrder},
+			{tiff.TagStripOffsets, tiff.TypeLong, 0},
+			{tiff.TagRowsPerStrip, tiff.TypeLong, uint32(page.img.Height)},
+			{tiff.TagStripByteCounts, tiff.TypeLong, uint32(len(data))},
+			{tiff.TagXResolution, tiff.TypeRational, 0},
+			{tiff.TagYResolution, tiff.TypeRational, 0},
+			{tiff.TagT4Options, tiff.TypeLong, page.t4Options},
+			{tiff.TagResolutionUnit, tiff.TypeShort, tiff.ResolutionUnitInch},
+		}
+
+		ifdSize := 2 + 12*len(entries) + 4
+		resOffset := uint32(buf.Len() + ifdSize)
+		dataOffset := resOffset + 16
+		next := uint32(0)
+		if i < len(pages)-1 {
+			next = dataOffset + uint32(len(data))
+			next += next % 2
+		}
+
+		binary.Write(&buf, le, uint16(len(entries)))
+		for _, e := range entries {
+			value := e.value
+			switch e.tag {
+			case tiff.TagStripOffsets:
+				value = dataOffset
+			case tiff.TagXResolution:
+				value = resOffset
+			case tiff.TagYResolution:
+				value = resOffset + 8
+			}
+			binary.Write(&buf, le, e.tag)
+			binary.Write(&buf, le, e.typ)
+			binary.Write(&buf, le, uint32(1))
+			binary.Write(&buf, le, value)
+		}
+		binary.Write(&buf, le, next)
+		for _, v := range []uint32{204, 1, page.yres, 1} {
+			binary.Write(&buf, le, v)
+		}
+		buf.Write(data)
+		if buf.Len()%2 == 1 && next != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+var (
+	mediaBoxRegexp = regexp.MustCompile(`/MediaBox \[0 0 ([0-9.]+) ([0-9.]+)\]`)
+	imageRegexp    = regexp.MustCompile(`(?s)/Width (\d+) /Height (\d+) .*?/Length (\d+) >>\nstream\n`)
+)
+
+func TestConvert(t *testing.T) {
+	pages := []testPage{
+		{testImage(1728, 1100), tiff.CompressionCCITTT4, tiff.T4OptionFillBits, 98, tiff.FillOrderLSB2MSB},
+		{testImage(1728, 2200), tiff.CompressionCCITTT4, tiff.T4Option2D, 196, tiff.FillOrderMSB2LSB},
+		{testImage(1728, 4400), tiff.CompressionCCITTT6, 0, 391, tiff.FillOrderMSB2LSB},
+		{testImage(1728, 1100), tiff.CompressionCCITTRLE, 0, 98, tiff.FillOrderMSB2LSB},
+		{testImage(1728, 1100), tiff.CompressionNone, 0, 98, tiff.FillOrderMSB2LSB},
+	}
+
+	f, err := tiff.Decode(bytes.NewReader(writeTIFF(pages)))
+	assert.NoError(t, err)
+	assert.Len(t, f.IFDs, len(pages))
+
+	var out bytes.Buffer
+	assert.NoError(t, Convert(&out, f))
+	pdf := out.Bytes()
+
+	assert.True(t, bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")))
+	assert.Contains(t, string(pdf), fmt.Sprintf("/Count %d", len(pages)))
+
+	// Pages are scaled according to their resolution
+	boxes := mediaBoxRegexp.FindAllStringSubmatch(string(pdf), -1)
+	assert.Len(t, boxes, len(pages))
+	for i, box := range boxes {
+		assert.Equal(t, "609.8824", box[1])
+		assert.Equal(t, []string{"808.1633", "808.1633", "810.2302", "808.1633", "808.1633"}[i], box[2])
+	}
+
+	// The embedded images are identical to the pages
+	images := imageRegexp.FindAllSubmatchIndex(pdf, -1)
+	assert.Len(t, images, len(pages))
+	for i, m := range images {
+		width, _ := strconv.Atoi(string(pdf[m[2]:m[3]]))
+		height, _ := strconv.Atoi(string(pdf[m[4]:m[5]]))
+		length, _ := strconv.Atoi(string(pdf[m[6]:m[7]]))
+		data := pdf[m[1] : m[1]+length]
+
+		img, err := ccitt.Decode(data, ccitt.Options{Format: ccitt.G4, Width: width}, height)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, img.BadRows, "page %d", i+1)
+		assert.True(t, bytes.Equal(pages[i].img.Pix, img.Pix), "page %d", i+1)
+	}
+
+	// The xref table points to all objects
+	xref := bytes.LastIndex(pdf, []byte("\nxref\n"))
+	assert.True(t, xref > 0)
+	entries := regexp.MustCompile(`(\d{10}) 00000 n`).FindAllSubmatch(pdf[xref:], -1)
+	assert.NotEmpty(t, entries)
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		assert.True(t, bytes.HasPrefix(pdf[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))))
+	}
+}
+
+func TestConvertInvalid(t *testing.T) {
+	pages := []testPage{{testImage(1728, 100), 42, 0, 98, tiff.FillOrderMSB2LSB}}
+	f, err := tiff.Decode(bytes.NewReader(writeTIFF(pages)))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.Error(t, Convert(&out, f))
+
+	_, err = tiff.Decode(bytes.NewReader([]byte("%PDF-1.4")))
+	assert.Error(t, err)
+}
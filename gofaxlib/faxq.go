@@ -69,7 +69,11 @@ func (f *faxqfifo) messageLoop() {
 	}
 }
 
+// Send sends a message to faxq. Messages are discarded in standalone mode.
 func (f *faxqfifo) Send(msg string) error {
+	if Config.Hylafax.Standalone {
+		return nil
+	}
 	logger.Logger.Printf("Sending message to %s: %s", f.getFilename(), msg)
 	m := message{
 		msg: msg,
@@ -63,12 +63,14 @@ type PageResult struct {
 	Page             uint
 	BadRows          uint
 	LongestBadRowRun uint
+	Encoding         int
 	EncodingName     string
-	ImagePixelSize   Resolution
-	FilePixelSize    Resolution
-	ImageResolution  Resolution
-	FileResolution   Resolution
-	ImageSize        uint
+	// Width and length in pixels
+	ImagePixelSize  Resolution
+	FilePixelSize   Resolution
+	ImageResolution Resolution
+	FileResolution  Resolution
+	ImageSize       uint
 }
 
 func (p PageResult) String() string {
@@ -89,12 +91,28 @@ type FaxResult struct {
 	TotalPages       uint
 	TransferredPages uint
 	Ecm              bool
+	T38Status        string
+	LocalID          string
 	RemoteID         string
+	RemoteCountry    string
+	RemoteVendor     string
+	RemoteModel      string
 	ResultCode       int // SpanDSP, not HylaFAX!
 	ResultText       string
 	Success          bool
+	Outcome          Outcome
 	TransferRate     uint
-	NegotiateCount   uint
+	// Modem inferred from TransferRate, as mod_spandsp does not report it.
+	// V.17 also supports 9600 and 7200 bit/s, which are reported as V.29.
+	Modem          string
+	NegotiateCount uint
+
+	// Last page as reported with the result
+	ImageResolution Resolution
+	// Width and length in pixels
+	ImagePixelSize Resolution
+	ImageSize      uint
+	BadRows        uint
 
 	PageResults []PageResult
 }
@@ -130,14 +148,11 @@ func (f *FaxResult) AddEvent(ev *eventsocket.Event) {
 		case "spandsp::rxfaxnegociateresult",
 			"spandsp::txfaxnegociateresult":
 			f.NegotiateCount++
-			if ecm := ev.Get("Fax-Ecm-Used"); ecm == "on" {
-				f.Ecm = true
-			}
-			f.RemoteID = ev.Get("Fax-Remote-Station-Id")
-			if rate, err := strconv.Atoi(ev.Get("Fax-Transfer-Rate")); err == nil {
-				f.TransferRate = uint(rate)
+			f.addStationInfo(ev)
+			f.sessionlog.Logf("Remote ID: \"%v\", Transfer Rate: %v (%v), ECM=%v, T.38: %v", f.RemoteID, f.TransferRate, f.Modem, f.Ecm, f.T38Status)
+			if f.RemoteVendor != "" || f.RemoteModel != "" {
+				f.sessionlog.Logf("Remote fax machine: %v %v (%v)", f.RemoteVendor, f.RemoteModel, f.RemoteCountry)
 			}
-			f.sessionlog.Logf("Remote ID: \"%v\", Transfer Rate: %v, ECM=%v", f.RemoteID, f.TransferRate, f.Ecm)
 
 		case "spandsp::rxfaxpageresult":
 			action = "received"
@@ -150,6 +165,9 @@ func (f *FaxResult) AddEvent(ev *eventsocket.Event) {
 			if pages, err := strconv.Atoi(ev.Get("Fax-Document-Transferred-Pages")); err == nil {
 				f.TransferredPages = uint(pages)
 			}
+			if totalpages, err := strconv.Atoi(ev.Get("Fax-Document-Total-Pages")); err == nil {
+				f.TotalPages = uint(totalpages)
+			}
 
 			pr := new(PageResult)
 			pr.Page = f.TransferredPages
@@ -157,6 +175,9 @@ func (f *FaxResult) AddEvent(ev *eventsocket.Event) {
 			if badrows, err := strconv.Atoi(ev.Get("Fax-Bad-Rows")); err == nil {
 				pr.BadRows = uint(badrows)
 			}
+			if encoding, err := strconv.Atoi(ev.Get("Fax-Encoding")); err == nil {
+				pr.Encoding = encoding
+			}
 			pr.EncodingName = ev.Get("Fax-Encoding-Name")
 			if imgsize, err := parseResolution(ev.Get("Fax-Image-Pixel-Size")); err == nil {
 				pr.ImagePixelSize = *imgsize
@@ -188,10 +209,19 @@ func (f *FaxResult) AddEvent(ev *eventsocket.Event) {
 			if transferredpages, err := strconv.Atoi(ev.Get("Fax-Document-Transferred-Pages")); err == nil {
 				f.TransferredPages = uint(transferredpages)
 			}
-			if ecm := ev.Get("Fax-Ecm-Used"); ecm == "on" {
-				f.Ecm = true
+			f.addStationInfo(ev)
+			if imgres, err := parseResolution(ev.Get("Fax-Image-Resolution")); err == nil {
+				f.ImageResolution = *imgres
+			}
+			if imgsize, err := parseResolution(ev.Get("Fax-Image-Pixel-Size")); err == nil {
+				f.ImagePixelSize = *imgsize
+			}
+			if size, err := strconv.Atoi(ev.Get("Fax-Image-Size")); err == nil {
+				f.ImageSize = uint(size)
+			}
+			if badrows, err := strconv.Atoi(ev.Get("Fax-Bad-Rows")); err == nil {
+				f.BadRows = uint(badrows)
 			}
-			f.RemoteID = ev.Get("Fax-Remote-Station-Id")
 			if resultcode, err := strconv.Atoi(ev.Get("Fax-Result-Code")); err == nil {
 				f.ResultCode = resultcode
 			}
@@ -199,11 +229,47 @@ func (f *FaxResult) AddEvent(ev *eventsocket.Event) {
 			if ev.Get("Fax-Success") == "1" {
 				f.Success = true
 			}
-			if rate, err := strconv.Atoi(ev.Get("Fax-Transfer-Rate")); err == nil {
-				f.TransferRate = uint(rate)
-			}
 
 		}
 	}
 
+	f.Outcome = classifyOutcome(f)
+}
+
+// addStationInfo sets the negotiated parameters reported in
+// negotiation and result events. Empty values are ignored as
+// the result of an aborted call may not contain them.
+func (f *FaxResult) addStationInfo(ev *eventsocket.Event) {
+	if ecm := ev.Get("Fax-Ecm-Used"); ecm == "on" {
+		f.Ecm = true
+	}
+	if rate, err := strconv.Atoi(ev.Get("Fax-Transfer-Rate")); err == nil && rate > 0 {
+		f.TransferRate = uint(rate)
+		f.Modem = modemName(f.TransferRate)
+	}
+	for header, field := range map[string]*string{
+		"Fax-T38-Status":        &f.T38Status,
+		"Fax-Local-Station-Id":  &f.LocalID,
+		"Fax-Remote-Station-Id": &f.RemoteID,
+		"Fax-Remote-Country":    &f.RemoteCountry,
+		"Fax-Remote-Vendor":     &f.RemoteVendor,
+		"Fax-Remote-Model":      &f.RemoteModel,
+	} {
+		if value := ev.Get(header); value != "" {
+			*field = value
+		}
+	}
+}
+
+// modemName returns the modem used for a transfer rate
+func modemName(rate uint) string {
+	switch rate {
+	case 14400, 12000:
+		return "V.17"
+	case 9600, 7200:
+		return "V.29"
+	case 4800, 2400:
+		return "V.27ter"
+	}
+	return ""
 }
@@ -0,0 +1,160 @@
+package gofaxlib
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiorix/go-eventsocket/eventsocket"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type nullLog struct{}
+
+func (nullLog) CommSeq() uint64                      { return 0 }
+func (nullLog) CommID() string                       { return "" }
+func (nullLog) Logfile() string                      { return "" }
+func (nullLog) Log(v ...interface{})                 {}
+func (nullLog) Logf(format string, v ...interface{}) {}
+
+// readEvents reads events in the format of "event plain". The fixtures are
+// synthesized from the headers mod_spandsp sends, they are not captures of
+// real calls.
+func readEvents(t *testing.T, name string) []*eventsocket.Event {
+	f, err := os.Open(filepath.Join("testdata", "events", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []*eventsocket.Event
+	r := textproto.NewReader(bufio.NewReader(f))
+	for {
+		hdr, err := r.ReadMIMEHeader()
+		if len(hdr) > 0 {
+			ev := &eventsocket.Event{Header: make(eventsocket.EventHeader)}
+			for k, v := range hdr {
+				if ev.Header[k], err = url.QueryUnescape(v[0]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			events = append(events, ev)
+		}
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func parseEvents(t *testing.T, name string) *FaxResult {
+	result := NewFaxResult(uuid.New(), nullLog{})
+	for _, ev := range readEvents(t, name) {
+		result.AddEvent(ev)
+	}
+	return result
+}
+
+func TestFaxResultSuccess(t *testing.T) {
+	assert := assert.New(t)
+	result := parseEvents(t, "rx-success.txt")
+
+	assert.True(result.Success)
+	assert.Equal(OutcomeSuccess, result.Outcome)
+	assert.Equal("NORMAL_CLEARING", result.Hangupcause)
+	assert.Equal(0, result.ResultCode)
+	assert.Equal("OK", result.ResultText)
+	assert.Equal(uint(2), result.TotalPages)
+	assert.Equal(uint(2), result.TransferredPages)
+	assert.Equal(uint(1), result.NegotiateCount)
+	assert.True(result.Ecm)
+	assert.Equal("negotiated", result.T38Status)
+	assert.Equal("+49 30 100", result.LocalID)
+	assert.Equal("+49 40 123", result.RemoteID)
+	assert.Equal("Germany", result.RemoteCountry)
+	assert.Equal("Brother", result.RemoteVendor)
+	assert.Equal("MFC-L2700", result.RemoteModel)
+	assert.Equal(uint(14400), result.TransferRate)
+	assert.Equal("V.17", result.Modem)
+	assert.Equal(Resolution{8031, 3850}, result.ImageResolution)
+	assert.Equal(Resolution{1728, 1146}, result.ImagePixelSize)
+	assert.Equal(uint(9216), result.ImageSize)
+	assert.Equal(uint(3), result.BadRows)
+	assert.False(result.StartTs.IsZero())
+	assert.False(result.EndTs.Before(result.StartTs))
+
+	if assert.Len(result.PageResults, 2) {
+		assert.Equal(PageResult{
+			Ts:               result.PageResults[1].Ts,
+			Page:             2,
+			BadRows:          3,
+			LongestBadRowRun: 2,
+			Encoding:         3,
+			EncodingName:     "T.4 2-D",
+			ImagePixelSize:   Resolution{1728, 1146},
+			FilePixelSize:    Resolution{1728, 1146},
+			ImageResolution:  Resolution{8031, 3850},
+			FileResolution:   Resolution{8031, 3850},
+			ImageSize:        9216,
+		}, result.PageResults[1])
+		assert.Equal(uint(1), result.PageResults[0].Page)
+		assert.Equal("T.6", result.PageResults[0].EncodingName)
+	}
+}
+
+func TestFaxResultOutcome(t *testing.T) {
+	for _, test := range []struct {
+		file    string
+		outcome Outcome
+		code    int
+		pages   uint
+		total   uint
+		rate    uint
+		modem   string
+	}{
+		{"rx-success.txt", OutcomeSuccess, 0, 2, 2, 14400, "V.17"},
+		{"tx-partial.txt", OutcomePartial, 49, 1, 3, 9600, "V.29"},
+		{"tx-negotiation-failure.txt", OutcomeNegotiationFailure, 6, 0, 3, 0, ""},
+		{"rx-line-error.txt", OutcomeLineError, 26, 0, 0, 4800, "V.27ter"},
+		{"tx-local-error.txt", OutcomeLocalError, 41, 0, 0, 0, ""},
+		{"tx-busy.txt", OutcomeRemoteHangup, 0, 0, 0, 0, ""},
+	} {
+		result := parseEvents(t, test.file)
+		assert.Equal(t, test.outcome, result.Outcome, test.file)
+		assert.Equal(t, test.outcome == OutcomeSuccess, result.Success, test.file)
+		assert.Equal(t, test.code, result.ResultCode, test.file)
+		assert.Equal(t, test.pages, result.TransferredPages, test.file)
+		assert.Equal(t, test.total, result.TotalPages, test.file)
+		assert.Equal(t, test.rate, result.TransferRate, test.file)
+		assert.Equal(t, test.modem, result.Modem, test.file)
+	}
+}
+
+func TestClassifyOutcome(t *testing.T) {
+	for _, test := range []struct {
+		result  FaxResult
+		outcome Outcome
+	}{
+		{FaxResult{Success: true, TransferredPages: 1}, OutcomeSuccess},
+		{FaxResult{ResultCode: 49, TransferredPages: 2}, OutcomePartial},
+		{FaxResult{ResultCode: 28}, OutcomeNegotiationFailure},
+		{FaxResult{ResultCode: 55}, OutcomeNegotiationFailure},
+		{FaxResult{ResultCode: 17}, OutcomeRemoteHangup},
+		{FaxResult{ResultCode: 48}, OutcomeRemoteHangup},
+		{FaxResult{ResultCode: 33}, OutcomeLineError},
+		{FaxResult{ResultCode: 999}, OutcomeLineError},
+		{FaxResult{ResultCode: 47}, OutcomeLocalError},
+		{FaxResult{NegotiateCount: 1}, OutcomeRemoteHangup},
+		{FaxResult{Hangupcause: "NO_ANSWER"}, OutcomeRemoteHangup},
+		{FaxResult{}, OutcomeLocalError},
+	} {
+		assert.Equal(t, test.outcome, classifyOutcome(&test.result), "%+v", test.result)
+	}
+}
@@ -18,7 +18,8 @@
 package gofaxlib
 
 import (
-	"io/ioutil"
+	"bufio"
+	"bytes"
 	"os"
 	"strings"
 )
@@ -62,18 +63,29 @@ func (f *fifo) loop() {
 			return
 		}
 
-		// BUG(markus): split at null or \n
-		// until EOF
-		msg, err := ioutil.ReadAll(fifofile)
+		// Writers may send multiple messages before closing the FIFO
+		scanner := bufio.NewScanner(fifofile)
+		scanner.Split(splitMessages)
+		for scanner.Scan() {
+			if msg := strings.TrimSpace(scanner.Text()); msg != "" {
+				f.messages <- msg
+			}
+		}
 		fifofile.Close()
-		if err != nil {
+		if err = scanner.Err(); err != nil {
 			f.errors <- err
 			return
 		}
-		msgstr := strings.TrimSpace(string(msg))
-		if msgstr != "" {
-			f.messages <- msgstr
-		}
+	}
+}
 
+// splitMessages is a bufio.SplitFunc for messages terminated by NUL or newline
+func splitMessages(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\x00\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
 	}
+	return 0, nil, nil
 }
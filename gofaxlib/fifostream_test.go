@@ -0,0 +1,45 @@
+package gofaxlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFifoStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifostream")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "FIFO.test")
+	assert.NoError(t, syscall.Mkfifo(name, 0600))
+
+	stream := NewFifoStream(name)
+
+	// Multiple messages in one write, terminated by NUL or newline
+	assert.NoError(t, SendFIFO(name, "H\x00SR\nZ"))
+	// Multiple writes per open
+	fifo, err := os.OpenFile(name, os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	fifo.WriteString("Cfoo:bar\x00\x00")
+	fifo.WriteString("Q\n")
+	fifo.Close()
+
+	var messages []string
+	for len(messages) < 5 {
+		select {
+		case msg := <-stream.Messages():
+			messages = append(messages, msg)
+		case err := <-stream.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for messages, got", messages)
+		}
+	}
+	assert.Equal(t, []string{"H", "SR", "Z", "Cfoo:bar", "Q"}, messages)
+}
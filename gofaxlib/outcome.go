@@ -0,0 +1,87 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxlib
+
+// Outcome is the category of the result of a fax transmission
+type Outcome string
+
+// Outcomes of fax transmissions
+const (
+	// All pages were transferred
+	OutcomeSuccess Outcome = "success"
+	// Some pages were transferred before the transmission failed
+	OutcomePartial Outcome = "partial"
+	// The fax machines could not agree on how to transfer the document
+	OutcomeNegotiationFailure Outcome = "negotiation_failure"
+	// The remote side ended the call or disconnected
+	OutcomeRemoteHangup Outcome = "remote_hangup"
+	// Communication errors while transferring the document
+	OutcomeLineError Outcome = "line_error"
+	// Errors of the local side, like unreadable documents
+	OutcomeLocalError Outcome = "local_error"
+)
+
+// Outcomes by name, e.g. to validate configuration
+var Outcomes = map[string]Outcome{
+	string(OutcomeSuccess):            OutcomeSuccess,
+	string(OutcomePartial):            OutcomePartial,
+	string(OutcomeNegotiationFailure): OutcomeNegotiationFailure,
+	string(OutcomeRemoteHangup):       OutcomeRemoteHangup,
+	string(OutcomeLineError):          OutcomeLineError,
+	string(OutcomeLocalError):         OutcomeLocalError,
+}
+
+// SpanDSP T.30 result codes (t30_err_e) by outcome, transmissions
+// failing with other codes are line errors
+var resultCodeOutcomes = map[int]Outcome{}
+
+func init() {
+	for outcome, codes := range map[Outcome][]int{
+		// Phase B: no common capabilities, training failed, no fax
+		// machine answered, unacceptable polling and identification
+		OutcomeNegotiationFailure: {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 19, 20, 28,
+			50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61},
+		// DCN received or call dropped
+		OutcomeRemoteHangup: {17, 35, 36, 37, 38, 39, 40, 48, 49},
+		// File and memory errors
+		OutcomeLocalError: {41, 42, 43, 44, 45, 46, 47},
+	} {
+		for _, code := range codes {
+			resultCodeOutcomes[code] = outcome
+		}
+	}
+}
+
+// classifyOutcome returns the outcome category of f
+func classifyOutcome(f *FaxResult) Outcome {
+	switch {
+	case f.Success:
+		return OutcomeSuccess
+	case f.TransferredPages > 0:
+		return OutcomePartial
+	case f.ResultCode != 0:
+		if outcome, ok := resultCodeOutcomes[f.ResultCode]; ok {
+			return outcome
+		}
+		return OutcomeLineError
+	case f.NegotiateCount > 0, f.Hangupcause != "":
+		// Call ended without a fax result, e.g. busy or answered by a person
+		return OutcomeRemoteHangup
+	}
+	return OutcomeLocalError
+}
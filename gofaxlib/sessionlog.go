@@ -20,6 +20,7 @@ package gofaxlib
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
 
 	"github.com/gonicus/gofaxip/gofaxlib/logger"
 )
@@ -69,6 +70,24 @@ func NewSessionLogger(jobid uint) (SessionLogger, error) {
 	return l, nil
 }
 
+// OpenSessionLogger returns a SessionLogger appending to the
+// session log file of an existing CommID
+func OpenSessionLogger(jobid uint, commid string) (SessionLogger, error) {
+	commseq, err := strconv.ParseUint(commid, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commid %q: %w", commid, err)
+	}
+
+	l := &hylasessionlog{
+		jobid:   jobid,
+		commseq: commseq,
+		commid:  commid,
+		logfile: filepath.Join(logDir, fmt.Sprintf(logFileFormat, commid)),
+	}
+
+	return l, nil
+}
+
 func (h *hylasessionlog) Log(v ...interface{}) {
 	if h.jobid != 0 {
 		logger.Logger.Println(append([]interface{}{fmt.Sprintf("(%d)", h.jobid)}, v...)...)
@@ -0,0 +1,45 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxlib
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultStandaloneSpooldir is used as spool directory
+	// in standalone mode if none is configured
+	DefaultStandaloneSpooldir = "/var/lib/gofaxip"
+)
+
+// Subdirectories of the spool directory used by GOfax.IP
+var spoolDirs = []string{"docq", "doneq", "log", "recvq", "sendq", "status"}
+
+// CreateSpool creates the spool directory and its subdirectories
+// if they don't exist. In standalone mode, GOfax.IP runs without
+// HylaFAX and keeps its sequence numbers, logs, received faxes and
+// queued jobs in a spool directory with the same layout.
+func CreateSpool() error {
+	for _, dir := range spoolDirs {
+		if err := os.MkdirAll(filepath.Join(Config.Hylafax.Spooldir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
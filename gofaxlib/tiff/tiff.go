@@ -0,0 +1,514 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+// Package tiff reads TIFF files as used for facsimile (TIFF Class F)
+package tiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/gonicus/gofaxip/gofaxlib/ccitt"
+)
+
+// TIFF tags used for facsimile images
+const (
+	TagNewSubfileType  = 254
+	TagImageWidth      = 256
+	TagImageLength     = 257
+	TagBitsPerSample   = 258
+	TagCompression     = 259
+	TagPhotometric     = 262
+	TagFillOrder       = 266
+	TagStripOffsets    = 273
+	TagSamplesPerPixel = 277
+	TagRowsPerStrip    = 278
+	TagStripByteCounts = 279
+	TagXResolution     = 282
+	TagYResolution     = 283
+	TagT4Options       = 292
+	TagT6Options       = 293
+	TagResolutionUnit  = 296
+	TagPageNumber      = 297
+	TagTileWidth       = 322
+)
+
+// Compression schemes
+const (
+	CompressionNone     = 1
+	CompressionCCITTRLE = 2
+	CompressionCCITTT4  = 3
+	CompressionCCITTT6  = 4
+)
+
+// Field types
+const (
+	TypeByte      = 1
+	TypeASCII     = 2
+	TypeShort     = 3
+	TypeLong      = 4
+	TypeRational  = 5
+	TypeSByte     = 6
+	TypeUndefined = 7
+	TypeSShort    = 8
+	TypeSLong     = 9
+	TypeSRational = 10
+	TypeFloat     = 11
+	TypeDouble    = 12
+)
+
+// Other tag values
+const (
+	PhotometricMinIsWhite = 0
+	PhotometricMinIsBlack = 1
+
+	FillOrderMSB2LSB = 1
+	FillOrderLSB2MSB = 2
+
+	ResolutionUnitNone = 1
+	ResolutionUnitInch = 2
+	ResolutionUnitCm   = 3
+
+	T4Option2D           = 1
+	T4OptionUncompressed = 2
+	T4OptionFillBits     = 4
+)
+
+// Limit the number of directories to detect loops in broken files
+const maxIFDs = 10000
+
+var typeSizes = map[uint16]uint32{
+	TypeByte:      1,
+	TypeASCII:     1,
+	TypeShort:     2,
+	TypeLong:      4,
+	TypeRational:  8,
+	TypeSByte:     1,
+	TypeUndefined: 1,
+	TypeSShort:    2,
+	TypeSLong:     4,
+	TypeSRational: 8,
+	TypeFloat:     4,
+	TypeDouble:    8,
+}
+
+// Field is a TIFF directory entry
+type Field struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	// Value in file byte order
+	Data []byte
+
+	order binary.ByteOrder
+}
+
+// Uints returns the values of a BYTE, SHORT or LONG field
+func (f *Field) Uints() []uint32 {
+	values := make([]uint32, 0, f.Count)
+	for i := uint32(0); i < f.Count; i++ {
+		switch f.Type {
+		case TypeByte, TypeUndefined:
+			values = append(values, uint32(f.Data[i]))
+		case TypeShort:
+			values = append(values, uint32(f.order.Uint16(f.Data[2*i:])))
+		case TypeLong:
+			values = append(values, f.order.Uint32(f.Data[4*i:]))
+		default:
+			return nil
+		}
+	}
+	return values
+}
+
+// Float returns the first value of a numeric field as float64
+func (f *Field) Float() float64 {
+	if f.Count == 0 {
+		return 0
+	}
+	switch f.Type {
+	case TypeRational:
+		num, den := f.order.Uint32(f.Data), f.order.Uint32(f.Data[4:])
+		if den == 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	case TypeByte, TypeShort, TypeLong:
+		return float64(f.Uints()[0])
+	}
+	return 0
+}
+
+// IFD is a TIFF image file directory, i.e. a page of a fax
+type IFD struct {
+	// Offset of the directory in the file
+	Offset uint32
+	// Fields sorted by tag
+	Fields []*Field
+}
+
+// Field returns the field with given tag or nil
+func (ifd *IFD) Field(tag uint16) *Field {
+	i := sort.Search(len(ifd.Fields), func(i int) bool { return ifd.Fields[i].Tag >= tag })
+	if i < len(ifd.Fields) && ifd.Fields[i].Tag == tag {
+		return ifd.Fields[i]
+	}
+	return nil
+}
+
+// Uint returns the first value of the field with given tag or def if it does not exist
+func (ifd *IFD) Uint(tag uint16, def uint32) uint32 {
+	if f := ifd.Field(tag); f != nil {
+		if values := f.Uints(); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return def
+}
+
+// Uints returns all values of the field with given tag
+func (ifd *IFD) Uints(tag uint16) []uint32 {
+	if f := ifd.Field(tag); f != nil {
+		return f.Uints()
+	}
+	return nil
+}
+
+// Float returns the value of the field with given tag or def if it does not exist
+func (ifd *IFD) Float(tag uint16, def float64) float64 {
+	if f := ifd.Field(tag); f != nil {
+		return f.Float()
+	}
+	return def
+}
+
+// Width returns the width of the image in pixels
+func (ifd *IFD) Width() uint32 {
+	return ifd.Uint(TagImageWidth, 0)
+}
+
+// Length returns the length of the image in rows
+func (ifd *IFD) Length() uint32 {
+	return ifd.Uint(TagImageLength, 0)
+}
+
+// Resolution returns the horizontal and vertical resolution in pixels per inch
+func (ifd *IFD) Resolution() (x float64, y float64) {
+	x = ifd.Float(TagXResolution, 204)
+	y = ifd.Float(TagYResolution, 98)
+	if ifd.Uint(TagResolutionUnit, ResolutionUnitInch) == ResolutionUnitCm {
+		x *= 2.54
+		y *= 2.54
+	}
+	return
+}
+
+// Page widths allowed by T.4 for the supported resolutions
+var faxWidths = map[uint32]bool{
+	1728: true, 2048: true, 2432: true, // 204 dpi
+	2592: true, 3072: true, 3648: true, // 300 dpi
+	3456: true, 4096: true, 4864: true, // 408 dpi
+}
+
+// CheckFax returns an error if the image can not be transmitted
+// as a fax without converting it
+func (ifd *IFD) CheckFax() error {
+	if ifd.Field(TagTileWidth) != nil {
+		return errors.New("tiled images are not supported")
+	}
+	if bps := ifd.Uint(TagBitsPerSample, 1); bps != 1 {
+		return fmt.Errorf("image is not black and white (%d bits per sample)", bps)
+	}
+	if spp := ifd.Uint(TagSamplesPerPixel, 1); spp != 1 {
+		return fmt.Errorf("image is not black and white (%d samples per pixel)", spp)
+	}
+	switch compression := ifd.Uint(TagCompression, CompressionNone); compression {
+	case CompressionCCITTRLE, CompressionCCITTT4, CompressionCCITTT6:
+	default:
+		return fmt.Errorf("compression %d is not supported for faxes", compression)
+	}
+	if ifd.Uint(TagT4Options, 0)&T4OptionUncompressed != 0 {
+		return errors.New("uncompressed mode is not supported for faxes")
+	}
+	if photometric := ifd.Uint(TagPhotometric, PhotometricMinIsWhite); photometric != PhotometricMinIsWhite {
+		return fmt.Errorf("photometric interpretation %d is not supported for faxes", photometric)
+	}
+	if width := ifd.Width(); !faxWidths[width] {
+		return fmt.Errorf("invalid page width %d", width)
+	}
+	if ifd.Length() == 0 {
+		return errors.New("invalid page length")
+	}
+	if x, y := ifd.Resolution(); x < 100 || y < 50 {
+		return fmt.Errorf("invalid resolution %.0fx%.0f", x, y)
+	}
+	if len(ifd.Uints(TagStripOffsets)) == 0 {
+		return errors.New("image contains no strips")
+	}
+	return nil
+}
+
+// File is a parsed TIFF file
+type File struct {
+	ByteOrder binary.ByteOrder
+	IFDs      []*IFD
+
+	r      io.ReaderAt
+	closer io.Closer
+}
+
+// Decode parses the header and all directories of a TIFF file
+func Decode(r io.ReaderAt) (*File, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading TIFF header: %w", err)
+	}
+
+	f := &File{r: r}
+	switch string(header[0:2]) {
+	case "II":
+		f.ByteOrder = binary.LittleEndian
+	case "MM":
+		f.ByteOrder = binary.BigEndian
+	default:
+		return nil, errors.New("not a TIFF file")
+	}
+	if f.ByteOrder.Uint16(header[2:]) != 42 {
+		return nil, errors.New("not a TIFF file")
+	}
+
+	seen := make(map[uint32]bool)
+	offset := f.ByteOrder.Uint32(header[4:])
+	for offset != 0 {
+		if seen[offset] || len(f.IFDs) >= maxIFDs {
+			return nil, fmt.Errorf("loop in TIFF directories at offset %d", offset)
+		}
+		seen[offset] = true
+
+		ifd, next, err := f.readIFD(offset)
+		if err != nil {
+			return nil, fmt.Errorf("reading TIFF directory %d: %w", len(f.IFDs), err)
+		}
+		f.IFDs = append(f.IFDs, ifd)
+		offset = next
+	}
+
+	if len(f.IFDs) == 0 {
+		return nil, errors.New("TIFF file contains no images")
+	}
+
+	return f, nil
+}
+
+// Open opens and parses a TIFF file. The file has to be closed after use.
+func Open(filename string) (*File, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Decode(fh)
+	if err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	f.closer = fh
+	return f, nil
+}
+
+// Close closes a file opened using Open
+func (f *File) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+func (f *File) readIFD(offset uint32) (*IFD, uint32, error) {
+	buf := make([]byte, 2)
+	if _, err := f.r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	count := uint32(f.ByteOrder.Uint16(buf))
+
+	buf = make([]byte, 12*count+4)
+	if _, err := f.r.ReadAt(buf, int64(offset)+2); err != nil {
+		return nil, 0, err
+	}
+
+	ifd := &IFD{Offset: offset}
+	for i := uint32(0); i < count; i++ {
+		entry := buf[12*i : 12*i+12]
+		field := &Field{
+			Tag:   f.ByteOrder.Uint16(entry[0:]),
+			Type:  f.ByteOrder.Uint16(entry[2:]),
+			Count: f.ByteOrder.Uint32(entry[4:]),
+			order: f.ByteOrder,
+		}
+
+		size, ok := typeSizes[field.Type]
+		if !ok {
+			// Unknown field types must be ignored
+			continue
+		}
+		length := uint64(size) * uint64(field.Count)
+		if length > 1<<24 {
+			return nil, 0, fmt.Errorf("tag %d too large", field.Tag)
+		}
+
+		if length <= 4 {
+			field.Data = append([]byte(nil), entry[8:8+length]...)
+		} else {
+			field.Data = make([]byte, length)
+			if _, err := f.r.ReadAt(field.Data, int64(f.ByteOrder.Uint32(entry[8:]))); err != nil {
+				return nil, 0, fmt.Errorf("reading tag %d: %w", field.Tag, err)
+			}
+		}
+		ifd.Fields = append(ifd.Fields, field)
+	}
+	sort.SliceStable(ifd.Fields, func(i, j int) bool { return ifd.Fields[i].Tag < ifd.Fields[j].Tag })
+
+	return ifd, f.ByteOrder.Uint32(buf[12*count:]), nil
+}
+
+// Strips returns the raw (compressed) strips of the image in given directory
+func (f *File) Strips(ifd *IFD) ([][]byte, error) {
+	offsets := ifd.Uints(TagStripOffsets)
+	counts := ifd.Uints(TagStripByteCounts)
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, errors.New("invalid strip offsets")
+	}
+
+	strips := make([][]byte, len(offsets))
+	for i := range offsets {
+		if counts[i] > 1<<28 {
+			return nil, fmt.Errorf("strip %d too large", i)
+		}
+		strips[i] = make([]byte, counts[i])
+		if _, err := f.r.ReadAt(strips[i], int64(offsets[i])); err != nil {
+			return nil, fmt.Errorf("reading strip %d: %w", i, err)
+		}
+	}
+
+	return strips, nil
+}
+
+// Image decodes the image in given directory. Damaged rows are tolerated
+// and reported in the BadRows field of the image.
+func (f *File) Image(ifd *IFD) (*ccitt.Image, error) {
+	width, length := int(ifd.Width()), int(ifd.Length())
+	if width == 0 {
+		return nil, errors.New("invalid image width")
+	}
+	if bps := ifd.Uint(TagBitsPerSample, 1); bps != 1 {
+		return nil, fmt.Errorf("unsupported bits per sample: %d", bps)
+	}
+
+	opts := ccitt.Options{Width: width}
+	compression := ifd.Uint(TagCompression, CompressionNone)
+	switch compression {
+	case CompressionNone:
+	case CompressionCCITTRLE:
+		opts.Format = ccitt.MH
+	case CompressionCCITTT4:
+		options := ifd.Uint(TagT4Options, 0)
+		if options&T4OptionUncompressed != 0 {
+			return nil, errors.New("uncompressed mode is not supported")
+		}
+		opts.Format = ccitt.G3
+		opts.TwoD = options&T4Option2D != 0
+		opts.FillBits = options&T4OptionFillBits != 0
+	case CompressionCCITTT6:
+		opts.Format = ccitt.G4
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+
+	strips, err := f.Strips(ifd)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsPerStrip := int(ifd.Uint(TagRowsPerStrip, uint32(length)))
+	lsbFirst := ifd.Uint(TagFillOrder, FillOrderMSB2LSB) == FillOrderLSB2MSB
+	minIsBlack := ifd.Uint(TagPhotometric, PhotometricMinIsWhite) == PhotometricMinIsBlack
+
+	img := ccitt.NewImage(width, 0)
+	for i, strip := range strips {
+		// Rows of the last strip (or all rows if the length is unknown)
+		rows := 0
+		if length > 0 && rowsPerStrip > 0 {
+			rows = rowsPerStrip
+			if remaining := length - img.Height; remaining < rows || i == len(strips)-1 {
+				rows = remaining
+			}
+			if rows <= 0 {
+				break
+			}
+		}
+
+		if lsbFirst {
+			for j := range strip {
+				strip[j] = bits.Reverse8(strip[j])
+			}
+		}
+
+		var part *ccitt.Image
+		if compression == CompressionNone {
+			part = rawImage(strip, width, rows, minIsBlack)
+		} else if part, err = ccitt.Decode(strip, opts, rows); err != nil {
+			// Keep the rows decoded before the damage
+			var decodeErr *ccitt.DecodeError
+			if !errors.As(err, &decodeErr) {
+				return nil, fmt.Errorf("strip %d: %w", i, err)
+			}
+			part = decodeErr.Image
+		}
+
+		img.Pix = append(img.Pix, part.Pix...)
+		img.Height += part.Height
+		img.BadRows += part.BadRows
+	}
+
+	if img.Height == 0 {
+		return nil, errors.New("image contains no rows")
+	}
+	return img, nil
+}
+
+// rawImage returns the image for uncompressed data
+func rawImage(data []byte, width, rows int, minIsBlack bool) *ccitt.Image {
+	stride := (width + 7) / 8
+	if rows == 0 {
+		rows = len(data) / stride
+	}
+	img := ccitt.NewImage(width, rows)
+	n := copy(img.Pix, data)
+	if minIsBlack {
+		for i := 0; i < n; i++ {
+			img.Pix[i] = ^img.Pix[i]
+		}
+	}
+	if len(data) < len(img.Pix) {
+		img.BadRows = (len(img.Pix) - len(data) + stride - 1) / stride
+	}
+	return img
+}
@@ -0,0 +1,61 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib/ccitt"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestImageFixtures decodes files created by other encoders, see testdata/README
+func TestImageFixtures(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "bw-gopher.png"))
+	must(t, err)
+	defer f.Close()
+	src, err := png.Decode(f)
+	must(t, err)
+
+	for _, name := range []string{"bw-gopher_ccittGroup3.tiff", "bw-gopher_ccittGroup4.tiff"} {
+		file, err := Open(filepath.Join("testdata", name))
+		must(t, err)
+		img, err := file.Image(file.IFDs[0])
+		file.Close()
+		must(t, err)
+
+		assert.Equal(t, src.Bounds().Dx(), img.Width, name)
+		assert.Equal(t, src.Bounds().Dy(), img.Height, name)
+		assert.Equal(t, 0, img.BadRows, name)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				black := src.(*image.Gray).GrayAt(x, y).Y < 0x80
+				if img.Black(x, y) != black {
+					t.Fatalf("%s: pixel %d,%d differs", name, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestImageDamaged(t *testing.T) {
+	expected := testImage(1728, 100, 1)
+	data := buildTIFF(binary.LittleEndian, []*ccitt.Image{expected})
+	// The image data is at the end of the file
+	data[len(data)-len(data)/8] ^= 0xff
+
+	f, err := Decode(bytes.NewReader(data))
+	must(t, err)
+	img, err := f.Image(f.IFDs[0])
+	must(t, err)
+
+	// Rows after the damage are missing
+	assert.Equal(t, expected.Height, img.Height)
+	assert.True(t, img.BadRows > 0 && img.BadRows < expected.Height, "%d bad rows", img.BadRows)
+	good := expected.Height - img.BadRows
+	assert.True(t, bytes.Equal(expected.Pix[:good*expected.Stride], img.Pix[:good*img.Stride]))
+}
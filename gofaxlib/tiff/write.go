@@ -0,0 +1,191 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package tiff
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Tags referring to other data in the file which can not be copied
+var skipTags = map[uint16]bool{
+	288:   true, // FreeOffsets
+	289:   true, // FreeByteCounts
+	330:   true, // SubIFDs
+	513:   true, // JPEGInterchangeFormat
+	34665: true, // Exif IFD
+	34853: true, // GPS IFD
+	40965: true, // Interoperability IFD
+}
+
+// Page refers to a directory of a parsed TIFF file
+type Page struct {
+	File *File
+	IFD  *IFD
+}
+
+// WritePages writes the given pages to w as a new TIFF file.
+// The image data is copied without being decoded.
+func WritePages(w io.Writer, pages []Page) error {
+	if len(pages) == 0 {
+		return errors.New("no pages to write")
+	}
+
+	out := &pageWriter{w: bufio.NewWriter(w), order: binary.LittleEndian}
+	out.write([]byte{'I', 'I', 42, 0, 8, 0, 0, 0})
+
+	for i, page := range pages {
+		strips, err := page.File.Strips(page.IFD)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", i+1, err)
+		}
+		if err = out.writePage(page, strips, i == len(pages)-1); err != nil {
+			return fmt.Errorf("page %d: %w", i+1, err)
+		}
+	}
+
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
+
+type pageWriter struct {
+	w     *bufio.Writer
+	order binary.ByteOrder
+	// Current offset in output
+	offset uint32
+	err    error
+}
+
+func (p *pageWriter) write(data []byte) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = p.w.Write(data)
+	p.offset += uint32(len(data))
+}
+
+// writePage writes a directory followed by the values not fitting
+// in the directory and the strips. The current offset has to be even.
+func (p *pageWriter) writePage(page Page, strips [][]byte, last bool) error {
+	fields := make([]*Field, 0, len(page.IFD.Fields))
+	for _, field := range page.IFD.Fields {
+		if !skipTags[field.Tag] {
+			fields = append(fields, field)
+		}
+	}
+
+	// Replace strip offsets, the values are set below
+	offsets := &Field{Tag: TagStripOffsets, Type: TypeLong, Count: uint32(len(strips)), Data: make([]byte, 4*len(strips))}
+	i := sort.Search(len(fields), func(i int) bool { return fields[i].Tag >= TagStripOffsets })
+	if i < len(fields) && fields[i].Tag == TagStripOffsets {
+		fields[i] = offsets
+	} else {
+		fields = append(fields[:i], append([]*Field{offsets}, fields[i:]...)...)
+	}
+
+	// Layout of external values and strips
+	dirSize := 2 + 12*uint32(len(fields)) + 4
+	external := p.offset + dirSize
+	valueOffsets := make([]uint32, len(fields))
+	for i, field := range fields {
+		if size := uint32(len(field.Data)); size > 4 {
+			valueOffsets[i] = external
+			external += size + size%2
+		}
+	}
+	stripOffset := external
+	for i, strip := range strips {
+		p.order.PutUint32(offsets.Data[4*i:], stripOffset)
+		stripOffset += uint32(len(strip))
+	}
+	if uint64(stripOffset) >= 1<<32-1 {
+		return errors.New("output file too large")
+	}
+	var next uint32
+	if !last {
+		next = stripOffset + stripOffset%2
+	}
+
+	// Directory
+	buf := make([]byte, dirSize)
+	p.order.PutUint16(buf, uint16(len(fields)))
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		entry := buf[2+12*i:]
+		p.order.PutUint16(entry[0:], field.Tag)
+		p.order.PutUint16(entry[2:], field.Type)
+		p.order.PutUint32(entry[4:], field.Count)
+		values[i] = field.bytes(p.order)
+		if len(values[i]) > 4 {
+			p.order.PutUint32(entry[8:], valueOffsets[i])
+		} else {
+			copy(entry[8:12], values[i])
+		}
+	}
+	p.order.PutUint32(buf[dirSize-4:], next)
+	p.write(buf)
+
+	for _, value := range values {
+		if len(value) > 4 {
+			p.write(value)
+			if len(value)%2 != 0 {
+				p.write([]byte{0})
+			}
+		}
+	}
+	for _, strip := range strips {
+		p.write(strip)
+	}
+	if !last && p.offset%2 != 0 {
+		p.write([]byte{0})
+	}
+
+	return p.err
+}
+
+// bytes returns the value of the field in given byte order
+func (f *Field) bytes(order binary.ByteOrder) []byte {
+	if f.order == nil || f.order == order {
+		return f.Data
+	}
+
+	data := make([]byte, len(f.Data))
+	switch f.Type {
+	case TypeShort, TypeSShort:
+		for i := 0; i+2 <= len(data); i += 2 {
+			order.PutUint16(data[i:], f.order.Uint16(f.Data[i:]))
+		}
+	case TypeLong, TypeSLong, TypeFloat, TypeRational, TypeSRational:
+		for i := 0; i+4 <= len(data); i += 4 {
+			order.PutUint32(data[i:], f.order.Uint32(f.Data[i:]))
+		}
+	case TypeDouble:
+		for i := 0; i+8 <= len(data); i += 8 {
+			order.PutUint64(data[i:], f.order.Uint64(f.Data[i:]))
+		}
+	default:
+		copy(data, f.Data)
+	}
+	return data
+}
@@ -0,0 +1,163 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib/ccitt"
+	"github.com/stretchr/testify/assert"
+)
+
+type testField struct {
+	tag, typ uint16
+	values   []uint32
+}
+
+// buildTIFF writes a TIFF file containing a G4 page for each image
+func buildTIFF(order binary.ByteOrder, images []*ccitt.Image, extra ...testField) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	binary.Write(&buf, order, uint16(42))
+	binary.Write(&buf, order, uint32(8))
+
+	for i, img := range images {
+		data, _ := ccitt.Encode(img, ccitt.Options{Format: ccitt.G4})
+		fields := []testField{
+			{TagImageWidth, TypeShort, []uint32{uint32(img.Width)}},
+			{TagImageLength, TypeLong, []uint32{uint32(img.Height)}},
+			{TagBitsPerSample, TypeShort, []uint32{1}},
+			{TagCompression, TypeShort, []uint32{CompressionCCITTT6}},
+			{TagPhotometric, TypeShort, []uint32{PhotometricMinIsWhite}},
+			{TagStripOffsets, TypeLong, []uint32{0}},
+			{TagRowsPerStrip, TypeLong, []uint32{uint32(img.Height)}},
+			{TagStripByteCounts, TypeLong, []uint32{uint32(len(data))}},
+			{TagXResolution, TypeRational, []uint32{204, 1}},
+			{TagYResolution, TypeRational, []uint32{196, 1}},
+			{TagResolutionUnit, TypeShort, []uint32{ResolutionUnitInch}},
+			{TagPageNumber, TypeShort, []uint32{uint32(i), uint32(len(images))}},
+		}
+		fields = append(fields, extra...)
+
+		// Values not fitting in the directory follow it, then the image data
+		dirSize := 2 + 12*len(fields) + 4
+		var values bytes.Buffer
+		entries := make([]byte, 0, 12*len(fields))
+		for _, f := range fields {
+			var value bytes.Buffer
+			for _, v := range f.values {
+				if f.typ == TypeShort {
+					binary.Write(&value, order, uint16(v))
+				} else {
+					binary.Write(&value, order, v)
+				}
+			}
+			count := len(f.values)
+			if f.typ == TypeRational {
+				count /= 2
+			}
+			entry := make([]byte, 12)
+			order.PutUint16(entry, f.tag)
+			order.PutUint16(entry[2:], f.typ)
+			order.PutUint32(entry[4:], uint32(count))
+			if value.Len() > 4 {
+				order.PutUint32(entry[8:], uint32(buf.Len()+dirSize+values.Len()))
+				values.Write(value.Bytes())
+			} else {
+				copy(entry[8:], value.Bytes())
+			}
+			entries = append(entries, entry...)
+		}
+		dataOffset := uint32(buf.Len() + dirSize + values.Len())
+		order.PutUint32(entries[12*5+8:], dataOffset)
+		next := uint32(0)
+		if i < len(images)-1 {
+			next = dataOffset + uint32(len(data))
+			next += next % 2
+		}
+
+		binary.Write(&buf, order, uint16(len(fields)))
+		buf.Write(entries)
+		binary.Write(&buf, order, next)
+		buf.Write(values.Bytes())
+		buf.Write(data)
+		if buf.Len()%2 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+func testImage(width, height, seed int) *ccitt.Image {
+	img := ccitt.NewImage(width, height)
+	for y := 0; y < height; y++ {
+		for x := (y * seed) % 7; x < width; x += 3 + (x+y+seed)%11 {
+			img.Pix[y*img.Stride+x/8] |= 0x80 >> uint(x%8)
+		}
+	}
+	return img
+}
+
+func TestWritePages(t *testing.T) {
+	images := []*ccitt.Image{testImage(1728, 50, 1), testImage(1728, 60, 2), testImage(2048, 40, 3)}
+	big, err := Decode(bytes.NewReader(buildTIFF(binary.BigEndian, images[:2])))
+	must(t, err)
+	little, err := Decode(bytes.NewReader(buildTIFF(binary.LittleEndian, images[2:])))
+	must(t, err)
+
+	var out bytes.Buffer
+	must(t, WritePages(&out, []Page{{big, big.IFDs[1]}, {little, little.IFDs[0]}, {big, big.IFDs[0]}}))
+
+	f, err := Decode(bytes.NewReader(out.Bytes()))
+	must(t, err)
+	if !assert.Len(t, f.IFDs, 3) {
+		return
+	}
+	for i, expected := range []*ccitt.Image{images[1], images[2], images[0]} {
+		ifd := f.IFDs[i]
+		assert.NoError(t, ifd.CheckFax())
+		assert.EqualValues(t, expected.Width, ifd.Width())
+		x, y := ifd.Resolution()
+		assert.Equal(t, 204.0, x)
+		assert.Equal(t, 196.0, y)
+		assert.Len(t, ifd.Uints(TagPageNumber), 2)
+
+		img, err := f.Image(ifd)
+		must(t, err)
+		assert.Equal(t, 0, img.BadRows)
+		assert.Equal(t, expected.Height, img.Height)
+		assert.True(t, bytes.Equal(expected.Pix, img.Pix), "image of page %d differs", i+1)
+	}
+
+	assert.Error(t, WritePages(&out, nil))
+}
+
+func TestCheckFax(t *testing.T) {
+	img := testImage(1728, 10, 1)
+	for _, test := range []struct {
+		field testField
+		err   string
+	}{
+		{testField{TagSamplesPerPixel, TypeShort, []uint32{3}}, "image is not black and white (3 samples per pixel)"},
+		{testField{TagT4Options, TypeLong, []uint32{T4OptionUncompressed}}, "uncompressed mode is not supported for faxes"},
+		{testField{TagTileWidth, TypeLong, []uint32{256}}, "tiled images are not supported"},
+	} {
+		f, err := Decode(bytes.NewReader(buildTIFF(binary.LittleEndian, []*ccitt.Image{img}, test.field)))
+		must(t, err)
+		assert.EqualError(t, f.IFDs[0].CheckFax(), test.err)
+	}
+
+	f, err := Decode(bytes.NewReader(buildTIFF(binary.LittleEndian, []*ccitt.Image{testImage(1700, 10, 1)})))
+	must(t, err)
+	assert.EqualError(t, f.IFDs[0].CheckFax(), "invalid page width 1700")
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
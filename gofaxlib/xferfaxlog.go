@@ -48,6 +48,8 @@ type XFRecord struct {
 	Cidnum   string
 	Owner    string
 	Dcs      string
+	// Identification of the call, e.g. custom SIP headers
+	CallID string
 }
 
 // SetResult populates xferfaxlog record fields from a FaxResult
@@ -56,14 +58,16 @@ func (r *XFRecord) SetResult(result *FaxResult) {
 		duration := result.EndTs.Sub(result.StartTs)
 		r.Ts = result.StartTs
 		r.RemoteID = result.RemoteID
-		r.Params = EncodeParams(result.TransferRate, result.Ecm)
+		params := NewClass2Params(result)
+		r.Params = params.Encode()
 		r.Pages = result.TransferredPages
 		r.Jobtime = duration
 		r.Conntime = duration
 		r.Reason = result.ResultText
 
-		if len(result.PageResults) > 0 {
-			r.Dcs = result.PageResults[0].EncodingName
+		// Parameters are only known if the fax machines negotiated
+		if result.NegotiateCount > 0 || len(result.PageResults) > 0 {
+			r.Dcs = params.String()
 		}
 	}
 }
@@ -71,7 +75,7 @@ func (r *XFRecord) SetResult(result *FaxResult) {
 func (r *XFRecord) formatTransmissionReport() string {
 	return fmt.Sprintf(xLogFormat, r.Ts.Format(tsLayout), "SEND", r.Commid, r.Modem,
 		r.Jobid, r.Jobtag, r.Sender, r.Destnum, r.RemoteID, r.Params, r.Pages,
-		formatDuration(r.Jobtime), formatDuration(r.Conntime), r.Reason, "", "", "", r.Owner, r.Dcs)
+		formatDuration(r.Jobtime), formatDuration(r.Conntime), r.Reason, "", "", r.CallID, r.Owner, r.Dcs)
 }
 
 func (r *XFRecord) formatReceptionReport() string {
@@ -109,27 +113,11 @@ func formatDuration(d time.Duration) string {
 
 // EncodeParams encodes given baud rate and ecm status to
 // the status byte used in HylaFAX's xferfaxlog.
-// This only encodes bitrate and ECM use right now.
+// Use NewClass2Params to encode all parameters of a fax.
 func EncodeParams(baudrate uint, ecm bool) uint {
-
-	var br uint
-	switch {
-	case baudrate > 12000:
-		br = 5
-	case baudrate > 9600:
-		br = 4
-	case baudrate > 7200:
-		br = 3
-	case baudrate > 4800:
-		br = 2
-	case baudrate > 2400:
-		br = 1
-	}
-
-	var ec uint
+	p := Class2Params{BR: bitRateCode(baudrate)}
 	if ecm {
-		ec = 1
+		p.EC = ECEnable256
 	}
-
-	return (br << 3) | (ec << 16)
+	return p.Encode()
 }
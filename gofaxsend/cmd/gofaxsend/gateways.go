@@ -0,0 +1,64 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+// gatewaysCommand shows or resets the circuit breaker state of the gateways
+func gatewaysCommand(args []string) int {
+	if len(args) == 2 && args[0] == "reset" {
+		if err := gofaxsend.ResetGateway(args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	statuses, err := gofaxsend.GatewayStatuses()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "GATEWAY\tCIRCUIT\tFAILURES\tACTIVE\tLAST SUCCESS\tLAST FAILURE\tOPEN UNTIL\tLAST ERROR")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", s.Name, s.Circuit, s.Failures, s.ActiveCalls,
+			formatTime(s.LastSuccess), formatTime(s.LastFailure), formatTime(s.OpenUntil), s.LastError)
+	}
+	w.Flush()
+	return 0
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
@@ -39,8 +39,11 @@ var (
 	configFile  = flag.String("c", defaultConfigfile, "GOfax configuration file")
 	deviceID    = flag.String("m", "", "Virtual modem device ID")
 	showVersion = flag.Bool("version", false, "Show version information")
+	normalize   = flag.String("normalize", "", "Show how given number is dialed using the dial plan")
+	dryRun      = flag.Bool("dry-run", false, "Show the fax job and originate command for qfile without dialing")
+	noFS        = flag.Bool("no-fs", false, "Don't query FreeSWITCH during a dry run")
 
-	usage = fmt.Sprintf("Usage: %s -version | [-c configfile] -m deviceID qfile [qfile [qfile [...]]]", os.Args[0])
+	usage = fmt.Sprintf("Usage: %s -version | [-c configfile] -m deviceID qfile [qfile [qfile [...]]] | [-c configfile] -dry-run [-no-fs] -m deviceID qfile | [-c configfile] gateways [reset gateway] | [-c configfile] submit [options] number file.tif [...] | [-c configfile] -normalize number", os.Args[0])
 
 	// Version can be set at build time using:
 	//    -ldflags "-X main.version 0.42"
@@ -66,6 +69,30 @@ func logPanic() {
 	}
 }
 
+func loadConfig() {
+	gofaxlib.LoadConfig(*configFile)
+	if err := gofaxsend.LoadRetryPolicies(); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if err := gofaxsend.LoadGateways(); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if err := gofaxsend.LoadDialPlan(); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if err := gofaxsend.LoadSendWindows(); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+	if err := gofaxsend.LoadSIPHeaders(); err != nil {
+		logger.Logger.Print("Config: ", err)
+		log.Fatal("Config: ", err)
+	}
+}
+
 func main() {
 	defer logPanic()
 	flag.Parse()
@@ -75,6 +102,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *normalize != "" {
+		loadConfig()
+		os.Exit(normalizeCommand(*normalize))
+	}
+
+	if flag.Arg(0) == "gateways" {
+		loadConfig()
+		os.Exit(gatewaysCommand(flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "submit" {
+		loadConfig()
+		os.Exit(submitCommand(flag.Args()[1:]))
+	}
+
 	if *deviceID == "" || !(flag.NArg() > 0) {
 		logger.Logger.Print(usage)
 		log.Fatal(usage)
@@ -85,7 +127,11 @@ func main() {
 		logger.Logger.Fatalln("No qfile provided on command line")
 	}
 
-	gofaxlib.LoadConfig(*configFile)
+	loadConfig()
+	if *dryRun {
+		os.Exit(dryRunCommand(qfilename))
+	}
+
 	devicefifo := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, fifoPrefix+*deviceID)
 	gofaxlib.SendFIFO(devicefifo, "SB")
 
@@ -104,3 +150,27 @@ func main() {
 	logger.Logger.Print("Exiting with status ", returned)
 	os.Exit(int(returned))
 }
+
+// dryRunCommand shows how qfilename would be sent
+func dryRunCommand(qfilename string) int {
+	// Documents in the qfile are relative to the spool directory
+	qfilename, err := filepath.Abs(qfilename)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err = os.Chdir(gofaxlib.Config.Hylafax.Spooldir); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	dialed, err := gofaxsend.DryRun(os.Stdout, qfilename, *deviceID, *noFS)
+	if err != nil {
+		log.Printf("Error processing qfile %v: %v", qfilename, err)
+		return 1
+	}
+	if !dialed {
+		return 1
+	}
+	return 0
+}
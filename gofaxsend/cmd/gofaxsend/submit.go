@@ -0,0 +1,227 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
+	"github.com/gonicus/gofaxip/gofaxsend"
+)
+
+const (
+	sendqDir = "sendq"
+	docqDir  = "docq"
+
+	// Job state ready as used by HylaFAX
+	jobStateReady = 5
+)
+
+// submitCommand queues a fax to be sent by gofaxd in standalone mode
+func submitCommand(args []string) int {
+	fs := flag.NewFlagSet("submit", flag.ContinueOnError)
+	sender := fs.String("sender", "", "Sender name")
+	owner := fs.String("owner", "", "Owner of the job (default: current user)")
+	tag := fs.String("tag", "", "Job tag")
+	sendat := fs.String("sendat", "", "Send at given time (RFC 3339)")
+	killtime := fs.Duration("killtime", 3*time.Hour, "Give up after this time")
+	maxtries := fs.Uint("maxtries", 3, "Maximum number of answered calls")
+	maxdials := fs.Uint("maxdials", 12, "Maximum number of dial attempts")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-c configfile] submit [options] number file.tif [file.tif [...]]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 1
+	}
+
+	if !gofaxlib.Config.Hylafax.Standalone {
+		fmt.Fprintln(os.Stderr, "submit is only available in standalone mode, use sendfax to submit jobs to HylaFAX")
+		return 1
+	}
+
+	tts := time.Now()
+	if *sendat != "" {
+		var err error
+		if tts, err = time.Parse(time.RFC3339, *sendat); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid time %q: %v\n", *sendat, err)
+			return 1
+		}
+	}
+	if *owner == "" {
+		if u, err := user.Current(); err == nil {
+			*owner = u.Username
+		}
+	}
+
+	// Document paths are relative to the spool directory
+	documents := make([]string, 0, fs.NArg()-1)
+	for _, doc := range fs.Args()[1:] {
+		abs, err := filepath.Abs(doc)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		documents = append(documents, abs)
+	}
+	if err := gofaxlib.CreateSpool(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.Chdir(gofaxlib.Config.Hylafax.Spooldir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var entries []string
+	var pages int
+	for _, doc := range documents {
+		entry, n, err := queueDocument(doc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", doc, err)
+			removeDocuments(entries)
+			return 1
+		}
+		entries = append(entries, entry)
+		pages += n
+	}
+
+	jobid, err := gofaxlib.GetSeqFor(sendqDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		removeDocuments(entries)
+		return 1
+	}
+
+	// The queue file is moved into place when it is complete,
+	// gofaxd only picks up files named q<jobid>
+	tmpname := filepath.Join(sendqDir, fmt.Sprintf(".tmp-%d", jobid))
+	qf, err := gofaxsend.CreateQfile(tmpname)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		removeDocuments(entries)
+		return 1
+	}
+	defer qf.Close()
+
+	number := fs.Arg(0)
+	for _, p := range [][2]string{
+		{"tts", strconv.FormatInt(tts.Unix(), 10)},
+		{"killtime", strconv.FormatInt(tts.Add(*killtime).Unix(), 10)},
+		{"state", strconv.Itoa(jobStateReady)},
+		{"npages", "0"},
+		{"totpages", strconv.Itoa(pages)},
+		{"ndials", "0"},
+		{"totdials", "0"},
+		{"maxdials", strconv.FormatUint(uint64(*maxdials), 10)},
+		{"tottries", "0"},
+		{"maxtries", strconv.FormatUint(uint64(*maxtries), 10)},
+		{"desiredbr", "13"},
+		{"desiredec", "2"},
+		{"external", number},
+		{"number", number},
+		{"sender", *sender},
+		{"jobid", strconv.FormatUint(jobid, 10)},
+		{"jobtag", *tag},
+		{"modem", "any"},
+		{"owner", *owner},
+		{"jobtype", "facsimile"},
+		{"status", ""},
+	} {
+		qf.Add(p[0], p[1])
+	}
+	for _, entry := range entries {
+		qf.Add("fax", entry)
+	}
+	if err = qf.Write(); err == nil {
+		err = os.Rename(tmpname, filepath.Join(sendqDir, fmt.Sprintf("q%d", jobid)))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Remove(tmpname)
+		removeDocuments(entries)
+		return 1
+	}
+
+	fmt.Printf("request id is %d (%d pages)\n", jobid, pages)
+	return 0
+}
+
+// queueDocument copies a TIFF to docq and returns
+// the fax entry for the queue file and its number of pages
+func queueDocument(filename string) (string, int, error) {
+	file, err := tiff.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	if len(file.IFDs) == 0 {
+		return "", 0, errors.New("document has no pages")
+	}
+	for i, ifd := range file.IFDs {
+		if err = ifd.CheckFax(); err != nil {
+			return "", 0, fmt.Errorf("page %d: %w", i+1, err)
+		}
+	}
+
+	seq, err := gofaxlib.GetSeqFor(docqDir)
+	if err != nil {
+		return "", 0, err
+	}
+	docname := filepath.Join(docqDir, fmt.Sprintf("doc%d.tif", seq))
+
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(docname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(docname)
+		return "", 0, err
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(docname)
+		return "", 0, err
+	}
+
+	return "0::" + docname, len(file.IFDs), nil
+}
+
+func removeDocuments(entries []string) {
+	for _, entry := range entries {
+		os.Remove(entry[len("0::"):])
+	}
+}
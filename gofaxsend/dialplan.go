@@ -0,0 +1,220 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+// Formats of dialed numbers
+const (
+	formatE164          = "e164"
+	formatPlusE164      = "+e164"
+	formatInternational = "international"
+	formatNational      = "national"
+	formatLocal         = "local"
+)
+
+var numberFormats = map[string]bool{
+	formatE164:          true,
+	formatPlusE164:      true,
+	formatInternational: true,
+	formatNational:      true,
+	formatLocal:         true,
+}
+
+// Characters used to group digits in numbers
+var numberSeparators = strings.NewReplacer(" ", "", "\t", "", "-", "", "/", "", ".", "", "(", "", ")", "")
+
+// dialPlan normalizes destination numbers to E.164 and
+// formats them as expected by the gateways
+type dialPlan struct {
+	countryCode         string
+	areaCode            string
+	internationalPrefix string
+	nationalPrefix      string
+	format              string
+	techPrefix          string
+}
+
+// Dial plan loaded by LoadDialPlan, nil if not configured
+var dialplan *dialPlan
+
+// LoadDialPlan loads the [dialplan] section of the configuration.
+// It has to be called after gofaxlib.LoadConfig.
+func LoadDialPlan() error {
+	d, err := loadDialPlan()
+	if err != nil {
+		return err
+	}
+	dialplan = d
+	return nil
+}
+
+func loadDialPlan() (*dialPlan, error) {
+	cfg := gofaxlib.Config.Dialplan
+	if cfg.CountryCode == "" {
+		return nil, nil
+	}
+
+	d := &dialPlan{
+		countryCode:         cfg.CountryCode,
+		areaCode:            cfg.AreaCode,
+		internationalPrefix: cfg.InternationalPrefix,
+		nationalPrefix:      cfg.NationalPrefix,
+		format:              cfg.NumberFormat,
+		techPrefix:          cfg.TechPrefix,
+	}
+	if d.internationalPrefix == "" {
+		d.internationalPrefix = "00"
+	}
+	if d.nationalPrefix == "" {
+		d.nationalPrefix = "0"
+	}
+	if d.format == "" {
+		d.format = formatE164
+	}
+
+	for _, code := range []string{d.countryCode, d.areaCode, d.internationalPrefix, d.nationalPrefix} {
+		if !isDigits(code) && code != "" {
+			return nil, fmt.Errorf("dialplan: invalid code %q", code)
+		}
+	}
+	if !numberFormats[d.format] {
+		return nil, fmt.Errorf("dialplan: invalid numberformat %q", d.format)
+	}
+	for name, gw := range gofaxlib.Config.Gateway {
+		if gw.NumberFormat != "" && !numberFormats[gw.NumberFormat] {
+			return nil, fmt.Errorf("gateway %q: invalid numberformat %q", name, gw.NumberFormat)
+		}
+	}
+
+	return d, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Normalize parses a number as entered by a user and returns it in E.164
+// format without "+". Numbers without prefix are local numbers in the
+// configured area.
+func (d *dialPlan) Normalize(number string) (string, error) {
+	n := strings.TrimSpace(number)
+	international := strings.HasPrefix(n, "+")
+	if international {
+		// The national prefix is often given in parentheses, i.e. +49 (0)40 123
+		n = strings.Replace(n[1:], "(0)", "", 1)
+	}
+	n = numberSeparators.Replace(n)
+	if !isDigits(n) {
+		return "", fmt.Errorf("invalid number %q", number)
+	}
+
+	var e164 string
+	switch {
+	case international:
+		e164 = n
+	case strings.HasPrefix(n, d.internationalPrefix):
+		e164 = n[len(d.internationalPrefix):]
+	case strings.HasPrefix(n, d.nationalPrefix):
+		e164 = d.countryCode + n[len(d.nationalPrefix):]
+	default:
+		e164 = d.countryCode + d.areaCode + n
+	}
+
+	// E.164 numbers have at most 15 digits
+	if len(e164) > 15 {
+		return "", fmt.Errorf("number %q is too long", number)
+	}
+	if len(e164) <= len(d.countryCode)+len(d.areaCode) || e164[0] == '0' {
+		return "", fmt.Errorf("invalid number %q", number)
+	}
+	return e164, nil
+}
+
+// Format returns an E.164 number in given format
+func (d *dialPlan) Format(e164 string, format string) (string, error) {
+	national := strings.HasPrefix(e164, d.countryCode)
+	switch format {
+	case formatE164:
+		return e164, nil
+	case formatPlusE164:
+		return "+" + e164, nil
+	case formatInternational:
+		return d.internationalPrefix + e164, nil
+	case formatLocal:
+		if d.areaCode != "" && strings.HasPrefix(e164, d.countryCode+d.areaCode) {
+			return e164[len(d.countryCode+d.areaCode):], nil
+		}
+		fallthrough
+	case formatNational:
+		if national {
+			return d.nationalPrefix + e164[len(d.countryCode):], nil
+		}
+		return d.internationalPrefix + e164, nil
+	}
+	return "", errors.New("invalid number format " + format)
+}
+
+// Dial returns the number to dial using given gateway, an empty
+// gateway returns the number in the default format
+func (d *dialPlan) Dial(e164 string, gateway string) string {
+	format, techPrefix := d.format, d.techPrefix
+	if cfg, ok := gofaxlib.Config.Gateway[gateway]; ok && gateway != "" {
+		if cfg.NumberFormat != "" {
+			format = cfg.NumberFormat
+		}
+		if cfg.TechPrefix != "" {
+			techPrefix = cfg.TechPrefix
+		}
+	}
+	number, err := d.Format(e164, format)
+	if err != nil {
+		// Formats are checked when loading
+		number = e164
+	}
+	return techPrefix + number
+}
+
+// NormalizeNumber shows how a number is dialed using the configured
+// dial plan. It returns the E.164 number, the number in the default
+// format and the number to dial for each configured gateway.
+func NormalizeNumber(number string) (e164 string, dial string, gateways map[string]string, err error) {
+	if dialplan == nil {
+		return "", "", nil, errors.New("no dial plan configured")
+	}
+	if e164, err = dialplan.Normalize(number); err != nil {
+		return "", "", nil, err
+	}
+	callPrefix := gofaxlib.Config.Gofaxsend.CallPrefix
+	gateways = make(map[string]string)
+	for _, gw := range configuredGateways() {
+		gateways[gw] = callPrefix + dialplan.Dial(e164, gw)
+	}
+	return e164, callPrefix + dialplan.Dial(e164, ""), gateways, nil
+}
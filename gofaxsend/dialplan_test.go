@@ -0,0 +1,99 @@
+package gofaxsend
+
+import (
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialPlanNormalize(t *testing.T) {
+	assert := assert.New(t)
+	d := &dialPlan{countryCode: "49", areaCode: "40", internationalPrefix: "00", nationalPrefix: "0"}
+
+	for _, test := range []struct {
+		input, e164, err string
+	}{
+		{"+49 40 123", "4940123", ""},
+		{"+49 (0)40 123-45", "494012345", ""},
+		{"0049 40 12345", "494012345", ""},
+		{"(040) 123-45", "494012345", ""},
+		{"030/123.45", "493012345", ""},
+		{"12345", "494012345", ""},
+		{"001 212 555 0100", "12125550100", ""},
+		{"+1 (212) 555-0100", "12125550100", ""},
+		{"", "", `invalid number ""`},
+		{"040 123 ext 5", "", `invalid number "040 123 ext 5"`},
+		{"+49 40 1234567890123", "", `number "+49 40 1234567890123" is too long`},
+		{"000123", "", `invalid number "000123"`},
+	} {
+		e164, err := d.Normalize(test.input)
+		if test.err != "" {
+			assert.EqualError(err, test.err, test.input)
+			continue
+		}
+		assert.NoError(err, test.input)
+		assert.Equal(test.e164, e164, test.input)
+	}
+}
+
+func TestDialPlanFormat(t *testing.T) {
+	assert := assert.New(t)
+	d := &dialPlan{countryCode: "49", areaCode: "40", internationalPrefix: "00", nationalPrefix: "0"}
+
+	for _, test := range []struct {
+		e164, format, number string
+	}{
+		{"494012345", formatE164, "494012345"},
+		{"494012345", formatPlusE164, "+494012345"},
+		{"494012345", formatInternational, "00494012345"},
+		{"494012345", formatNational, "04012345"},
+		{"12125550100", formatNational, "0012125550100"},
+		{"494012345", formatLocal, "12345"},
+		{"493012345", formatLocal, "03012345"},
+		{"12125550100", formatLocal, "0012125550100"},
+	} {
+		number, err := d.Format(test.e164, test.format)
+		assert.NoError(err)
+		assert.Equal(test.number, number, "%v as %v", test.e164, test.format)
+	}
+
+	_, err := d.Format("494012345", "dialable")
+	assert.Error(err)
+}
+
+func TestDialPlanGateways(t *testing.T) {
+	assert := assert.New(t)
+	gofaxlib.Config.Dialplan.CountryCode = "49"
+	gofaxlib.Config.Dialplan.AreaCode = "40"
+	gofaxlib.Config.Dialplan.NumberFormat = formatPlusE164
+	gofaxlib.Config.Freeswitch.Gateway = []string{"carrier"}
+	gofaxlib.Config.Gateway = map[string]*gofaxlib.GatewayConfig{
+		"pbx": {NumberFormat: formatNational, TechPrefix: "99#"},
+	}
+	defer func() {
+		gofaxlib.Config.Dialplan.CountryCode = ""
+		gofaxlib.Config.Dialplan.AreaCode = ""
+		gofaxlib.Config.Dialplan.NumberFormat = ""
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		gofaxlib.Config.Gateway = nil
+		dialplan = nil
+	}()
+
+	assert.NoError(LoadDialPlan())
+	e164, dial, gateways, err := NormalizeNumber("040 12345")
+	assert.NoError(err)
+	assert.Equal("494012345", e164)
+	assert.Equal("+494012345", dial)
+	assert.Equal(map[string]string{"carrier": "+494012345", "pbx": "99#04012345"}, gateways)
+
+	gofaxlib.Config.Gateway["pbx"].NumberFormat = "dialable"
+	assert.EqualError(LoadDialPlan(), `gateway "pbx": invalid numberformat "dialable"`)
+
+	// Disabled without country code
+	gofaxlib.Config.Dialplan.CountryCode = ""
+	dialplan = nil
+	assert.NoError(LoadDialPlan())
+	_, _, _, err = NormalizeNumber("040 12345")
+	assert.EqualError(err, "no dial plan configured")
+}
@@ -0,0 +1,141 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fiorix/go-eventsocket/eventsocket"
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+// dryRun holds the state of a dry run, see DryRun
+type dryRun struct {
+	w io.Writer
+	// Don't query FreeSWITCH for gateway status, overrides and softmodem fallback
+	noFS bool
+	// Set if the job would be dialed
+	dialed bool
+}
+
+// DryRun runs the given qfile through the same steps as SendQfile
+// and writes the resulting fax job and originate command to w
+// instead of dialing. The qfile and the gateway state are not changed.
+// It returns true if the job would be dialed.
+func DryRun(w io.Writer, filename, deviceID string, noFS bool) (bool, error) {
+	qfile, err := OpenQfile(filename)
+	if err != nil {
+		return false, err
+	}
+	params := make(map[string][]string)
+	for _, p := range qfile.params {
+		params[p.Tag] = append(params[p.Tag], p.Value)
+	}
+	qfile.Close()
+
+	dry := &dryRun{w: w, noFS: noFS}
+	qf := NewQmemory(params)
+	returned, _, err := sendQfile(context.Background(), qf, deviceID, dry)
+	if err != nil {
+		return false, err
+	}
+	if !dry.dialed {
+		fmt.Fprintf(w, "Not dialing (result %d): %s\n", returned, qf.GetString("status"))
+	}
+	return dry.dialed, nil
+}
+
+// log returns a SessionLogger writing to the output of the dry run
+func (d *dryRun) log() gofaxlib.SessionLogger {
+	return dryRunLog{d.w}
+}
+
+// preview prepares the call of faxjob and writes it to the output
+func (d *dryRun) preview(faxjob *FaxJob, sessionlog gofaxlib.SessionLogger) FaxError {
+	t := &transmission{
+		ctx:        context.Background(),
+		faxjob:     *faxjob,
+		sessionlog: sessionlog,
+		dryRun:     true,
+	}
+	if faxerr := t.validate(); faxerr != nil {
+		return faxerr
+	}
+	if !d.noFS {
+		conn, err := eventsocket.Dial(gofaxlib.Config.Freeswitch.Socket, gofaxlib.Config.Freeswitch.Password)
+		if err != nil {
+			return NewFaxError(err.Error(), true)
+		}
+		defer conn.Close()
+		t.conn = conn
+	}
+
+	gateways, originate, faxerr := t.prepare()
+	if faxerr != nil {
+		return faxerr
+	}
+	d.dialed = true
+
+	tw := tabwriter.NewWriter(d.w, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "\nFax job:")
+	fmt.Fprintf(tw, "UUID:\t%v\n", t.faxjob.UUID)
+	fmt.Fprintf(tw, "Number:\t%s\n", t.faxjob.Number)
+	numbers := make([]string, 0, len(t.faxjob.GatewayNumbers))
+	for gw := range t.faxjob.GatewayNumbers {
+		numbers = append(numbers, gw)
+	}
+	sort.Strings(numbers)
+	for _, gw := range numbers {
+		fmt.Fprintf(tw, "Number via %s:\t%s\n", gw, t.faxjob.GatewayNumbers[gw])
+	}
+	fmt.Fprintf(tw, "Caller ID number:\t%s\n", t.faxjob.Cidnum)
+	fmt.Fprintf(tw, "Caller ID name:\t%s\n", t.faxjob.Cidname)
+	fmt.Fprintf(tw, "Ident:\t%s\n", t.faxjob.Ident)
+	fmt.Fprintf(tw, "Header:\t%s\n", t.faxjob.Header)
+	fmt.Fprintf(tw, "SIP headers:\t%s\n", formatSIPHeaders(t.faxjob.SIPHeaders))
+	fmt.Fprintf(tw, "File:\t%s\n", t.faxjob.Filename)
+	fmt.Fprintf(tw, "ECM:\t%v\n", t.faxjob.UseECM)
+	fmt.Fprintf(tw, "V.17:\t%v\n", !t.faxjob.DisableV17)
+	fmt.Fprintf(tw, "Gateways:\t%s\n", strings.Join(gateways, ", "))
+	tw.Flush()
+
+	fmt.Fprintf(d.w, "\nOriginate command:\n%s\n", originate)
+	return nil
+}
+
+// dryRunLog is a SessionLogger writing to the output of a dry run
+type dryRunLog struct {
+	w io.Writer
+}
+
+func (l dryRunLog) CommSeq() uint64 { return 0 }
+func (l dryRunLog) CommID() string  { return "" }
+func (l dryRunLog) Logfile() string { return "" }
+
+func (l dryRunLog) Log(v ...interface{}) {
+	fmt.Fprintln(l.w, v...)
+}
+
+func (l dryRunLog) Logf(format string, v ...interface{}) {
+	fmt.Fprintf(l.w, format+"\n", v...)
+}
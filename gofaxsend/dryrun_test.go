@@ -0,0 +1,150 @@
+package gofaxsend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gofaxlib.Config.Freeswitch.Gateway = []string{"a", "b"}
+	gofaxlib.Config.Freeswitch.GatewayStrategy = strategyRoundRobin
+	gofaxlib.Config.Gofaxsend.CidName = "GOfax.IP"
+	gofaxlib.Config.Gofaxsend.MaxCallsPerDestination = 1
+	defer func() {
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		gofaxlib.Config.Gofaxsend.CidName = ""
+		gofaxlib.Config.Gofaxsend.MaxCallsPerDestination = 0
+	}()
+
+	document, err := filepath.Abs("testdata/pages,3.tif")
+	must(t, err)
+	filename := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, "q1")
+	content := []byte("jobid:1\nexternal:04012345678\nnumber:04012345678\nfax:0::" + document + "\n")
+	must(t, ioutil.WriteFile(filename, content, 0600))
+
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		dialed, err := DryRun(&out, filename, "modem", true)
+		assert.NoError(err)
+		assert.True(dialed)
+		assert.Contains(out.String(), "Caller ID name:   GOfax.IP")
+		assert.Contains(out.String(), "Gateways:         a, b")
+		assert.Regexp(`\noriginate \{.*\}sofia/gateway/a/04012345678\|sofia/gateway/b/04012345678, &txfax\(.*\)\n`, out.String())
+	}
+
+	// No call slots are taken
+	_, err = os.Stat(filepath.Join(gofaxlib.Config.Hylafax.Spooldir, semaphoreDir))
+	assert.True(os.IsNotExist(err))
+
+	// The qfile is not changed
+	written, err := ioutil.ReadFile(filename)
+	must(t, err)
+	assert.Equal(content, written)
+
+	// Sender names are escaped
+	gofaxlib.Config.Gofaxsend.CidName = "sender"
+	must(t, ioutil.WriteFile(filename, append(content, "sender:Doe, O'Brien\n"...), 0600))
+	var out bytes.Buffer
+	dialed, err := DryRun(&out, filename, "modem", true)
+	assert.NoError(err)
+	assert.True(dialed)
+	assert.Contains(out.String(), `,origination_caller_id_name='Doe\, O\\\'Brien',`)
+
+	// Job is not dialed without a destination
+	must(t, ioutil.WriteFile(filename, []byte("jobid:1\nfax:0::"+document+"\n"), 0600))
+	out.Reset()
+	dialed, err = DryRun(&out, filename, "modem", true)
+	assert.NoError(err)
+	assert.False(dialed)
+	assert.Contains(out.String(), "Not dialing (result 1): Number to dial is empty")
+}
+
+func TestDryRunDialPlan(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gofaxlib.Config.Freeswitch.Gateway = []string{"carrier"}
+	gofaxlib.Config.Gofaxsend.CallPrefix = "0"
+	gofaxlib.Config.Dialplan.CountryCode = "49"
+	gofaxlib.Config.Dialplan.AreaCode = "40"
+	defer func() {
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		gofaxlib.Config.Gofaxsend.CallPrefix = ""
+		gofaxlib.Config.Dialplan.CountryCode = ""
+		gofaxlib.Config.Dialplan.AreaCode = ""
+		dialplan = nil
+		gatewayPrefixes = nil
+	}()
+	must(t, LoadDialPlan())
+	var err error
+	gatewayPrefixes, err = loadGatewayPrefixes(map[string]*gofaxlib.GatewayPrefixConfig{
+		"4940": {Gateway: []string{"hamburg"}},
+	})
+	must(t, err)
+
+	document, err := filepath.Abs("testdata/pages,3.tif")
+	must(t, err)
+	filename := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, "q1")
+	must(t, ioutil.WriteFile(filename, []byte("jobid:1\nexternal:123456\nnumber:123456\nfax:0::"+document+"\n"), 0600))
+
+	// Gateway prefixes are matched against the E.164 number
+	var out bytes.Buffer
+	dialed, err := DryRun(&out, filename, "modem", true)
+	assert.NoError(err)
+	assert.True(dialed)
+	assert.Regexp(`\nGateways: +hamburg\n`, out.String())
+	assert.Contains(out.String(), "sofia/gateway/hamburg/04940123456,")
+}
+
+func TestDryRunSendWindow(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gofaxlib.Config.Freeswitch.Gateway = []string{"carrier"}
+	gofaxlib.Config.Gofaxsend.CallPrefix = "9"
+	defer func() {
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		gofaxlib.Config.Gofaxsend.CallPrefix = ""
+		sendWindows = nil
+	}()
+
+	// Closed on all days but today
+	var days []string
+	for name, day := range weekdays {
+		if day != time.Now().UTC().Weekday() {
+			days = append(days, name)
+		}
+	}
+	var err error
+	sendWindows, err = loadSendWindows(map[string]*gofaxlib.SendWindowConfig{
+		"germany": {Prefix: []string{"0049"}, Timezone: "UTC", Days: strings.Join(days, ","), Hours: []string{"00:00-23:59"}},
+	})
+	must(t, err)
+
+	document, err := filepath.Abs("testdata/pages,3.tif")
+	must(t, err)
+	filename := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, "q1")
+	must(t, ioutil.WriteFile(filename, []byte("jobid:1\nexternal:004940123456\nnumber:004940123456\nfax:0::"+document+"\n"), 0600))
+
+	// Windows are matched against the number without callprefix
+	var out bytes.Buffer
+	dialed, err := DryRun(&out, filename, "modem", true)
+	assert.NoError(err)
+	assert.False(dialed)
+	assert.Contains(out.String(), `Not dialing (result 0): Outside of sending window "germany" for this destination`)
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
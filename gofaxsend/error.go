@@ -26,11 +26,14 @@ type FaxError interface {
 type faxError struct {
 	msg   string
 	retry bool
+
+	// Set if originating the call failed
+	hangupcause string
 }
 
 // NewFaxError creates a FaxError
 func NewFaxError(msg string, retry bool) FaxError {
-	return faxError{msg, retry}
+	return faxError{msg: msg, retry: retry}
 }
 
 func (e faxError) Error() string {
@@ -40,3 +43,21 @@ func (e faxError) Error() string {
 func (e faxError) Retry() bool {
 	return e.retry
 }
+
+// newHangupError creates a FaxError for a call that could not be established
+func newHangupError(hangupcause string, retry bool) FaxError {
+	msg := hangupcause
+	if !retry {
+		msg += " (retry disabled)"
+	}
+	return faxError{msg, retry, hangupcause}
+}
+
+// errorHangupcause returns the hangup cause of a failed call or
+// an empty string if the error is not caused by a hangup
+func errorHangupcause(err FaxError) string {
+	if e, ok := err.(faxError); ok {
+		return e.hangupcause
+	}
+	return ""
+}
@@ -21,14 +21,16 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 
-	"github.com/gonicus/gofaxip/gofaxlib/logger"
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
 )
 
+// docqDir is the HylaFAX document queue relative to the spool directory
+const docqDir = "docq"
+
 // One item (TIFF file) of a fax
 type faxItem struct {
 	// First directory in the file to transmit
@@ -39,6 +41,12 @@ type faxItem struct {
 
 	// Input file of this item
 	filename string
+
+	// Path as given in the queue file
+	path string
+
+	// Number of pages to transmit, known after WriteTo
+	pages uint
 }
 
 // FaxFile represents a whole fax optionally consisting of multiple documents
@@ -75,31 +83,116 @@ func (f *FaxFile) AddItem(entry string) error {
 	}
 
 	faxitem.filename = filename
+	faxitem.path = parts[2]
 	f.items = append(f.items, faxitem)
 	return nil
 }
 
-// WriteTo combines input items and writes output to given
-// path using tiffcp
-func (f *FaxFile) WriteTo(outfile string) error {
+// WriteTo combines the pages of all input items and writes
+// them to given path. The image data is copied as is, so all
+// pages have to be valid fax pages already.
+func (f *FaxFile) WriteTo(outfile string) (err error) {
 	if len(f.items) == 0 {
 		return errors.New("No part files found to combine")
 	}
 
-	args := make([]string, 0, len(f.items)+2)
-	args = append(args, "-x")
-	for _, item := range f.items {
-		// BUG(markus): If the filename contains ',' tiffcp will fail
-		args = append(args, fmt.Sprintf("%s,%d,", item.filename, item.startdir))
+	var pages []tiff.Page
+	for n := range f.items {
+		item := &f.items[n]
+		file, err := tiff.Open(item.filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if item.startdir >= uint(len(file.IFDs)) {
+			return fmt.Errorf("%s: starting page %d not found, document has %d pages", filepath.Base(item.filename), item.startdir+1, len(file.IFDs))
+		}
+		for i, ifd := range file.IFDs[item.startdir:] {
+			if err = ifd.CheckFax(); err != nil {
+				return fmt.Errorf("%s: page %d: %w", filepath.Base(item.filename), int(item.startdir)+i+1, err)
+			}
+			pages = append(pages, tiff.Page{File: file, IFD: ifd})
+		}
+		item.pages = uint(len(file.IFDs)) - item.startdir
 	}
-	args = append(args, outfile)
 
-	cmd := exec.Command("tiffcp", args...)
-	output, err := cmd.CombinedOutput()
+	out, err := os.Create(outfile)
 	if err != nil {
-		logger.Logger.Print(string(output))
 		return err
 	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(outfile)
+		}
+	}()
+
+	if err = tiff.WritePages(out, pages); err != nil {
+		return fmt.Errorf("writing %s: %w", outfile, err)
+	}
+	return nil
+}
+
+// Pages returns the total number of pages written by WriteTo
+func (f *FaxFile) Pages() uint {
+	var pages uint
+	for _, item := range f.items {
+		pages += item.pages
+	}
+	return pages
+}
+
+// SkipPages returns queue file entries for the items still to be sent
+// after the first given number of pages were transmitted successfully.
+// Items that were sent completely are returned in done. At least the
+// last page is always left to be sent, so skipped can be less than sent.
+func (f *FaxFile) SkipPages(sent uint) (remaining []string, done []string, skipped uint) {
+	if total := f.Pages(); sent >= total && total > 0 {
+		sent = total - 1
+	}
+	skipped = sent
+
+	for _, item := range f.items {
+		startdir := item.startdir
+		if sent >= item.pages {
+			sent -= item.pages
+			done = append(done, item.entry(startdir))
+			continue
+		}
+		startdir += sent
+		sent = 0
+		remaining = append(remaining, item.entry(startdir))
+	}
+	return
+}
 
+// entry returns the queue file entry for the item starting at given directory
+func (i faxItem) entry(startdir uint) string {
+	return fmt.Sprintf("%d:%s:%s", startdir, i.subaddr, i.path)
+}
+
+// removeDocuments removes the files of given queue file entries which are
+// not used by an entry in keep. Only files in docq are removed, other
+// documents belong to the submitting application.
+func removeDocuments(entries []string, keep []string) error {
+	used := make(map[string]bool)
+	for _, entry := range keep {
+		if parts := strings.SplitN(entry, ":", 3); len(parts) == 3 {
+			used[filepath.Clean(parts[2])] = true
+		}
+	}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || filepath.Dir(parts[2]) != docqDir || used[filepath.Clean(parts[2])] {
+			continue
+		}
+		if err := os.Remove(parts[2]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
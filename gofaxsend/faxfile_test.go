@@ -0,0 +1,109 @@
+package gofaxsend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib/tiff"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaxFileWriteTo(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxsend")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	outfile := filepath.Join(dir, "out.tif")
+
+	// Filenames containing commas are fine
+	f := FaxFile{}
+	assert.NoError(f.AddItem("0::testdata/pages,3.tif"))
+	assert.NoError(f.AddItem("1::testdata/pages,3.tif"))
+	assert.NoError(f.WriteTo(outfile))
+
+	out, err := tiff.Open(outfile)
+	assert.NoError(err)
+	if assert.NotNil(out) {
+		assert.Len(out.IFDs, 5)
+		out.Close()
+	}
+
+	// Start directory beyond the end of the file
+	f = FaxFile{}
+	assert.NoError(f.AddItem("3::testdata/pages,3.tif"))
+	assert.EqualError(f.WriteTo(outfile), "pages,3.tif: starting page 4 not found, document has 3 pages")
+
+	// Pages which are not valid fax pages
+	assert.NoError(os.Remove(outfile))
+	f = FaxFile{}
+	assert.NoError(f.AddItem("0::testdata/pages,3.tif"))
+	assert.NoError(f.AddItem("0::testdata/invalid.tif"))
+	assert.EqualError(f.WriteTo(outfile), "invalid.tif: page 2: invalid page width 1000")
+	_, err = os.Stat(outfile)
+	assert.True(os.IsNotExist(err))
+
+	// No items
+	f = FaxFile{}
+	assert.Error(f.WriteTo(outfile))
+}
+
+func TestFaxFileSkipPages(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxsend")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	f := FaxFile{}
+	assert.NoError(f.AddItem("1:sub:testdata/pages,3.tif"))
+	assert.NoError(f.AddItem("0::testdata/pages,3.tif"))
+	assert.NoError(f.WriteTo(filepath.Join(dir, "out.tif")))
+	assert.EqualValues(5, f.Pages())
+
+	remaining, done, skipped := f.SkipPages(0)
+	assert.Equal([]string{"1:sub:testdata/pages,3.tif", "0::testdata/pages,3.tif"}, remaining)
+	assert.Empty(done)
+	assert.EqualValues(0, skipped)
+
+	remaining, done, skipped = f.SkipPages(1)
+	assert.Equal([]string{"2:sub:testdata/pages,3.tif", "0::testdata/pages,3.tif"}, remaining)
+	assert.Empty(done)
+	assert.EqualValues(1, skipped)
+
+	remaining, done, skipped = f.SkipPages(3)
+	assert.Equal([]string{"1::testdata/pages,3.tif"}, remaining)
+	assert.Equal([]string{"1:sub:testdata/pages,3.tif"}, done)
+	assert.EqualValues(3, skipped)
+
+	// The last page is always sent again
+	remaining, done, skipped = f.SkipPages(7)
+	assert.Equal([]string{"2::testdata/pages,3.tif"}, remaining)
+	assert.Equal([]string{"1:sub:testdata/pages,3.tif"}, done)
+	assert.EqualValues(4, skipped)
+}
+
+func TestRemoveDocuments(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxsend")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	assert.NoError(err)
+	assert.NoError(os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	assert.NoError(os.Mkdir(docqDir, 0755))
+	for _, name := range []string{"docq/doc1.tif", "docq/doc2.tif", "other.tif"} {
+		assert.NoError(ioutil.WriteFile(name, nil, 0644))
+	}
+
+	// Documents still used and files outside of docq are kept
+	assert.NoError(removeDocuments([]string{"0::docq/doc1.tif", "0::docq/doc2.tif", "0::other.tif", "0::docq/missing.tif"}, []string{"1::docq/doc2.tif"}))
+	_, err = os.Stat("docq/doc1.tif")
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat("docq/doc2.tif")
+	assert.NoError(err)
+	_, err = os.Stat("other.tif")
+	assert.NoError(err)
+}
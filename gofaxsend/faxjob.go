@@ -27,6 +27,8 @@ type FaxJob struct {
 	UUID uuid.UUID
 	// Destination number
 	Number string
+	// Destination number by gateway, if it differs from Number
+	GatewayNumbers map[string]string
 	// Caller ID number
 	Cidnum string
 	// Caller ID name
@@ -43,6 +45,8 @@ type FaxJob struct {
 	// Page header with timestamp, header, ident, pageno will be added
 	// if this Header is non empty
 	Header string
+	// Custom SIP headers by name
+	SIPHeaders map[string]string
 
 	// Gateways to try for this job
 	Gateways []string
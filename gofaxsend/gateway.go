@@ -0,0 +1,314 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+const (
+	// State shared by all gofaxsend processes, relative to the spool directory
+	gatewayStateFile = "gofaxsend.gateways"
+
+	strategyFailover    = "failover"
+	strategyRoundRobin  = "roundrobin"
+	strategyWeighted    = "weighted"
+	strategyLeastActive = "leastactive"
+)
+
+var gatewayStrategies = map[string]bool{
+	strategyFailover:    true,
+	strategyRoundRobin:  true,
+	strategyWeighted:    true,
+	strategyLeastActive: true,
+}
+
+// gatewayRoute is a list of gateways and the strategy to order them
+type gatewayRoute struct {
+	gateways []string
+	strategy string
+}
+
+// Routes by destination prefix loaded by LoadGateways, longest prefix first
+var gatewayPrefixes []gatewayPrefix
+
+type gatewayPrefix struct {
+	prefix string
+	route  gatewayRoute
+}
+
+// LoadGateways checks the gateway configuration and loads the
+// [gatewayprefix "..."] sections. It has to be called after gofaxlib.LoadConfig.
+func LoadGateways() error {
+	prefixes, err := loadGatewayPrefixes(gofaxlib.Config.GatewayPrefix)
+	if err != nil {
+		return err
+	}
+	if strategy := gofaxlib.Config.Freeswitch.GatewayStrategy; strategy != "" && !gatewayStrategies[strategy] {
+		return fmt.Errorf("invalid gatewaystrategy %q", strategy)
+	}
+	gatewayPrefixes = prefixes
+	return nil
+}
+
+func loadGatewayPrefixes(sections map[string]*gofaxlib.GatewayPrefixConfig) ([]gatewayPrefix, error) {
+	prefixes := make([]gatewayPrefix, 0, len(sections))
+	for prefix, cfg := range sections {
+		if len(cfg.Gateway) == 0 {
+			return nil, fmt.Errorf("gatewayprefix %q: no gateway given", prefix)
+		}
+		if cfg.Strategy != "" && !gatewayStrategies[cfg.Strategy] {
+			return nil, fmt.Errorf("gatewayprefix %q: invalid strategy %q", prefix, cfg.Strategy)
+		}
+		prefixes = append(prefixes, gatewayPrefix{prefix, gatewayRoute{cfg.Gateway, cfg.Strategy}})
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i].prefix) != len(prefixes[j].prefix) {
+			return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+		}
+		return prefixes[i].prefix < prefixes[j].prefix
+	})
+	return prefixes, nil
+}
+
+// routeGateways returns the gateways to use for given number. The
+// default gateways are replaced by the longest matching prefix route.
+func routeGateways(prefixes []gatewayPrefix, number string, gateways []string) gatewayRoute {
+	route := gatewayRoute{gateways, gofaxlib.Config.Freeswitch.GatewayStrategy}
+	for _, p := range prefixes {
+		if strings.HasPrefix(number, p.prefix) {
+			route.gateways = p.route.gateways
+			if p.route.strategy != "" {
+				route.strategy = p.route.strategy
+			}
+			break
+		}
+	}
+	if route.strategy == "" {
+		route.strategy = strategyFailover
+	}
+	return route
+}
+
+// gatewayState is shared between gofaxsend processes
+type gatewayState struct {
+	// Round robin counters by list of gateways
+	RoundRobin map[string]uint64 `json:"roundrobin,omitempty"`
+	// Running calls
+	Calls []gatewayCall `json:"calls,omitempty"`
+	// Circuit breaker state by gateway
+	Health map[string]*gatewayHealth `json:"health,omitempty"`
+}
+
+type gatewayCall struct {
+	Gateway string    `json:"gateway"`
+	Pid     int       `json:"pid"`
+	Start   time.Time `json:"start"`
+}
+
+// active returns the number of running calls by gateway
+func (s *gatewayState) active() map[string]int {
+	active := make(map[string]int)
+	for _, call := range s.Calls {
+		active[call.Gateway]++
+	}
+	return active
+}
+
+func gatewayStateFilename() string {
+	return filepath.Join(gofaxlib.Config.Hylafax.Spooldir, gatewayStateFile)
+}
+
+// withGatewayState calls f with the shared state locked
+// and saves the state afterwards if f returns true
+func withGatewayState(f func(state *gatewayState) bool) error {
+	filename := gatewayStateFilename()
+	fh, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	if err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	state := &gatewayState{}
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, state); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	if state.RoundRobin == nil {
+		state.RoundRobin = make(map[string]uint64)
+	}
+
+	// Forget calls of processes which died without cleaning up
+	calls := state.Calls[:0]
+	for _, call := range state.Calls {
+		if err := syscall.Kill(call.Pid, 0); err == nil || err == syscall.EPERM {
+			calls = append(calls, call)
+		}
+	}
+	state.Calls = calls
+
+	if !f(state) {
+		return nil
+	}
+
+	if data, err = json.Marshal(state); err != nil {
+		return err
+	}
+	if err = fh.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = fh.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// orderGateways returns the gateways of the route in the order
+// they should be tried. Unless advance is set, the round robin
+// state is not changed, so the next call uses the same order.
+func orderGateways(route gatewayRoute, advance bool) ([]string, error) {
+	gateways := append([]string(nil), route.gateways...)
+	if len(gateways) < 2 {
+		return gateways, nil
+	}
+
+	switch route.strategy {
+	case strategyRoundRobin:
+		key := strings.Join(gateways, ",")
+		var counter uint64
+		err := withGatewayState(func(state *gatewayState) bool {
+			counter = state.RoundRobin[key]
+			if advance {
+				state.RoundRobin[key] = counter + 1
+			}
+			return advance
+		})
+		if err != nil {
+			return route.gateways, err
+		}
+		n := int(counter % uint64(len(gateways)))
+		gateways = append(gateways[n:], gateways[:n]...)
+
+	case strategyWeighted:
+		// Each process starts with the same seed otherwise
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		gateways = weightedOrder(gateways, gatewayWeight, random.Float64)
+
+	case strategyLeastActive:
+		var active map[string]int
+		err := withGatewayState(func(state *gatewayState) bool {
+			active = state.active()
+			return false
+		})
+		if err != nil {
+			return route.gateways, err
+		}
+		sort.SliceStable(gateways, func(i, j int) bool {
+			return active[gateways[i]] < active[gateways[j]]
+		})
+	}
+
+	return gateways, nil
+}
+
+// gatewayWeight returns the configured weight of a gateway
+func gatewayWeight(gateway string) uint {
+	if cfg, ok := gofaxlib.Config.Gateway[gateway]; ok && cfg.Weight != nil {
+		return *cfg.Weight
+	}
+	return 1
+}
+
+// weightedOrder orders gateways randomly, a gateway is chosen
+// before the others with a probability proportional to its weight.
+// Gateways with weight 0 are only used if all others fail.
+func weightedOrder(gateways []string, weight func(string) uint, random func() float64) []string {
+	remaining := append([]string(nil), gateways...)
+	ordered := make([]string, 0, len(gateways))
+	for len(remaining) > 0 {
+		var total uint
+		for _, gw := range remaining {
+			total += weight(gw)
+		}
+		if total == 0 {
+			break
+		}
+
+		r := random() * float64(total)
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			w := float64(weight(remaining[i]))
+			if r < w {
+				break
+			}
+			r -= w
+		}
+		for weight(remaining[i]) == 0 {
+			i--
+		}
+
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return append(ordered, remaining...)
+}
+
+// startGatewayCall registers a running call using given gateway.
+// The returned function has to be called when the call is finished.
+func startGatewayCall(gateway string) (func(), error) {
+	pid := os.Getpid()
+	err := withGatewayState(func(state *gatewayState) bool {
+		state.Calls = append(state.Calls, gatewayCall{gateway, pid, time.Now()})
+		return true
+	})
+	if err != nil {
+		return func() {}, err
+	}
+
+	return func() {
+		withGatewayState(func(state *gatewayState) bool {
+			for i, call := range state.Calls {
+				if call.Gateway == gateway && call.Pid == pid {
+					state.Calls = append(state.Calls[:i], state.Calls[i+1:]...)
+					break
+				}
+			}
+			return true
+		})
+	}, nil
+}
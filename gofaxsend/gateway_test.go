@@ -0,0 +1,124 @@
+package gofaxsend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupGatewayTest(t *testing.T) {
+	spooldir, err := ioutil.TempDir("", "gofaxsend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofaxlib.Config.Hylafax.Spooldir = spooldir
+	t.Cleanup(func() {
+		os.RemoveAll(spooldir)
+		gofaxlib.Config.Hylafax.Spooldir = ""
+		gofaxlib.Config.Freeswitch.GatewayStrategy = ""
+		gofaxlib.Config.Gateway = nil
+	})
+}
+
+func TestRouteGateways(t *testing.T) {
+	assert := assert.New(t)
+
+	prefixes, err := loadGatewayPrefixes(map[string]*gofaxlib.GatewayPrefixConfig{
+		"049":   {Gateway: []string{"de1", "de2"}, Strategy: strategyRoundRobin},
+		"04930": {Gateway: []string{"berlin"}},
+		"001":   {Gateway: []string{"us"}},
+	})
+	assert.NoError(err)
+
+	gofaxlib.Config.Freeswitch.GatewayStrategy = strategyLeastActive
+	defer func() { gofaxlib.Config.Freeswitch.GatewayStrategy = "" }()
+	defaults := []string{"default", "backup"}
+
+	assert.Equal(gatewayRoute{[]string{"berlin"}, strategyLeastActive}, routeGateways(prefixes, "0493012345", defaults))
+	assert.Equal(gatewayRoute{[]string{"de1", "de2"}, strategyRoundRobin}, routeGateways(prefixes, "0494012345", defaults))
+	assert.Equal(gatewayRoute{defaults, strategyLeastActive}, routeGateways(prefixes, "0044123", defaults))
+	assert.Equal(gatewayRoute{defaults, strategyLeastActive}, routeGateways(nil, "0493012345", defaults))
+
+	gofaxlib.Config.Freeswitch.GatewayStrategy = ""
+	assert.Equal(gatewayRoute{defaults, strategyFailover}, routeGateways(nil, "0493012345", defaults))
+
+	_, err = loadGatewayPrefixes(map[string]*gofaxlib.GatewayPrefixConfig{"049": {}})
+	assert.EqualError(err, `gatewayprefix "049": no gateway given`)
+	_, err = loadGatewayPrefixes(map[string]*gofaxlib.GatewayPrefixConfig{"049": {Gateway: []string{"a"}, Strategy: "random"}})
+	assert.EqualError(err, `gatewayprefix "049": invalid strategy "random"`)
+}
+
+func TestOrderGateways(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gateways := []string{"a", "b", "c"}
+
+	ordered, err := orderGateways(gatewayRoute{gateways, strategyFailover}, true)
+	assert.NoError(err)
+	assert.Equal(gateways, ordered)
+
+	// Round robin state is shared using the spool
+	for _, expected := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		ordered, err = orderGateways(gatewayRoute{gateways, strategyRoundRobin}, true)
+		assert.NoError(err)
+		assert.Equal(expected, ordered)
+	}
+	assert.Equal([]string{"a", "b", "c"}, gateways)
+
+	// Least active calls
+	endA, err := startGatewayCall("a")
+	assert.NoError(err)
+	endA2, err := startGatewayCall("a")
+	assert.NoError(err)
+	endC, err := startGatewayCall("c")
+	assert.NoError(err)
+	ordered, err = orderGateways(gatewayRoute{gateways, strategyLeastActive}, true)
+	assert.NoError(err)
+	assert.Equal([]string{"b", "c", "a"}, ordered)
+	endA()
+	endA2()
+	endC()
+	ordered, err = orderGateways(gatewayRoute{gateways, strategyLeastActive}, true)
+	assert.NoError(err)
+	assert.Equal(gateways, ordered)
+
+	// Calls of dead processes are removed
+	assert.NoError(withGatewayState(func(state *gatewayState) bool {
+		state.Calls = append(state.Calls, gatewayCall{Gateway: "a", Pid: 1 << 30})
+		return true
+	}))
+	assert.NoError(withGatewayState(func(state *gatewayState) bool {
+		assert.Empty(state.Calls)
+		return false
+	}))
+}
+
+func TestWeightedOrder(t *testing.T) {
+	assert := assert.New(t)
+	weights := map[string]uint{"a": 1, "b": 3, "c": 0}
+	weight := func(gw string) uint { return weights[gw] }
+	fixed := func(r float64) func() float64 { return func() float64 { return r } }
+	gateways := []string{"a", "b", "c"}
+
+	assert.Equal([]string{"a", "b", "c"}, weightedOrder(gateways, weight, fixed(0.1)))
+	assert.Equal([]string{"b", "a", "c"}, weightedOrder(gateways, weight, fixed(0.5)))
+	assert.Equal([]string{"b", "a", "c"}, weightedOrder(gateways, weight, fixed(0.99)))
+
+	// Weights from config
+	setupGatewayTest(t)
+	three := uint(3)
+	gofaxlib.Config.Gateway = map[string]*gofaxlib.GatewayConfig{"b": {Weight: &three}}
+	assert.EqualValues(3, gatewayWeight("b"))
+	assert.EqualValues(1, gatewayWeight("a"))
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		ordered, err := orderGateways(gatewayRoute{[]string{"a", "b"}, strategyWeighted}, true)
+		assert.NoError(err)
+		counts[ordered[0]]++
+	}
+	assert.InDelta(750, counts["b"], 100)
+}
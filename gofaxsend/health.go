@@ -0,0 +1,323 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
+)
+
+const defaultGatewayCooldown = 300
+
+// A half-open gateway is reserved for one call testing it. The reservation
+// expires in case gofaxsend ends before recording the result. FreeSWITCH
+// gives up originating a call after 60 seconds by default.
+const gatewayProbeTimeout = 2 * time.Minute
+
+// Hangup causes of failed originates caused by the gateway, not the destination
+var gatewayFailureCauses = map[string]bool{
+	"GATEWAY_DOWN":             true,
+	"NETWORK_OUT_OF_ORDER":     true,
+	"NORMAL_TEMPORARY_FAILURE": true,
+	"NO_ROUTE_TRANSIT_NET":     true,
+	"RECOVERY_ON_TIMER_EXPIRE": true,
+	"SERVICE_UNAVAILABLE":      true,
+	"SWITCH_CONGESTION":        true,
+}
+
+// Registration states of unavailable gateways as shown by sofia status
+var gatewayDownStates = map[string]bool{
+	"UNREGED":   true,
+	"FAILED":    true,
+	"FAIL_WAIT": true,
+	"EXPIRED":   true,
+	"TIMEOUT":   true,
+}
+
+// gatewayHealth is the circuit breaker state of a gateway
+type gatewayHealth struct {
+	// Consecutive failures
+	Failures    uint      `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	// The gateway is skipped until this time
+	OpenUntil time.Time `json:"open_until,omitempty"`
+	// A call is testing the half-open circuit until this time
+	ProbeUntil time.Time `json:"probe_until,omitempty"`
+}
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuit returns the circuit breaker state. After the cooldown, the
+// circuit is half-open: the next call is tried and closes it if successful.
+// Other calls skip the gateway while it is tested.
+func (h *gatewayHealth) circuit(now time.Time) string {
+	switch {
+	case h == nil || h.OpenUntil.IsZero():
+		return circuitClosed
+	case now.Before(h.OpenUntil):
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+func (s *gatewayState) health(gateway string) *gatewayHealth {
+	if s.Health == nil {
+		s.Health = make(map[string]*gatewayHealth)
+	}
+	h, ok := s.Health[gateway]
+	if !ok {
+		h = &gatewayHealth{}
+		s.Health[gateway] = h
+	}
+	return h
+}
+
+func gatewayCooldown() time.Duration {
+	if cooldown := gofaxlib.Config.Freeswitch.GatewayCooldown; cooldown > 0 {
+		return time.Duration(cooldown) * time.Second
+	}
+	return defaultGatewayCooldown * time.Second
+}
+
+// openCircuits returns the gateways which are currently skipped. Half-open
+// gateways are skipped while another call tests them. If probe is set, the
+// others are reserved for the caller and returned as probes, they have to be
+// released using endGatewayProbes.
+func openCircuits(gateways []string, probe bool) (open map[string]bool, probes []string, err error) {
+	open = make(map[string]bool)
+	now := time.Now()
+	err = withGatewayState(func(state *gatewayState) bool {
+		for _, gw := range gateways {
+			h := state.Health[gw]
+			switch h.circuit(now) {
+			case circuitOpen:
+				open[gw] = true
+			case circuitHalfOpen:
+				if now.Before(h.ProbeUntil) {
+					open[gw] = true
+				} else if probe {
+					h.ProbeUntil = now.Add(gatewayProbeTimeout)
+					probes = append(probes, gw)
+				}
+			}
+		}
+		return len(probes) > 0
+	})
+	if err != nil {
+		probes = nil
+	}
+	return open, probes, err
+}
+
+// endGatewayProbes releases half-open gateways reserved by openCircuits.
+// Their circuits stay half-open unless the result of the call was recorded.
+func endGatewayProbes(gateways []string) error {
+	if len(gateways) == 0 {
+		return nil
+	}
+	return withGatewayState(func(state *gatewayState) bool {
+		for _, gw := range gateways {
+			if h := state.Health[gw]; h != nil {
+				h.ProbeUntil = time.Time{}
+			}
+		}
+		return true
+	})
+}
+
+// recordGatewayFailure counts a failed call using given gateway. The circuit
+// is opened if GatewayMaxFailures consecutive calls failed, or immediately
+// if trip is set.
+func recordGatewayFailure(gateway string, reason string, trip bool) error {
+	maxFailures := gofaxlib.Config.Freeswitch.GatewayMaxFailures
+	now := time.Now()
+	return withGatewayState(func(state *gatewayState) bool {
+		h := state.health(gateway)
+		h.Failures++
+		h.LastError = reason
+		h.LastFailure = now
+		h.ProbeUntil = time.Time{}
+
+		if h.circuit(now) != circuitOpen && (trip || (maxFailures > 0 && h.Failures >= maxFailures)) {
+			h.OpenUntil = now.Add(gatewayCooldown())
+			logger.Logger.Printf("Gateway %v: circuit opened until %v after %d failures, last error: %v",
+				gateway, h.OpenUntil.Format(time.RFC3339), h.Failures, reason)
+		}
+		return true
+	})
+}
+
+// recordGatewaySuccess closes the circuit of given gateway
+func recordGatewaySuccess(gateway string) error {
+	now := time.Now()
+	return withGatewayState(func(state *gatewayState) bool {
+		h := state.health(gateway)
+		if h.circuit(now) != circuitClosed {
+			logger.Logger.Printf("Gateway %v: circuit closed", gateway)
+		}
+		h.Failures = 0
+		h.OpenUntil = time.Time{}
+		h.ProbeUntil = time.Time{}
+		h.LastSuccess = now
+		return true
+	})
+}
+
+// parseGatewayStatus checks the output of "sofia status gateway <name>"
+// and returns the reason if the gateway is unavailable
+func parseGatewayStatus(output string) (available bool, reason string) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			values[fields[0]] = fields[1]
+		}
+	}
+
+	if values["Name"] == "" {
+		// Unknown gateway
+		return false, strings.TrimSpace(output)
+	}
+	if status := values["Status"]; status == "DOWN" {
+		return false, "status " + status
+	}
+	if state := values["State"]; gatewayDownStates[state] {
+		return false, "state " + state
+	}
+	return true, ""
+}
+
+// GatewayStatus is the health of a gateway as shown by "gofaxsend gateways"
+type GatewayStatus struct {
+	Name        string
+	Circuit     string
+	Failures    uint
+	LastError   string
+	LastFailure time.Time
+	LastSuccess time.Time
+	OpenUntil   time.Time
+	ActiveCalls int
+}
+
+// configuredGateways returns the names of all gateways in the configuration
+func configuredGateways() []string {
+	names := append([]string(nil), gofaxlib.Config.Freeswitch.Gateway...)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+	}
+	var other []string
+	for name := range gofaxlib.Config.Gateway {
+		other = append(other, name)
+	}
+	for _, p := range gatewayPrefixes {
+		other = append(other, p.route.gateways...)
+	}
+	sort.Strings(other)
+	for _, name := range other {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// GatewayStatuses returns the state of all configured or used gateways
+func GatewayStatuses() ([]GatewayStatus, error) {
+	var statuses []GatewayStatus
+	now := time.Now()
+	view := withGatewayState
+	if _, err := os.Stat(gatewayStateFilename()); os.IsNotExist(err) {
+		// Don't create the file, it might get the wrong owner
+		view = func(f func(state *gatewayState) bool) error {
+			f(&gatewayState{})
+			return nil
+		}
+	}
+	err := view(func(state *gatewayState) bool {
+		names := configuredGateways()
+		for name := range state.Health {
+			names = append(names, name)
+		}
+		active := state.active()
+		for name := range active {
+			names = append(names, name)
+		}
+
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			status := GatewayStatus{Name: name, ActiveCalls: active[name]}
+			if h := state.Health[name]; h != nil {
+				status.Circuit = h.circuit(now)
+				status.Failures = h.Failures
+				status.LastError = h.LastError
+				status.LastFailure = h.LastFailure
+				status.LastSuccess = h.LastSuccess
+				status.OpenUntil = h.OpenUntil
+			} else {
+				status.Circuit = circuitClosed
+			}
+			statuses = append(statuses, status)
+		}
+		return false
+	})
+	return statuses, err
+}
+
+// ResetGateway closes the circuit of given gateway and clears its failures
+func ResetGateway(gateway string) error {
+	var found bool
+	if _, err := os.Stat(gatewayStateFilename()); os.IsNotExist(err) {
+		return fmt.Errorf("no state for gateway %v", gateway)
+	}
+	err := withGatewayState(func(state *gatewayState) bool {
+		if _, found = state.Health[gateway]; found {
+			delete(state.Health, gateway)
+		}
+		return found
+	})
+	if err == nil && !found {
+		return fmt.Errorf("no state for gateway %v", gateway)
+	}
+	if err == nil {
+		logger.Logger.Printf("Gateway %v: circuit reset", gateway)
+	}
+	return err
+}
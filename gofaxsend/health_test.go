@@ -0,0 +1,161 @@
+package gofaxsend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+const sofiaGatewayStatus = `=================================================================================================
+Name    	default
+Profile 	external
+Scheme  	Digest
+Realm   	sip.example.com
+Username	4930123
+Password	yes
+From    	<sip:4930123@sip.example.com>
+Contact 	<sip:gw+default@192.0.2.1:5080;transport=udp;gw=default>
+Exten   	4930123
+To      	sip:4930123@sip.example.com
+Proxy   	sip:sip.example.com
+Context 	public
+Expires 	3600
+Freq    	3600
+Ping    	1700000000
+PingFreq	0
+PingTime	0.00
+PingState	0/0/0
+State   	%s
+Status  	%s
+Uptime  	3600s
+CallsIN 	0
+CallsOUT	12
+=================================================================================================
+`
+
+func TestParseGatewayStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []struct {
+		state, status string
+		available     bool
+		reason        string
+	}{
+		{"REGED", "UP", true, ""},
+		{"NOREG", "UP", true, ""},
+		{"FAIL_WAIT", "UP", false, "state FAIL_WAIT"},
+		{"UNREGED", "UP", false, "state UNREGED"},
+		{"NOREG", "DOWN", false, "status DOWN"},
+	} {
+		available, reason := parseGatewayStatus(fmt.Sprintf(sofiaGatewayStatus, test.state, test.status))
+		assert.Equal(test.available, available, test.state)
+		assert.Equal(test.reason, reason)
+	}
+
+	available, reason := parseGatewayStatus("Invalid Gateway!\n")
+	assert.False(available)
+	assert.Equal("Invalid Gateway!", reason)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gofaxlib.Config.Freeswitch.GatewayMaxFailures = 2
+	gofaxlib.Config.Freeswitch.GatewayCooldown = 60
+	gofaxlib.Config.Freeswitch.Gateway = []string{"a", "b"}
+	defer func() {
+		gofaxlib.Config.Freeswitch.GatewayMaxFailures = 0
+		gofaxlib.Config.Freeswitch.GatewayCooldown = 0
+		gofaxlib.Config.Freeswitch.Gateway = nil
+	}()
+
+	// No state yet
+	statuses, err := GatewayStatuses()
+	assert.NoError(err)
+	assert.Equal([]GatewayStatus{{Name: "a", Circuit: circuitClosed}, {Name: "b", Circuit: circuitClosed}}, statuses)
+	assert.EqualError(ResetGateway("a"), "no state for gateway a")
+
+	// Opened after two failures
+	assert.NoError(recordGatewayFailure("a", "GATEWAY_DOWN", false))
+	open, _, err := openCircuits([]string{"a", "b"}, false)
+	assert.NoError(err)
+	assert.Empty(open)
+	assert.NoError(recordGatewayFailure("a", "NETWORK_OUT_OF_ORDER", false))
+	open, _, err = openCircuits([]string{"a", "b"}, false)
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"a": true}, open)
+
+	// Unavailable gateways are opened immediately
+	assert.NoError(recordGatewayFailure("b", "unavailable: state FAIL_WAIT", true))
+	open, _, err = openCircuits([]string{"a", "b"}, false)
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"a": true, "b": true}, open)
+
+	statuses, err = GatewayStatuses()
+	assert.NoError(err)
+	if assert.Len(statuses, 2) {
+		assert.Equal(circuitOpen, statuses[0].Circuit)
+		assert.EqualValues(2, statuses[0].Failures)
+		assert.Equal("NETWORK_OUT_OF_ORDER", statuses[0].LastError)
+		assert.WithinDuration(time.Now().Add(time.Minute), statuses[0].OpenUntil, 5*time.Second)
+	}
+
+	// Half-open after the cooldown, only one call tests the gateway
+	// and a failure opens it again
+	assert.NoError(withGatewayState(func(state *gatewayState) bool {
+		state.Health["a"].OpenUntil = time.Now().Add(-time.Second)
+		return true
+	}))
+	open, _, err = openCircuits([]string{"a"}, false)
+	assert.NoError(err)
+	assert.Empty(open)
+	open, probes, err := openCircuits([]string{"a"}, true)
+	assert.NoError(err)
+	assert.Empty(open)
+	assert.Equal([]string{"a"}, probes)
+	open, probes, err = openCircuits([]string{"a"}, true)
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"a": true}, open)
+	assert.Empty(probes)
+	assert.NoError(recordGatewayFailure("a", "GATEWAY_DOWN", false))
+	open, _, err = openCircuits([]string{"a"}, false)
+	assert.NoError(err)
+	assert.True(open["a"])
+
+	// The next call tests the gateway if the probe ended without result
+	// or did not end in time
+	assert.NoError(withGatewayState(func(state *gatewayState) bool {
+		state.Health["a"].OpenUntil = time.Now().Add(-time.Second)
+		return true
+	}))
+	_, probes, err = openCircuits([]string{"a"}, true)
+	assert.NoError(err)
+	assert.Equal([]string{"a"}, probes)
+	assert.NoError(endGatewayProbes(probes))
+	_, probes, err = openCircuits([]string{"a"}, true)
+	assert.NoError(err)
+	assert.Equal([]string{"a"}, probes)
+	assert.NoError(withGatewayState(func(state *gatewayState) bool {
+		state.Health["a"].ProbeUntil = time.Now().Add(-time.Second)
+		return true
+	}))
+	_, probes, err = openCircuits([]string{"a"}, true)
+	assert.NoError(err)
+	assert.Equal([]string{"a"}, probes)
+
+	// A successful call closes the circuit
+	assert.NoError(recordGatewaySuccess("a"))
+	statuses, err = GatewayStatuses()
+	assert.NoError(err)
+	assert.Equal(circuitClosed, statuses[0].Circuit)
+	assert.EqualValues(0, statuses[0].Failures)
+
+	// Reset by operator
+	assert.NoError(ResetGateway("b"))
+	open, _, err = openCircuits([]string{"a", "b"}, false)
+	assert.NoError(err)
+	assert.Empty(open)
+}
@@ -44,6 +44,7 @@ type Qfiler interface {
 	GetString(tag string) string
 	GetInt(tag string) (int, error)
 	Set(tag, value string)
+	SetAll(tag string, values []string)
 	Add(tag, value string)
 }
 
@@ -96,6 +97,26 @@ func OpenQfile(filename string) (*Qfile, error) {
 	return q, nil
 }
 
+// CreateQfile creates a new, empty queue file. It fails if
+// the file already exists. Tags are written using Write.
+func CreateQfile(filename string) (*Qfile, error) {
+	qfh, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, NewQfileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(qfh.Fd()), syscall.LOCK_EX); err != nil {
+		qfh.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+
+	return &Qfile{
+		filename: filename,
+		qfh:      qfh,
+	}, nil
+}
+
 // Close closes an open queue file
 func (q *Qfile) Close() error {
 	return q.qfh.Close()
@@ -175,6 +196,33 @@ func (q *Qfile) Set(tag string, value string) {
 	q.Add(tag, value)
 }
 
+// SetAll replaces all params with given tag by
+// params with given values. The new params are
+// inserted where the first existing param was found.
+func (q *Qfile) SetAll(tag string, values []string) {
+	params := make([]param, 0, len(q.params)+len(values))
+	inserted := false
+	for _, p := range q.params {
+		if p.Tag != tag {
+			params = append(params, p)
+			continue
+		}
+		if !inserted {
+			for _, value := range values {
+				params = append(params, param{tag, value})
+			}
+			inserted = true
+		}
+	}
+	q.params = params
+
+	if !inserted {
+		for _, value := range values {
+			q.Add(tag, value)
+		}
+	}
+}
+
 // Add adds a param with given tag and value. If the
 // tag already exists, a second one is added.
 func (q *Qfile) Add(tag string, value string) {
@@ -1,6 +1,9 @@
 package gofaxsend
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -51,6 +54,44 @@ func TestOpenQfile(t *testing.T) {
 	file.Set("baz", "foo")
 	assert.Equal("baz", file.GetString("foo"))
 
+	// Replace all values
+	file.Add("foo", "qux")
+	file.SetAll("foo", []string{"a", "b"})
+	assert.Equal([]string{"a", "b"}, file.GetAll("foo"))
+	file.SetAll("foo", nil)
+	assert.Empty(file.GetAll("foo"))
+	file.SetAll("foo", []string{"c"})
+	assert.Equal("c", file.GetString("foo"))
+
 	// Close
 	assert.NoError(file.Close())
 }
+
+func TestCreateQfile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gofaxsend")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "q1")
+
+	file, err := CreateQfile(filename)
+	if !assert.NoError(err) {
+		return
+	}
+	file.Set("jobid", "1")
+	file.Add("fax", "0::docq/doc1.tif")
+	file.Add("fax", "0::docq/doc2.tif")
+	assert.NoError(file.Write())
+	assert.NoError(file.Close())
+
+	// Existing files are not overwritten
+	_, err = CreateQfile(filename)
+	assert.True(os.IsExist(err))
+
+	file, err = OpenQfile(filename)
+	if assert.NoError(err) {
+		assert.Equal("1", file.GetString("jobid"))
+		assert.Equal([]string{"0::docq/doc1.tif", "0::docq/doc2.tif"}, file.GetAll("fax"))
+		file.Close()
+	}
+}
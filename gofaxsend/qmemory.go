@@ -57,6 +57,14 @@ func (q Qmemory) Set(tag, value string) {
 	q.params[tag] = []string{value}
 }
 
+func (q Qmemory) SetAll(tag string, values []string) {
+	if len(values) == 0 {
+		delete(q.params, tag)
+		return
+	}
+	q.params[tag] = append([]string(nil), values...)
+}
+
 func (q Qmemory) Add(tag, value string) {
 	existing, _ := q.params[tag]
 	q.params[tag] = append(existing, value)
@@ -63,6 +63,14 @@ func TestQmemory(t *testing.T) {
 	file.Set("baz", "foo")
 	assert.Equal("baz", file.GetString("foo"))
 
+	// Replace all values
+	file.Add("foo", "qux")
+	file.SetAll("foo", []string{"a", "b"})
+	assert.Equal([]string{"a", "b"}, file.GetAll("foo"))
+	file.SetAll("foo", nil)
+	assert.Empty(file.GetAll("foo"))
+	assert.Equal("", file.GetString("foo"))
+
 	// Write
 	assert.NoError(file.Write())
 }
@@ -0,0 +1,143 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+// Actions of retry policies
+var retryActions = map[string]SendResult{
+	"retry":       SendRetry,
+	"fail":        SendFailed,
+	"reformat":    SendReformat,
+	"v17fallback": SendV17fail,
+}
+
+// retryPolicy decides how a failed transmission is handled
+type retryPolicy struct {
+	name         string
+	hangupcauses map[string]bool
+	resultcodes  map[int]bool
+	resulttext   *regexp.Regexp
+	outcomes     map[gofaxlib.Outcome]bool
+
+	action string
+	result SendResult
+	// Seconds to wait before the next attempt
+	delay uint64
+}
+
+// Policies loaded by LoadRetryPolicies
+var retryPolicies []*retryPolicy
+
+// LoadRetryPolicies parses the [retrypolicy "..."] sections of the
+// configuration. It has to be called after gofaxlib.LoadConfig.
+func LoadRetryPolicies() error {
+	policies, err := loadRetryPolicies(gofaxlib.Config.RetryPolicy)
+	if err != nil {
+		return err
+	}
+	retryPolicies = policies
+	return nil
+}
+
+func loadRetryPolicies(sections map[string]*gofaxlib.RetryPolicyConfig) ([]*retryPolicy, error) {
+	// Sort section names so policies are tried in a stable order
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	policies := make([]*retryPolicy, 0, len(names))
+	for _, name := range names {
+		cfg := sections[name]
+
+		action := strings.ToLower(cfg.Action)
+		result, ok := retryActions[action]
+		if !ok {
+			return nil, fmt.Errorf("retrypolicy %q: invalid action %q", name, cfg.Action)
+		}
+		if len(cfg.Hangupcause) == 0 && len(cfg.Resultcode) == 0 && cfg.Resulttext == "" && len(cfg.Outcome) == 0 {
+			return nil, fmt.Errorf("retrypolicy %q: no hangupcause, resultcode, resulttext or outcome given", name)
+		}
+
+		policy := &retryPolicy{
+			name:         name,
+			hangupcauses: make(map[string]bool),
+			resultcodes:  make(map[int]bool),
+			outcomes:     make(map[gofaxlib.Outcome]bool),
+			action:       action,
+			result:       result,
+			delay:        cfg.Retrydelay,
+		}
+		for _, cause := range cfg.Hangupcause {
+			policy.hangupcauses[cause] = true
+		}
+		for _, code := range cfg.Resultcode {
+			policy.resultcodes[code] = true
+		}
+		for _, o := range cfg.Outcome {
+			outcome, ok := gofaxlib.Outcomes[strings.ToLower(o)]
+			if !ok {
+				return nil, fmt.Errorf("retrypolicy %q: invalid outcome %q", name, o)
+			}
+			policy.outcomes[outcome] = true
+		}
+		if cfg.Resulttext != "" {
+			re, err := regexp.Compile(cfg.Resulttext)
+			if err != nil {
+				return nil, fmt.Errorf("retrypolicy %q: %w", name, err)
+			}
+			policy.resulttext = re
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// matchRetryPolicy returns the first policy matching a failed transmission.
+// The result is nil if the call could not be established.
+func matchRetryPolicy(policies []*retryPolicy, hangupcause string, result *gofaxlib.FaxResult) *retryPolicy {
+	for _, policy := range policies {
+		if hangupcause != "" && policy.hangupcauses[hangupcause] {
+			return policy
+		}
+		if result == nil {
+			continue
+		}
+		if policy.resultcodes[result.ResultCode] {
+			return policy
+		}
+		if policy.outcomes[result.Outcome] {
+			return policy
+		}
+		if policy.resulttext != nil && policy.resulttext.MatchString(result.ResultText) {
+			return policy
+		}
+	}
+	return nil
+}
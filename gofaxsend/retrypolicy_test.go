@@ -0,0 +1,108 @@
+package gofaxsend
+
+import (
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gcfg.v1"
+)
+
+const testRetryPolicies = `
+[retrypolicy "busy"]
+hangupcause = USER_BUSY
+action = retry
+retrydelay = 300
+
+[retrypolicy "unobtainable"]
+hangupcause = UNALLOCATED_NUMBER
+hangupcause = NO_ROUTE_DESTINATION
+action = fail
+
+[retrypolicy "nofax"]
+resultcode = 2
+resulttext = (?i)not a fax machine
+action = Fail
+
+[retrypolicy "training"]
+resulttext = ^Failed to train
+action = v17fallback
+
+[retrypolicy "partial"]
+outcome = partial
+outcome = Line_Error
+action = retry
+retrydelay = 60
+`
+
+func TestRetryPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	var cfg struct {
+		RetryPolicy map[string]*gofaxlib.RetryPolicyConfig
+	}
+	assert.NoError(gcfg.ReadStringInto(&cfg, testRetryPolicies))
+
+	policies, err := loadRetryPolicies(cfg.RetryPolicy)
+	assert.NoError(err)
+	if !assert.Len(policies, 5) {
+		return
+	}
+
+	// Sorted by name
+	assert.Equal("busy", policies[0].name)
+	assert.Equal("nofax", policies[1].name)
+
+	for _, test := range []struct {
+		hangupcause string
+		result      *gofaxlib.FaxResult
+		policy      string
+		returned    SendResult
+	}{
+		{"USER_BUSY", nil, "busy", SendRetry},
+		{"NO_ROUTE_DESTINATION", nil, "unobtainable", SendFailed},
+		{"NORMAL_TEMPORARY_FAILURE", nil, "", 0},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 2}, "nofax", SendFailed},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 99, ResultText: "Far end is NOT a fax machine"}, "nofax", SendFailed},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 99, ResultText: "Failed to train with any of the compatible modems"}, "training", SendV17fail},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 99, ResultText: "Disconnected after permitted retries"}, "", 0},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 49, Outcome: gofaxlib.OutcomePartial}, "partial", SendRetry},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 26, Outcome: gofaxlib.OutcomeLineError}, "partial", SendRetry},
+		{"NORMAL_CLEARING", &gofaxlib.FaxResult{ResultCode: 41, Outcome: gofaxlib.OutcomeLocalError}, "", 0},
+	} {
+		policy := matchRetryPolicy(policies, test.hangupcause, test.result)
+		if test.policy == "" {
+			assert.Nil(policy)
+			continue
+		}
+		if assert.NotNil(policy, test.policy) {
+			assert.Equal(test.policy, policy.name)
+			assert.Equal(test.returned, policy.result)
+		}
+	}
+	assert.EqualValues(300, policies[0].delay)
+}
+
+func TestRetryPoliciesInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := loadRetryPolicies(map[string]*gofaxlib.RetryPolicyConfig{
+		"x": {Hangupcause: []string{"USER_BUSY"}, Action: "later"},
+	})
+	assert.EqualError(err, `retrypolicy "x": invalid action "later"`)
+
+	_, err = loadRetryPolicies(map[string]*gofaxlib.RetryPolicyConfig{
+		"x": {Action: "retry"},
+	})
+	assert.EqualError(err, `retrypolicy "x": no hangupcause, resultcode, resulttext or outcome given`)
+
+	_, err = loadRetryPolicies(map[string]*gofaxlib.RetryPolicyConfig{
+		"x": {Outcome: []string{"busy"}, Action: "retry"},
+	})
+	assert.EqualError(err, `retrypolicy "x": invalid outcome "busy"`)
+
+	_, err = loadRetryPolicies(map[string]*gofaxlib.RetryPolicyConfig{
+		"x": {Resulttext: "(", Action: "retry"},
+	})
+	assert.Error(err)
+}
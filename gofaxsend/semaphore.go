@@ -0,0 +1,143 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+const (
+	// Lock files of the semaphores, relative to the spool directory
+	semaphoreDir = "gofaxsend.locks"
+
+	defaultLimitRetryDelay = 60
+)
+
+// acquireSlot takes one of limit slots of the named semaphore shared by
+// all gofaxsend processes. A slot is a locked file, so it is released
+// when the process exits. The result is nil if all slots are taken.
+func acquireSlot(name string, limit uint) (*os.File, error) {
+	dir := filepath.Join(gofaxlib.Config.Hylafax.Spooldir, semaphoreDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for i := uint(0); i < limit; i++ {
+		filename := filepath.Join(dir, fmt.Sprintf("%s.%d", url.PathEscape(name), i))
+		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			return f, nil
+		}
+		f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// callSlots are the semaphore slots held for a call
+type callSlots struct {
+	mu       sync.Mutex
+	gateways map[string]*os.File
+	other    []*os.File
+}
+
+// acquireCallSlots takes the slots for a call to given destination using
+// the given gateways. Gateways without a free slot are removed from the
+// returned list. If the call is not possible, reason is set.
+func acquireCallSlots(destination string, gateways []string) (slots *callSlots, available []string, reason string, err error) {
+	slots = &callSlots{gateways: make(map[string]*os.File)}
+
+	if limit := gofaxlib.Config.Gofaxsend.MaxCallsPerDestination; limit > 0 {
+		f, err := acquireSlot("destination-"+destination, limit)
+		if err != nil {
+			return slots, gateways, "", err
+		}
+		if f == nil {
+			return slots, nil, fmt.Sprintf("Too many calls to %v", destination), nil
+		}
+		slots.other = append(slots.other, f)
+	}
+
+	for _, gw := range gateways {
+		cfg, ok := gofaxlib.Config.Gateway[gw]
+		if !ok || cfg.MaxCalls == 0 {
+			available = append(available, gw)
+			continue
+		}
+		f, err := acquireSlot("gateway-"+gw, cfg.MaxCalls)
+		if err != nil {
+			slots.release()
+			return slots, gateways, "", err
+		}
+		if f != nil {
+			slots.gateways[gw] = f
+			available = append(available, gw)
+		}
+	}
+	if len(available) == 0 {
+		slots.release()
+		return slots, nil, "All channels of the gateways are in use", nil
+	}
+
+	return slots, available, "", nil
+}
+
+// keepGateway releases the slots of all gateways except the one used for the call
+func (s *callSlots) keepGateway(gateway string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for gw, f := range s.gateways {
+		if gw != gateway {
+			f.Close()
+			delete(s.gateways, gw)
+		}
+	}
+}
+
+// release releases all slots
+func (s *callSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for gw, f := range s.gateways {
+		f.Close()
+		delete(s.gateways, gw)
+	}
+	for _, f := range s.other {
+		f.Close()
+	}
+	s.other = nil
+}
+
+func limitRetryDelay() int64 {
+	if delay := gofaxlib.Config.Gofaxsend.LimitRetryDelay; delay > 0 {
+		return int64(delay)
+	}
+	return defaultLimitRetryDelay
+}
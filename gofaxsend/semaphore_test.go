@@ -0,0 +1,124 @@
+package gofaxsend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireSlot(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+
+	first, err := acquireSlot("gateway-a/b", 2)
+	assert.NoError(err)
+	assert.NotNil(first)
+	second, err := acquireSlot("gateway-a/b", 2)
+	assert.NoError(err)
+	assert.NotNil(second)
+
+	// All slots taken
+	third, err := acquireSlot("gateway-a/b", 2)
+	assert.NoError(err)
+	assert.Nil(third)
+
+	// Closing the file releases the slot
+	first.Close()
+	third, err = acquireSlot("gateway-a/b", 2)
+	assert.NoError(err)
+	assert.NotNil(third)
+	second.Close()
+	third.Close()
+}
+
+func TestAcquireCallSlots(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gofaxlib.Config.Gofaxsend.MaxCallsPerDestination = 1
+	gofaxlib.Config.Gateway = map[string]*gofaxlib.GatewayConfig{
+		"a": {MaxCalls: 1},
+		"b": {MaxCalls: 2},
+	}
+	defer func() { gofaxlib.Config.Gofaxsend.MaxCallsPerDestination = 0 }()
+
+	call1, available, reason, err := acquireCallSlots("4940123", []string{"a", "b", "c"})
+	assert.NoError(err)
+	assert.Empty(reason)
+	assert.Equal([]string{"a", "b", "c"}, available)
+
+	// Only one call per destination
+	call2, available, reason, err := acquireCallSlots("4940123", []string{"a", "b", "c"})
+	assert.NoError(err)
+	assert.Equal("Too many calls to 4940123", reason)
+	assert.Nil(available)
+	call2.release()
+
+	// Gateway a is full
+	call2, available, reason, err = acquireCallSlots("4940456", []string{"a", "b"})
+	assert.NoError(err)
+	assert.Empty(reason)
+	assert.Equal([]string{"b"}, available)
+
+	call3, available, reason, err := acquireCallSlots("4940789", []string{"a", "b"})
+	assert.NoError(err)
+	assert.Equal("All channels of the gateways are in use", reason)
+	assert.Nil(available)
+	call3.release()
+
+	// The first call was established using gateway b
+	call1.keepGateway("b")
+	call3, available, reason, err = acquireCallSlots("4940789", []string{"a", "b"})
+	assert.NoError(err)
+	assert.Empty(reason)
+	assert.Equal([]string{"a"}, available)
+
+	call1.release()
+	call2.release()
+	call3.release()
+	call1, available, _, err = acquireCallSlots("4940123", []string{"a", "b"})
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, available)
+	call1.release()
+}
+
+func TestSendQfileDestinationLimit(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	gofaxlib.Config.Freeswitch.Gateway = []string{"carrier"}
+	gofaxlib.Config.Gofaxsend.CallPrefix = "9"
+	gofaxlib.Config.Gofaxsend.MaxCallsPerDestination = 1
+	defer func() {
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		gofaxlib.Config.Gofaxsend.CallPrefix = ""
+		gofaxlib.Config.Gofaxsend.MaxCallsPerDestination = 0
+	}()
+
+	// Destinations are limited by the number without callprefix
+	slot, err := acquireSlot("destination-04012345", 1)
+	must(t, err)
+	defer slot.Close()
+
+	document, err := filepath.Abs("testdata/pages,3.tif")
+	must(t, err)
+	spooldir := gofaxlib.Config.Hylafax.Spooldir
+	must(t, os.Mkdir(filepath.Join(spooldir, "log"), 0755))
+	wd, err := os.Getwd()
+	must(t, err)
+	must(t, os.Chdir(spooldir))
+	defer os.Chdir(wd)
+
+	qf := NewQmemory(map[string][]string{
+		"jobid":    {"1"},
+		"external": {"04012345"},
+		"number":   {"04012345"},
+		"fax":      {"0::" + document},
+	})
+	returned, _, err := SendQfileContext(context.Background(), qf, "modem")
+	assert.NoError(err)
+	assert.Equal(SendRetry, returned)
+	assert.Regexp(`^Too many calls to 04012345, retrying in \d+ seconds$`, qf.GetString("status"))
+}
@@ -18,14 +18,19 @@
 package gofaxsend
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/gonicus/gofaxip/gofaxlib/logger"
 )
 
 const (
@@ -54,8 +59,39 @@ func SendQfileFromDisk(filename, deviceID string) (SendResult, error) {
 	return SendQfile(qf, deviceID)
 }
 
-// SendQfile immediately tries to send the given qfile using FreeSWITCH
-func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
+// SendQfile immediately tries to send the given qfile using FreeSWITCH.
+// The call is hung up if the process receives SIGTERM or SIGINT, the job
+// is then returned as SendRetry so faxq can requeue it.
+func SendQfile(qf Qfiler, deviceID string) (SendResult, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigchan)
+	go func() {
+		select {
+		case sig := <-sigchan:
+			logger.Logger.Printf("gofaxsend received signal %v, cancelling transmission", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	returned, _, err := SendQfileContext(ctx, qf, deviceID)
+	return returned, err
+}
+
+// SendQfileContext immediately tries to send the given qfile using FreeSWITCH.
+// The call is hung up when ctx is cancelled. The result of the transmission
+// is returned if a call was established. Invalid queue files are reported
+// as FaxError without retry, other errors are local problems.
+func SendQfileContext(ctx context.Context, qf Qfiler, deviceID string) (SendResult, *gofaxlib.FaxResult, error) {
+	return sendQfile(ctx, qf, deviceID, nil)
+}
+
+// sendQfile sends the given qfile. If dry is set, the call is only prepared.
+func sendQfile(ctx context.Context, qf Qfiler, deviceID string, dry *dryRun) (returned SendResult, result *gofaxlib.FaxResult, err error) {
 	returned = SendFailed
 
 	var jobid uint
@@ -66,13 +102,12 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 	}
 
 	if jobid == 0 {
-		err = fmt.Errorf("Error parsing jobid")
+		err = NewFaxError("Error parsing jobid", false)
 		return
 	}
 
 	// Create FaxJob structure
 	faxjob := NewFaxJob()
-	faxjob.Number = fmt.Sprint(gofaxlib.Config.Gofaxsend.CallPrefix, qf.GetString("external"))
 	faxjob.Cidnum = gofaxlib.Config.Gofaxsend.FaxNumber //qf.GetString("faxnumber")
 	faxjob.Ident = gofaxlib.Config.Freeswitch.Ident
 	faxjob.Header = gofaxlib.Config.Freeswitch.Header
@@ -91,13 +126,13 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 	// Add TIFFs from queue file
 	faxparts := qf.GetAll("fax")
 	if len(faxparts) == 0 {
-		err = fmt.Errorf("No fax file(s) found in qfile")
+		err = NewFaxError("No fax file(s) found in qfile", false)
 		return
 	}
 	faxfile := FaxFile{}
 	for _, fileentry := range faxparts {
-		err = faxfile.AddItem(fileentry)
-		if err != nil {
+		if e := faxfile.AddItem(fileentry); e != nil {
+			err = NewFaxError(e.Error(), false)
 			return
 		}
 	}
@@ -106,17 +141,39 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 	faxjob.Filename = filepath.Join(os.TempDir(), "gofaxsend_"+faxjob.UUID.String()+".tif")
 	defer os.Remove(faxjob.Filename)
 	if err = faxfile.WriteTo(faxjob.Filename); err != nil {
-		return
+		errmsg := fmt.Sprint("Error preparing document: ", err)
+		logger.Logger.Printf("Job %d: %s", jobid, errmsg)
+		qf.Set("returned", strconv.Itoa(int(SendFailed)))
+		qf.Set("status", errmsg)
+		if err = qf.Write(); err != nil {
+			logger.Logger.Println("Error updating qfile:", err)
+		}
+		// Documents are not going to change, so don't retry
+		return SendFailed, nil, nil
 	}
 
 	// Start communication session and open logfile
-	sessionlog, err := gofaxlib.NewSessionLogger(jobid)
-	if err != nil {
+	var sessionlog gofaxlib.SessionLogger
+	if dry != nil {
+		sessionlog = dry.log()
+	} else if sessionlog, err = gofaxlib.NewSessionLogger(jobid); err != nil {
 		return
 	}
 	qf.Set("commid", sessionlog.CommID())
 	sessionlog.Logf("Processing hylafax commid %s as freeswitch call %v", sessionlog.CommID(), faxjob.UUID)
 
+	// Pages sent in previous attempts were removed from the fax entries
+	sentPages, _ := qf.GetInt("npages")
+	if sentPages > 0 {
+		sessionlog.Logf("Resuming transmission with page %d, %d pages were sent before", sentPages+1, sentPages)
+	}
+
+	callPrefix := gofaxlib.Config.Gofaxsend.CallPrefix
+	// Gateways set by DynamicConfig are not replaced by prefix routes
+	var dcGateways bool
+
+	faxjob.SIPHeaders = jobSIPHeaders(qf)
+
 	// Query DynamicConfig
 	if dcCmd := gofaxlib.Config.Gofaxsend.DynamicConfig; dcCmd != "" {
 		sessionlog.Log("Calling DynamicConfig script", dcCmd)
@@ -130,7 +187,7 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 				sessionlog.Logf("Error updating qfile:", err)
 			}
 			// Retry, as this is an internal error executing the DynamicConfig script which could recover later
-			return SendRetry, nil
+			return SendRetry, nil, nil
 		}
 
 		// Check if call should be rejected
@@ -142,7 +199,7 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 			if err = qf.Write(); err != nil {
 				sessionlog.Logf("Error updating qfile:", err)
 			}
-			return SendFailed, nil
+			return SendFailed, nil, nil
 		}
 
 		// Check if a custom identifier should be set
@@ -155,7 +212,7 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 		}
 
 		if prefix := dc.GetString("CallPrefix"); prefix != "" {
-			faxjob.Number = fmt.Sprint(prefix, qf.GetString("external"))
+			callPrefix = prefix
 		}
 
 		if faxnumber := dc.GetString("FAXNumber"); faxnumber != "" {
@@ -164,10 +221,90 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 
 		if gatewayString := dc.GetString("Gateway"); gatewayString != "" {
 			faxjob.Gateways = strings.Split(gatewayString, ",")
+			dcGateways = true
+		}
+
+		// Add or override SIP headers, empty values remove them
+		for _, header := range dc.GetAll("SIPHeader") {
+			name, value, err := parseSIPHeader(header)
+			if err != nil {
+				sessionlog.Logf("Ignoring SIPHeader %q from DynamicConfig: %v", header, err)
+			} else if value == "" {
+				delete(faxjob.SIPHeaders, name)
+			} else {
+				faxjob.SIPHeaders[name] = value
+			}
 		}
 
 	}
 
+	if len(faxjob.SIPHeaders) > 0 {
+		sessionlog.Logf("SIP headers: %s", formatSIPHeaders(faxjob.SIPHeaders))
+	}
+
+	// Normalize destination number
+	var e164 string
+	if dialplan != nil {
+		if e164, err = dialplan.Normalize(qf.GetString("external")); err != nil {
+			errmsg := fmt.Sprint("Error in destination number: ", err)
+			sessionlog.Log(errmsg)
+			qf.Set("returned", strconv.Itoa(int(SendFailed)))
+			qf.Set("status", errmsg)
+			if err = qf.Write(); err != nil {
+				sessionlog.Log("Error updating qfile:", err)
+			}
+			return SendFailed, nil, nil
+		}
+		faxjob.Number = callPrefix + dialplan.Dial(e164, "")
+		sessionlog.Logf("Normalized destination %v to %v", qf.GetString("external"), e164)
+	} else {
+		faxjob.Number = fmt.Sprint(callPrefix, qf.GetString("external"))
+	}
+
+	// Check if the destination may be dialed now. Destinations are matched
+	// without callprefix, as E.164 number if a dial plan is configured.
+	destination := qf.GetString("external")
+	if e164 != "" {
+		destination = e164
+	}
+	if window := matchSendWindow(sendWindows, destination); window != nil {
+		if allowed, next := window.check(time.Now()); !allowed {
+			status := fmt.Sprintf("Outside of sending window %q for this destination", window.name)
+			if !next.IsZero() {
+				status += fmt.Sprintf(", next attempt at %v", next.Format("2006-01-02 15:04 MST"))
+				qf.Set("tts", strconv.FormatInt(next.Unix(), 10))
+			}
+			sessionlog.Log(status)
+			qf.Set("returned", strconv.Itoa(int(SendRetry)))
+			qf.Set("status", status)
+			if err = qf.Write(); err != nil {
+				sessionlog.Log("Error updating qfile:", err)
+			}
+			return SendRetry, nil, nil
+		}
+	}
+
+	// Select gateways
+	prefixes := gatewayPrefixes
+	if dcGateways {
+		prefixes = nil
+	}
+	route := routeGateways(prefixes, destination, faxjob.Gateways)
+	gateways, gwErr := orderGateways(route, dry == nil)
+	if gwErr != nil {
+		sessionlog.Log("Error ordering gateways:", gwErr)
+	}
+	faxjob.Gateways = gateways
+	sessionlog.Logf("Using gateways %v (strategy %v)", strings.Join(faxjob.Gateways, ","), route.strategy)
+
+	// Gateways can expect different number formats
+	if dialplan != nil {
+		faxjob.GatewayNumbers = make(map[string]string)
+		for _, gw := range faxjob.Gateways {
+			faxjob.GatewayNumbers[gw] = callPrefix + dialplan.Dial(e164, gw)
+		}
+	}
+
 	switch gofaxlib.Config.Gofaxsend.CidName {
 	case "sender":
 		faxjob.Cidname = qf.GetString("sender")
@@ -204,29 +341,85 @@ func SendQfile(qf Qfiler, deviceID string) (returned SendResult, err error) {
 		faxjob.UseECM = false
 	}
 
+	if dry != nil {
+		if faxerr := dry.preview(faxjob, sessionlog); faxerr != nil {
+			if faxerr.Retry() {
+				returned = SendRetry
+			}
+			qf.Set("status", faxerr.Error())
+		}
+		return returned, nil, nil
+	}
+
+	// Concurrency limits for gateways and destination
+	slots, available, reason, slotErr := acquireCallSlots(destination, faxjob.Gateways)
+	defer slots.release()
+	if slotErr != nil {
+		sessionlog.Log("Error acquiring call slots:", slotErr)
+	}
+	if reason != "" {
+		delay := limitRetryDelay()
+		status := fmt.Sprintf("%s, retrying in %d seconds", reason, delay)
+		sessionlog.Log(status)
+		qf.Set("tts", strconv.FormatInt(time.Now().Unix()+delay, 10))
+		qf.Set("returned", strconv.Itoa(int(SendRetry)))
+		qf.Set("status", status)
+		if err = qf.Write(); err != nil {
+			sessionlog.Log("Error updating qfile:", err)
+		}
+		return SendRetry, nil, nil
+	}
+	faxjob.Gateways = available
+
 	// Update status
 	qf.Set("status", "Dialing")
 	totdials++
 	qf.Set("totdials", strconv.Itoa(totdials))
 	if err = qf.Write(); err != nil {
 		sessionlog.Log("Error updating qfile:", err)
-		return SendFailed, nil
+		return SendFailed, nil, nil
 	}
 	// Default: Retry when transmission fails
 	returned = SendRetry
 
+	// Count running calls by gateway for the leastactive strategy,
+	// using the gateway which answered the call
+	var callMu sync.Mutex
+	var endCall func()
+	defer func() {
+		callMu.Lock()
+		defer callMu.Unlock()
+		if endCall != nil {
+			endCall()
+		}
+		// Don't register calls connected after returning
+		endCall = func() {}
+	}()
+	connected := func(gateway string) {
+		slots.keepGateway(gateway)
+		callMu.Lock()
+		defer callMu.Unlock()
+		if endCall != nil {
+			return
+		}
+		var callErr error
+		if endCall, callErr = startGatewayCall(gateway); callErr != nil {
+			sessionlog.Log("Error registering call:", callErr)
+		}
+	}
+
 	// Start transmission goroutine
 	transmitTs := time.Now()
-	t := transmit(*faxjob, sessionlog)
-	var result *gofaxlib.FaxResult
+	t := transmit(ctx, *faxjob, sessionlog, connected)
 	var status string
+	var hangupcause string
 
 	// Wait for events
 StatusLoop:
 	for {
 		select {
 		case page := <-t.PageSent():
-			qf.Set("npages", strconv.Itoa(int(page.Page)))
+			qf.Set("npages", strconv.Itoa(sentPages+int(page.Page)))
 			qf.Set("dataformat", page.EncodingName)
 			if err = qf.Write(); err != nil {
 				sessionlog.Log("Error updating qfile:", err)
@@ -265,6 +458,7 @@ StatusLoop:
 			ndials++
 			qf.Set("ndials", strconv.Itoa(ndials))
 			status = faxerr.Error()
+			hangupcause = errorHangupcause(faxerr)
 			if faxerr.Retry() {
 				returned = SendRetry
 			} else {
@@ -274,6 +468,37 @@ StatusLoop:
 		}
 	}
 
+	// Classify failed transmissions using the configured policies
+	if returned != SendDone {
+		if result != nil {
+			hangupcause = result.Hangupcause
+		}
+		if policy := matchRetryPolicy(retryPolicies, hangupcause, result); policy != nil {
+			returned = policy.result
+			sessionlog.Logf("Retry policy %q matched, action: %v", policy.name, policy.action)
+			if returned == SendV17fail {
+				// Also disable V.17 if faxq does not handle this itself
+				qf.Set("desiredbr", "4")
+			}
+			if policy.delay > 0 && returned != SendFailed {
+				qf.Set("tts", strconv.FormatInt(time.Now().Unix()+int64(policy.delay), 10))
+			}
+		}
+	}
+
+	// Don't send pages again which were confirmed by the remote side.
+	// There is a page result for every phase D exchange, including retrained pages.
+	if (returned == SendRetry || returned == SendV17fail) && result != nil && result.TransferredPages > 0 {
+		remaining, done, skipped := faxfile.SkipPages(result.TransferredPages)
+		qf.SetAll("fax", remaining)
+		// faxq only removes documents listed in the queue file
+		if err := removeDocuments(done, remaining); err != nil {
+			sessionlog.Log("Error removing sent documents:", err)
+		}
+		qf.Set("npages", strconv.Itoa(sentPages+int(skipped)))
+		sessionlog.Logf("%d pages sent, next attempt resumes with %v", skipped, remaining)
+	}
+
 	qf.Set("status", status)
 	qf.Set("returned", strconv.Itoa(int(returned)))
 	if err = qf.Write(); err != nil {
@@ -288,12 +513,13 @@ StatusLoop:
 	xfl.Sender = qf.GetString("mailaddr")
 	xfl.Destnum = qf.GetString("number")
 	xfl.Owner = qf.GetString("owner")
+	xfl.CallID = formatSIPHeaders(faxjob.SIPHeaders)
 
 	if result != nil {
 		if result.Success {
 			sessionlog.Logf("Fax sent successfully. Hangup Cause: %v. Result: %v", result.Hangupcause, status)
 		} else {
-			sessionlog.Logf("Fax failed. Retry: %v. Hangup Cause: %v. Result: %v", returned == SendRetry, result.Hangupcause, status)
+			sessionlog.Logf("Fax failed (%v). Retry: %v. Hangup Cause: %v. Result: %v", result.Outcome, returned == SendRetry, result.Hangupcause, status)
 		}
 		xfl.SetResult(result)
 	} else {
@@ -307,5 +533,5 @@ StatusLoop:
 		sessionlog.Log(err)
 	}
 
-	return returned, nil
+	return returned, result, nil
 }
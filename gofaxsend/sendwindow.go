@@ -0,0 +1,218 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// sendWindow restricts the times destinations may be dialed
+type sendWindow struct {
+	name     string
+	prefixes []string
+	location *time.Location
+	days     [7]bool
+	// Minutes since midnight, ranges ending before they
+	// start continue on the next day
+	ranges []timeRange
+}
+
+type timeRange struct {
+	start, end int
+}
+
+// Windows loaded by LoadSendWindows
+var sendWindows []*sendWindow
+
+// LoadSendWindows loads the [sendwindow "..."] sections of the
+// configuration. It has to be called after gofaxlib.LoadConfig.
+func LoadSendWindows() error {
+	windows, err := loadSendWindows(gofaxlib.Config.SendWindow)
+	if err != nil {
+		return err
+	}
+	sendWindows = windows
+	return nil
+}
+
+func loadSendWindows(sections map[string]*gofaxlib.SendWindowConfig) ([]*sendWindow, error) {
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	windows := make([]*sendWindow, 0, len(names))
+	for _, name := range names {
+		cfg := sections[name]
+		w := &sendWindow{
+			name:     name,
+			prefixes: cfg.Prefix,
+			location: time.Local,
+		}
+
+		if cfg.Timezone != "" {
+			location, err := time.LoadLocation(cfg.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("sendwindow %q: %w", name, err)
+			}
+			w.location = location
+		}
+
+		if err := w.parseDays(cfg.Days); err != nil {
+			return nil, fmt.Errorf("sendwindow %q: %w", name, err)
+		}
+
+		if len(cfg.Hours) == 0 {
+			return nil, fmt.Errorf("sendwindow %q: no hours given", name)
+		}
+		for _, hours := range cfg.Hours {
+			r, err := parseTimeRange(hours)
+			if err != nil {
+				return nil, fmt.Errorf("sendwindow %q: %w", name, err)
+			}
+			w.ranges = append(w.ranges, r)
+		}
+
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+// parseDays parses a list of days or ranges of days, i.e. "mon-fri,sun".
+// All days are allowed if the list is empty.
+func (w *sendWindow) parseDays(days string) error {
+	if strings.TrimSpace(days) == "" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(days, ",") {
+		bounds := strings.SplitN(strings.ToLower(strings.TrimSpace(part)), "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("invalid day %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("invalid day %q", part)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeRange parses a range like "08:00-18:00"
+func parseTimeRange(hours string) (timeRange, error) {
+	bounds := strings.SplitN(hours, "-", 2)
+	if len(bounds) != 2 {
+		return timeRange{}, fmt.Errorf("invalid hours %q", hours)
+	}
+	var r timeRange
+	for i, bound := range bounds {
+		var h, m int
+		var rest string
+		if n, _ := fmt.Sscanf(strings.TrimSpace(bound), "%d:%d%s", &h, &m, &rest); n != 2 ||
+			h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+			return timeRange{}, fmt.Errorf("invalid hours %q", hours)
+		}
+		if i == 0 {
+			r.start = 60*h + m
+		} else {
+			r.end = 60*h + m
+		}
+	}
+	if r.start == r.end {
+		return timeRange{}, fmt.Errorf("empty hours %q", hours)
+	}
+	return r, nil
+}
+
+// matchSendWindow returns the window for given number. The window with
+// the longest matching prefix is used, windows without prefix match all numbers.
+func matchSendWindow(windows []*sendWindow, number string) *sendWindow {
+	var match *sendWindow
+	length := -1
+	for _, w := range windows {
+		if len(w.prefixes) == 0 && length < 0 {
+			match, length = w, 0
+		}
+		for _, prefix := range w.prefixes {
+			if strings.HasPrefix(number, prefix) && len(prefix) > length {
+				match, length = w, len(prefix)
+			}
+		}
+	}
+	return match
+}
+
+// check returns true if dialing is allowed at given time.
+// Otherwise the next time dialing is allowed is returned.
+func (w *sendWindow) check(now time.Time) (bool, time.Time) {
+	local := now.In(w.location)
+	var next time.Time
+
+	// Start with the day before for ranges ending on the next day
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, w.location)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		for _, r := range w.ranges {
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, r.start, 0, 0, w.location)
+			endDay := day.Day()
+			if r.end <= r.start {
+				endDay++
+			}
+			end := time.Date(day.Year(), day.Month(), endDay, 0, r.end, 0, 0, w.location)
+
+			if !now.Before(start) && now.Before(end) {
+				return true, time.Time{}
+			}
+			if start.After(now) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return false, next
+}
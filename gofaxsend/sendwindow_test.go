@@ -0,0 +1,83 @@
+package gofaxsend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendWindows(t *testing.T) {
+	assert := assert.New(t)
+
+	windows, err := loadSendWindows(map[string]*gofaxlib.SendWindowConfig{
+		"default":  {Hours: []string{"07:00-22:00"}, Timezone: "UTC"},
+		"germany":  {Prefix: []string{"49"}, Timezone: "Europe/Berlin", Days: "mon-fri", Hours: []string{"08:00-12:00", "13:00-18:00"}},
+		"hamburg":  {Prefix: []string{"4940"}, Timezone: "Europe/Berlin", Days: "fri-mon", Hours: []string{"22:00-02:00"}},
+		"new york": {Prefix: []string{"1212", "1646"}, Timezone: "America/New_York", Days: "Mon-Sat", Hours: []string{"09:00-17:00"}},
+	})
+	assert.NoError(err)
+
+	assert.Equal("germany", matchSendWindow(windows, "493012345").name)
+	assert.Equal("hamburg", matchSendWindow(windows, "494012345").name)
+	assert.Equal("new york", matchSendWindow(windows, "16465550100").name)
+	assert.Equal("default", matchSendWindow(windows, "4412345").name)
+	assert.Nil(matchSendWindow(windows[1:], "4412345"))
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	newYork, _ := time.LoadLocation("America/New_York")
+	for _, test := range []struct {
+		window string
+		now    time.Time
+		next   time.Time
+	}{
+		// Wednesday
+		{"germany", time.Date(2026, 10, 14, 9, 0, 0, 0, berlin), time.Time{}},
+		{"germany", time.Date(2026, 10, 14, 12, 30, 0, 0, berlin), time.Date(2026, 10, 14, 13, 0, 0, 0, berlin)},
+		{"germany", time.Date(2026, 10, 14, 18, 0, 0, 0, berlin), time.Date(2026, 10, 15, 8, 0, 0, 0, berlin)},
+		// Friday evening, next on Monday
+		{"germany", time.Date(2026, 10, 16, 19, 0, 0, 0, berlin), time.Date(2026, 10, 19, 8, 0, 0, 0, berlin)},
+		// Time zones are converted
+		{"germany", time.Date(2026, 10, 14, 7, 30, 0, 0, time.UTC), time.Time{}},
+		{"new york", time.Date(2026, 10, 14, 9, 0, 0, 0, berlin), time.Date(2026, 10, 14, 9, 0, 0, 0, newYork)},
+		// Across midnight and the end of daylight saving time on 2026-10-25
+		{"hamburg", time.Date(2026, 10, 24, 1, 0, 0, 0, berlin), time.Time{}},
+		{"hamburg", time.Date(2026, 10, 20, 1, 0, 0, 0, berlin), time.Time{}},
+		{"hamburg", time.Date(2026, 10, 20, 3, 0, 0, 0, berlin), time.Date(2026, 10, 23, 22, 0, 0, 0, berlin)},
+		{"default", time.Date(2026, 10, 14, 23, 0, 0, 0, time.UTC), time.Date(2026, 10, 15, 7, 0, 0, 0, time.UTC)},
+	} {
+		var window *sendWindow
+		for _, w := range windows {
+			if w.name == test.window {
+				window = w
+			}
+		}
+		allowed, next := window.check(test.now)
+		assert.Equal(test.next.IsZero(), allowed, "%v at %v", test.window, test.now)
+		assert.True(test.next.Equal(next), "%v at %v: expected %v, got %v", test.window, test.now, test.next, next)
+	}
+}
+
+func TestSendWindowsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []struct {
+		cfg gofaxlib.SendWindowConfig
+		err string
+	}{
+		{gofaxlib.SendWindowConfig{}, `sendwindow "x": no hours given`},
+		{gofaxlib.SendWindowConfig{Hours: []string{"8-18"}}, `sendwindow "x": invalid hours "8-18"`},
+		{gofaxlib.SendWindowConfig{Hours: []string{"08:00-25:00"}}, `sendwindow "x": invalid hours "08:00-25:00"`},
+		{gofaxlib.SendWindowConfig{Hours: []string{"08:00-08:00"}}, `sendwindow "x": empty hours "08:00-08:00"`},
+		{gofaxlib.SendWindowConfig{Hours: []string{"08:00-18:00"}, Days: "mon-fry"}, `sendwindow "x": invalid day "mon-fry"`},
+		{gofaxlib.SendWindowConfig{Hours: []string{"08:00-18:00"}, Timezone: "Mars/Olympus"}, `sendwindow "x": unknown time zone Mars/Olympus`},
+	} {
+		_, err := loadSendWindows(map[string]*gofaxlib.SendWindowConfig{"x": &test.cfg})
+		assert.EqualError(err, test.err)
+	}
+
+	r, err := parseTimeRange("00:00-24:00")
+	assert.NoError(err)
+	assert.Equal(timeRange{0, 24 * 60}, r)
+}
@@ -0,0 +1,104 @@
+// This file is part of the GOfax.IP project - https://github.com/gonicus/gofaxip
+// Copyright (C) 2014 GONICUS GmbH, Germany - http://www.gonicus.de
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; version 2
+// of the License.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+package gofaxsend
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+)
+
+var sipHeaderName = regexp.MustCompile(`^X-[A-Za-z0-9-]+$`)
+
+// sipHeader adds the value of a qfile tag to the INVITE
+type sipHeader struct {
+	name string
+	tag  string
+}
+
+// Headers loaded by LoadSIPHeaders
+var sipHeaders []sipHeader
+
+// LoadSIPHeaders loads the sipheader settings of the [gofaxsend]
+// section. It has to be called after gofaxlib.LoadConfig.
+func LoadSIPHeaders() error {
+	headers, err := loadSIPHeaders(gofaxlib.Config.Gofaxsend.SIPHeader)
+	if err != nil {
+		return err
+	}
+	sipHeaders = headers
+	return nil
+}
+
+func loadSIPHeaders(entries []string) ([]sipHeader, error) {
+	headers := make([]sipHeader, 0, len(entries))
+	for _, entry := range entries {
+		name, tag, err := parseSIPHeader(entry)
+		if err != nil {
+			return nil, fmt.Errorf("sipheader %q: %w", entry, err)
+		}
+		if tag == "" {
+			return nil, fmt.Errorf("sipheader %q: qfile tag missing", entry)
+		}
+		headers = append(headers, sipHeader{name, tag})
+	}
+	return headers, nil
+}
+
+// parseSIPHeader splits "X-Name: value" into name and value
+func parseSIPHeader(s string) (string, string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("expected \"X-Name: value\"")
+	}
+	name := strings.TrimSpace(parts[0])
+	if !sipHeaderName.MatchString(name) {
+		return "", "", fmt.Errorf("invalid header name %q, names have to start with X-", name)
+	}
+	return name, strings.TrimSpace(parts[1]), nil
+}
+
+// jobSIPHeaders returns the configured headers with values from qf.
+// Tags not set in the qfile are skipped.
+func jobSIPHeaders(qf Qfiler) map[string]string {
+	headers := make(map[string]string)
+	for _, h := range sipHeaders {
+		if value := qf.GetString(h.tag); value != "" {
+			headers[h.name] = value
+		}
+	}
+	return headers
+}
+
+// formatSIPHeaders formats headers sorted by name for logging
+func formatSIPHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]string, len(names))
+	for i, name := range names {
+		fields[i] = name + "=" + headers[name]
+	}
+	return strings.Join(fields, ";")
+}
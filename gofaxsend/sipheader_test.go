@@ -0,0 +1,95 @@
+package gofaxsend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gonicus/gofaxip/gofaxlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSIPHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	headers, err := loadSIPHeaders([]string{"X-GOfax-JobID: jobid", "X-Owner:owner"})
+	assert.NoError(err)
+	assert.Equal([]sipHeader{{"X-GOfax-JobID", "jobid"}, {"X-Owner", "owner"}}, headers)
+
+	for entry, expected := range map[string]string{
+		"X-GOfax-JobID":   `sipheader "X-GOfax-JobID": expected "X-Name: value"`,
+		"X-GOfax-JobID: ": `sipheader "X-GOfax-JobID: ": qfile tag missing`,
+		"From: owner":     `sipheader "From: owner": invalid header name "From", names have to start with X-`,
+		"X-Job ID: jobid": `sipheader "X-Job ID: jobid": invalid header name "X-Job ID", names have to start with X-`,
+		"X-Job_ID: jobid": `sipheader "X-Job_ID: jobid": invalid header name "X-Job_ID", names have to start with X-`,
+	} {
+		_, err = loadSIPHeaders([]string{entry})
+		assert.EqualError(err, expected)
+	}
+}
+
+func TestJobSIPHeaders(t *testing.T) {
+	assert := assert.New(t)
+	sipHeaders = []sipHeader{{"X-GOfax-JobID", "jobid"}, {"X-GOfax-JobTag", "jobtag"}, {"X-GOfax-CommID", "commid"}}
+	defer func() { sipHeaders = nil }()
+
+	qf := NewQmemory(map[string][]string{"jobid": {"42"}, "jobtag": {""}, "commid": {"000000007"}})
+	headers := jobSIPHeaders(qf)
+	assert.Equal(map[string]string{"X-GOfax-JobID": "42", "X-GOfax-CommID": "000000007"}, headers)
+	assert.Equal("X-GOfax-CommID=000000007;X-GOfax-JobID=42", formatSIPHeaders(headers))
+}
+
+func TestSIPHeadersDynamicConfig(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	dir := gofaxlib.Config.Hylafax.Spooldir
+	script := filepath.Join(dir, "DynamicConfig")
+	must(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'SIPHeader: X-GOfax-Owner: dc, '\"$2\"\necho 'SIPHeader: X-GOfax-JobTag:'\necho 'SIPHeader: X-Customer: 1234'\necho 'SIPHeader: Contact: x'\n"), 0700))
+	gofaxlib.Config.Freeswitch.Gateway = []string{"a"}
+	gofaxlib.Config.Gofaxsend.DynamicConfig = script
+	sipHeaders = []sipHeader{{"X-GOfax-JobID", "jobid"}, {"X-GOfax-Owner", "owner"}, {"X-GOfax-JobTag", "jobtag"}}
+	defer func() {
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		gofaxlib.Config.Gofaxsend.DynamicConfig = ""
+		sipHeaders = nil
+	}()
+
+	document, err := filepath.Abs("testdata/pages,3.tif")
+	must(t, err)
+	filename := filepath.Join(dir, "q1")
+	must(t, ioutil.WriteFile(filename, []byte("jobid:1\nowner:bob\njobtag:invoice\nnumber:123\nexternal:123\nfax:0::"+document+"\n"), 0600))
+
+	var out bytes.Buffer
+	dialed, err := DryRun(&out, filename, "modem", true)
+	assert.NoError(err)
+	assert.True(dialed)
+	assert.Contains(out.String(), "Ignoring SIPHeader \"Contact: x\" from DynamicConfig")
+	assert.Contains(out.String(), "SIP headers: X-Customer=1234;X-GOfax-JobID=1;X-GOfax-Owner=dc, bob\n")
+	assert.Contains(out.String(), `,sip_h_X-Customer='1234',sip_h_X-GOfax-JobID='1',sip_h_X-GOfax-Owner='dc\, bob'}sofia/gateway/a/123`)
+}
+
+func TestSIPHeadersUnrepresentable(t *testing.T) {
+	assert := assert.New(t)
+	setupGatewayTest(t)
+	dir := gofaxlib.Config.Hylafax.Spooldir
+	gofaxlib.Config.Freeswitch.Gateway = []string{"a"}
+	sipHeaders = []sipHeader{{"X-GOfax-JobID", "jobid"}, {"X-GOfax-JobTag", "jobtag"}}
+	defer func() {
+		gofaxlib.Config.Freeswitch.Gateway = nil
+		sipHeaders = nil
+	}()
+
+	document, err := filepath.Abs("testdata/pages,3.tif")
+	must(t, err)
+	filename := filepath.Join(dir, "q1")
+	must(t, ioutil.WriteFile(filename, []byte("jobid:1\njobtag:Invoice {42}\nnumber:123\nexternal:123\nfax:0::"+document+"\n"), 0600))
+
+	// The job is sent without the header
+	var out bytes.Buffer
+	dialed, err := DryRun(&out, filename, "modem", true)
+	assert.NoError(err)
+	assert.True(dialed)
+	assert.Contains(out.String(), "Not sending SIP header X-GOfax-JobTag: dialstring variable sip_h_X-GOfax-JobTag: invalid character '{'")
+	assert.Contains(out.String(), `,sip_h_X-GOfax-JobID='1'}sofia/gateway/a/123`)
+}
@@ -18,13 +18,11 @@
 package gofaxsend
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/gonicus/gofaxip/gofaxlib"
 
@@ -32,6 +30,7 @@ import (
 )
 
 type transmission struct {
+	ctx    context.Context
 	faxjob FaxJob
 	conn   *eventsocket.Connection
 
@@ -40,11 +39,22 @@ type transmission struct {
 	resultChan chan *gofaxlib.FaxResult
 
 	sessionlog gofaxlib.SessionLogger
+
+	// Called with the used gateway when the call is established
+	connected func(gateway string)
+
+	// Only prepare the call, don't change the gateway state
+	dryRun bool
+
+	// Half-open gateways tested by this call
+	probes []string
 }
 
-func transmit(faxjob FaxJob, sessionlog gofaxlib.SessionLogger) *transmission {
+func transmit(ctx context.Context, faxjob FaxJob, sessionlog gofaxlib.SessionLogger, connected func(gateway string)) *transmission {
 	t := &transmission{
+		ctx:        ctx,
 		faxjob:     faxjob,
+		connected:  connected,
 		pageChan:   make(chan *gofaxlib.PageResult),
 		errorChan:  make(chan FaxError),
 		resultChan: make(chan *gofaxlib.FaxResult),
@@ -69,18 +79,8 @@ func (t *transmission) Result() <-chan *gofaxlib.FaxResult {
 // Connect to FreeSWITCH and originate a txfax
 func (t *transmission) start() {
 
-	if t.faxjob.Number == "" {
-		t.errorChan <- NewFaxError("Number to dial is empty", false)
-		return
-	}
-
-	if len(t.faxjob.Gateways) == 0 {
-		t.errorChan <- NewFaxError("Gateway not set", false)
-		return
-	}
-
-	if _, err := os.Stat(t.faxjob.Filename); err != nil {
-		t.errorChan <- NewFaxError(err.Error(), false)
+	if faxerr := t.validate(); faxerr != nil {
+		t.errorChan <- faxerr
 		return
 	}
 
@@ -104,103 +104,57 @@ func (t *transmission) start() {
 		return
 	}
 
-	// Check if T.38 should be enabled
-	requestT38 := gofaxlib.Config.Gofaxsend.RequestT38
-	enableT38 := gofaxlib.Config.Gofaxsend.EnableT38
-
-	fallback, err := gofaxlib.GetSoftmodemFallback(t.conn, t.faxjob.Number)
-	if err != nil {
-		t.sessionlog.Log(err)
-	}
-	if fallback {
-		t.sessionlog.Logf("Softmodem fallback active for destination %s, disabling T.38", t.faxjob.Number)
-		enableT38 = false
-		requestT38 = false
-	}
-
-	// Collect dialstring variables
-	dsVariablesMap := map[string]string{
-		"ignore_early_media":           "true",
-		"origination_uuid":             t.faxjob.UUID.String(),
-		"origination_caller_id_number": t.faxjob.Cidnum,
-		"origination_caller_id_name":   t.faxjob.Cidname,
-		"fax_ident":                    t.faxjob.Ident,
-		"fax_header":                   t.faxjob.Header,
-		"fax_use_ecm":                  strconv.FormatBool(t.faxjob.UseECM),
-		"fax_disable_v17":              strconv.FormatBool(t.faxjob.DisableV17),
-		"fax_enable_t38":               strconv.FormatBool(enableT38),
-		"fax_enable_t38_request":       strconv.FormatBool(requestT38),
-		"fax_verbose":                  strconv.FormatBool(gofaxlib.Config.Freeswitch.Verbose),
-	}
-
-	// Look up variable overrides for given number
-	overrideRealm := fmt.Sprintf("override-%s", t.faxjob.Number)
-	overrides, err := gofaxlib.FreeSwitchDBList(t.conn, overrideRealm)
-	if err != nil {
-		if strings.TrimSpace(err.Error()) != "no reply" {
-			t.sessionlog.Log(err)
-		}
-	} else {
-		for _, varName := range overrides {
-			varValue, err := gofaxlib.FreeSwitchDBSelect(t.conn, overrideRealm, varName)
-			if err != nil {
-				if strings.TrimSpace(err.Error()) != "no reply" {
-					t.sessionlog.Log(err)
-				}
-			} else {
-				t.sessionlog.Log(fmt.Sprintf("Overriding dialstring variable %s=%s", varName, varValue))
-				dsVariablesMap[varName] = varValue
-			}
-		}
-	}
-
-	// Assemble dialstring
-	var dsVariables bytes.Buffer
-	var dsGateways bytes.Buffer
-
-	for k, v := range dsVariablesMap {
-		if dsVariables.Len() > 0 {
-			dsVariables.WriteByte(',')
+	// Let other calls test half-open gateways if the result of this call
+	// didn't decide about their circuits
+	defer func() {
+		if err := endGatewayProbes(t.probes); err != nil {
+			t.sessionlog.Log("Error updating gateway state:", err)
 		}
-		dsVariables.WriteString(fmt.Sprintf("%v='%v'", k, v))
+	}()
+	gateways, originate, faxerr := t.prepare()
+	if faxerr != nil {
+		t.errorChan <- faxerr
+		return
 	}
 
-	// Try gateways in configured order
-	for _, gw := range t.faxjob.Gateways {
-		if dsGateways.Len() > 0 {
-			dsGateways.WriteByte('|')
-		}
-		dsGateways.WriteString(fmt.Sprintf("sofia/gateway/%v/%v", gw, t.faxjob.Number))
+	// Cancelled transmissions can be retried, the caller decides
+	if t.ctx.Err() != nil {
+		t.errorChan <- NewFaxError("Transmission cancelled", true)
+		return
 	}
 
-	dialstring := fmt.Sprintf("{%v}%v", dsVariables.String(), dsGateways.String())
-	t.sessionlog.Logf("Dialstring: %v", dialstring)
-
 	// Originate call
-	t.sessionlog.Log("Originating channel to", t.faxjob.Number, "using gateway", strings.Join(t.faxjob.Gateways, ","))
-	_, err = t.conn.Send(fmt.Sprintf("api originate %v, &txfax(%v)", dialstring, t.faxjob.Filename))
+	t.sessionlog.Log("Originating channel to", t.faxjob.Number, "using gateway", strings.Join(gateways, ","))
+	_, err = t.conn.Send("api " + originate)
 	if err != nil {
 		t.conn.Send(fmt.Sprintf("uuid_dump %v", t.faxjob.UUID))
 		hangupcause := strings.TrimSpace(err.Error())
 		t.sessionlog.Log("Originate failed with hangup cause", hangupcause)
-		if gofaxlib.FailedHangupcause(hangupcause) {
-			t.errorChan <- NewFaxError(hangupcause+" (retry disabled)", false)
-		} else {
-			t.errorChan <- NewFaxError(hangupcause, true)
+		if gatewayFailureCauses[hangupcause] {
+			// All gateways in the dialstring were tried
+			for _, gw := range gateways {
+				if err := recordGatewayFailure(gw, hangupcause, false); err != nil {
+					t.sessionlog.Log("Error updating gateway state:", err)
+				}
+			}
 		}
+		t.errorChan <- newHangupError(hangupcause, !gofaxlib.FailedHangupcause(hangupcause))
 		return
 	}
 	t.sessionlog.Log("Originate successful")
+	gateway := t.usedGateway(gateways)
+	if t.connected != nil {
+		t.connected(gateway)
+	}
+	if err = recordGatewaySuccess(gateway); err != nil {
+		t.sessionlog.Log("Error updating gateway state:", err)
+	}
 
 	result := gofaxlib.NewFaxResult(t.faxjob.UUID, t.sessionlog)
 
 	es := gofaxlib.NewEventStream(t.conn)
 	var pages uint
 
-	// Listen for system signals to be able to kill the channel
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
-
 	for {
 		select {
 		case ev := <-es.Events():
@@ -249,11 +203,167 @@ func (t *transmission) start() {
 		case err := <-es.Errors():
 			t.errorChan <- NewFaxError(err.Error(), true)
 			return
-		case kill := <-sigchan:
-			t.sessionlog.Logf("gofaxsend received signal %v, destroying freeswitch channel %v", kill, t.faxjob.UUID)
+		case <-t.ctx.Done():
+			t.sessionlog.Logf("Transmission cancelled, destroying freeswitch channel %v", t.faxjob.UUID)
 			t.conn.Send(fmt.Sprintf("api uuid_kill %v", t.faxjob.UUID))
-			t.errorChan <- NewFaxError(fmt.Sprintf("Killed by signal %v", kill), false)
+			t.errorChan <- NewFaxError("Transmission cancelled", true)
+			return
+		}
+	}
+
+}
+
+// validate checks if the fax job can be sent
+func (t *transmission) validate() FaxError {
+	if t.faxjob.Number == "" {
+		return NewFaxError("Number to dial is empty", false)
+	}
+
+	if len(t.faxjob.Gateways) == 0 {
+		return NewFaxError("Gateway not set", false)
+	}
+
+	if _, err := os.Stat(t.faxjob.Filename); err != nil {
+		return NewFaxError(err.Error(), false)
+	}
+	return nil
+}
+
+// prepare selects the gateways to try and assembles the originate command
+func (t *transmission) prepare() ([]string, string, FaxError) {
+	// Skip failing gateways
+	gateways := t.availableGateways()
+	if len(gateways) == 0 {
+		return nil, "", NewFaxError("All gateways are unavailable", true)
+	}
+
+	// Check if T.38 should be enabled
+	requestT38 := gofaxlib.Config.Gofaxsend.RequestT38
+	enableT38 := gofaxlib.Config.Gofaxsend.EnableT38
+
+	if t.conn != nil {
+		fallback, err := gofaxlib.GetSoftmodemFallback(t.conn, t.faxjob.Number)
+		if err != nil {
+			t.sessionlog.Log(err)
+		}
+		if fallback {
+			t.sessionlog.Logf("Softmodem fallback active for destination %s, disabling T.38", t.faxjob.Number)
+			enableT38 = false
+			requestT38 = false
+		}
+	}
+
+	// Collect dialstring variables
+	ds := gofaxlib.NewDialstring()
+	for _, v := range []struct{ name, value string }{
+		{"ignore_early_media", "true"},
+		{"origination_uuid", t.faxjob.UUID.String()},
+		{"origination_caller_id_number", t.faxjob.Cidnum},
+		{"origination_caller_id_name", t.faxjob.Cidname},
+		{"fax_ident", t.faxjob.Ident},
+		{"fax_header", t.faxjob.Header},
+		{"fax_use_ecm", strconv.FormatBool(t.faxjob.UseECM)},
+		{"fax_disable_v17", strconv.FormatBool(t.faxjob.DisableV17)},
+		{"fax_enable_t38", strconv.FormatBool(enableT38)},
+		{"fax_enable_t38_request", strconv.FormatBool(requestT38)},
+		{"fax_verbose", strconv.FormatBool(gofaxlib.Config.Freeswitch.Verbose)},
+	} {
+		if err := ds.Set(v.name, v.value); err != nil {
+			return nil, "", NewFaxError(err.Error(), false)
+		}
+	}
+
+	// Headers only carry metadata like free-text job tags, never fail the job because of them
+	for name, value := range t.faxjob.SIPHeaders {
+		if err := ds.Set("sip_h_"+name, value); err != nil {
+			t.sessionlog.Logf("Not sending SIP header %s: %v", name, err)
+		}
+	}
+
+	// Look up variable overrides for given number
+	if t.conn != nil {
+		overrideRealm := fmt.Sprintf("override-%s", t.faxjob.Number)
+		overrides, err := gofaxlib.FreeSwitchDBList(t.conn, overrideRealm)
+		if err != nil {
+			if strings.TrimSpace(err.Error()) != "no reply" {
+				t.sessionlog.Log(err)
+			}
+		} else {
+			for _, varName := range overrides {
+				varValue, err := gofaxlib.FreeSwitchDBSelect(t.conn, overrideRealm, varName)
+				if err != nil {
+					if strings.TrimSpace(err.Error()) != "no reply" {
+						t.sessionlog.Log(err)
+					}
+				} else if err = ds.Set(varName, varValue); err != nil {
+					t.sessionlog.Logf("Ignoring dialstring override: %v", err)
+				} else {
+					t.sessionlog.Log(fmt.Sprintf("Overriding dialstring variable %s=%s", varName, varValue))
+				}
+			}
+		}
+	}
+
+	// Try gateways in configured order
+	for _, gw := range gateways {
+		number := t.faxjob.Number
+		if gwNumber, ok := t.faxjob.GatewayNumbers[gw]; ok {
+			number = gwNumber
+		}
+		if err := ds.AddEndpoint(fmt.Sprintf("sofia/gateway/%v/%v", gw, number)); err != nil {
+			return nil, "", NewFaxError(err.Error(), false)
+		}
+	}
+
+	dialstring := ds.String()
+	t.sessionlog.Logf("Dialstring: %v", dialstring)
+
+	return gateways, fmt.Sprintf("originate %v, &txfax(%v)", dialstring, t.faxjob.Filename), nil
+}
+
+// availableGateways returns the gateways of the job without those with
+// an open circuit breaker or, if enabled, those reported as down by FreeSWITCH
+func (t *transmission) availableGateways() []string {
+	open, probes, err := openCircuits(t.faxjob.Gateways, !t.dryRun)
+	t.probes = probes
+	if err != nil {
+		t.sessionlog.Log("Error reading gateway state:", err)
+	}
+
+	var gateways []string
+	for _, gw := range t.faxjob.Gateways {
+		if open[gw] {
+			t.sessionlog.Logf("Skipping gateway %v, circuit breaker is open", gw)
+			continue
+		}
+		if gofaxlib.Config.Freeswitch.CheckGatewayStatus && t.conn != nil {
+			status, err := t.conn.Send(fmt.Sprintf("api sofia status gateway %v", gw))
+			if err != nil {
+				t.sessionlog.Logf("Error querying status of gateway %v: %v", gw, err)
+			} else if ok, reason := parseGatewayStatus(status.Body); !ok {
+				t.sessionlog.Logf("Skipping gateway %v, it is unavailable: %v", gw, reason)
+				if !t.dryRun {
+					if err = recordGatewayFailure(gw, "unavailable: "+reason, true); err != nil {
+						t.sessionlog.Log("Error updating gateway state:", err)
+					}
+				}
+				continue
+			}
 		}
+		gateways = append(gateways, gw)
 	}
+	return gateways
+}
 
+// usedGateway returns the gateway of the established call
+func (t *transmission) usedGateway(gateways []string) string {
+	if ev, err := t.conn.Send(fmt.Sprintf("api uuid_getvar %v sip_gateway_name", t.faxjob.UUID)); err == nil {
+		name := strings.TrimSpace(ev.Body)
+		for _, gw := range gateways {
+			if gw == name {
+				return gw
+			}
+		}
+	}
+	return gateways[0]
 }